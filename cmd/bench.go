@@ -0,0 +1,72 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchServer   string
+	benchClient   string
+	benchDuration time.Duration
+
+	benchCmd = &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the throughput between two linked namespaces with iperf3",
+		Run: func(cmd *cobra.Command, args []string) {
+			s := state.LoadResources()
+			if s == nil {
+				logError(network.Errorf(network.ErrNotFound, "no resources"))
+				return
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			result, err := s.MeasureThroughput(ctx, benchServer, benchClient, benchDuration)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			b, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				logError(err)
+				return
+			}
+			fmt.Println(string(b))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().StringVar(&benchServer, "server", "", "namespace running the iperf3 server")
+	benchCmd.Flags().StringVar(&benchClient, "client", "", "namespace running the iperf3 client")
+	benchCmd.Flags().DurationVar(&benchDuration, "duration", 5*time.Second, "duration of the measurement")
+	benchCmd.MarkFlagRequired("server")
+	benchCmd.MarkFlagRequired("client")
+}
@@ -14,43 +14,46 @@
 package cmd
 
 import (
-	"io/ioutil"
-
-	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
 	"github.com/Shikugawa/ayame/pkg/state"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	configPath string
+	configPath     string
+	onlyNamespaces []string
 
 	createCmd = &cobra.Command{
 		Use:   "create",
 		Short: "Create network environment from config",
 		Run: func(cmd *cobra.Command, args []string) {
-			bytes, err := ioutil.ReadFile(configPath)
-			if err != nil {
-				log.Errorf(err.Error())
+			if err := network.PreflightCheck(); err != nil {
+				logError(err)
 				return
 			}
 
-			cfg, err := config.ParseConfig(bytes)
+			cfg, err := readConfig(configPath)
 			if err != nil {
-				log.Errorf(err.Error())
+				logError(err)
 				return
 			}
 
-			st, err := state.InitResources(cfg, false)
+			var st *state.State
+			if len(onlyNamespaces) != 0 {
+				st, err = state.InitSubset(cfg, onlyNamespaces, false)
+			} else {
+				st, err = state.InitResources(cfg, false)
+			}
 			if err != nil {
-				log.Errorf(err.Error())
+				logError(err)
 				return
 			}
 
 			log.Info("succeeded to initialize")
 
 			if err := st.SaveState(); err != nil {
-				log.Errorf(err.Error())
+				logError(err)
 			}
 		},
 	}
@@ -59,6 +62,10 @@ var (
 func init() {
 	rootCmd.AddCommand(createCmd)
 
-	createCmd.Flags().StringVarP(&configPath, "config", "c", "", "config path")
+	createCmd.Flags().StringVarP(&configPath, "config", "c", "", "config file or directory path")
 	createCmd.MarkFlagRequired("config")
+	createCmd.Flags().StringSliceVar(&onlyNamespaces, "only", nil, "create only these namespaces and the links attached to them")
+
+	createCmd.Flags().DurationVar(&network.InterfaceWaitTimeout, "wait-timeout", network.InterfaceWaitTimeout, "timeout to wait for devices moved into namespaces")
+	createCmd.Flags().DurationVar(&network.AddressWaitTimeout, "address-timeout", network.AddressWaitTimeout, "timeout to wait for addresses to be usable, e.g. IPv6 DAD. zero doesn't wait")
 }
@@ -14,6 +14,12 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/Shikugawa/ayame/pkg/network"
 	"github.com/Shikugawa/ayame/pkg/state"
 	"github.com/spf13/cobra"
 
@@ -22,18 +28,111 @@ import (
 
 // deleteCmd represents the delete command
 var (
+	showTeardownOrder bool
+	teardownScript    bool
+	deleteDryRun      bool
+
 	deleteCmd = &cobra.Command{
 		Use:   "delete",
 		Short: "delete saved network envs",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := state.DisposeResources(); err != nil {
-				log.Errorln(err.Error())
+			if showTeardownOrder {
+				st := state.LoadResources()
+				if st == nil {
+					logError(network.Errorf(network.ErrNotFound, "resources have already cleared."))
+					return
+				}
+				ls, err := state.DumpTeardownOrder(st.TeardownOrder())
+				if err != nil {
+					logError(err)
+					return
+				}
+				fmt.Println(ls)
+				return
+			}
+
+			if teardownScript {
+				st := state.LoadResources()
+				if st == nil {
+					logError(network.Errorf(network.ErrNotFound, "resources have already cleared."))
+					return
+				}
+				// Only the script goes to stdout.
+				log.SetOutput(os.Stderr)
+				fmt.Print(network.ScriptHeader)
+				network.SetScriptWriter(os.Stdout)
+				defer network.SetScriptWriter(nil)
+				if err := st.PlanTeardown(); err != nil {
+					logError(err)
+				}
+				return
+			}
+
+			if deleteDryRun && selector == "" {
+				logError(fmt.Errorf("--dry-run requires --selector"))
+				return
+			}
+
+			// Dry-run doesn't run any command, so it doesn't require root.
+			if !deleteDryRun {
+				if err := network.PreflightCheck(); err != nil {
+					logError(err)
+					return
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			var report *state.DisposeReport
+			var err error
+			if selector != "" {
+				report, err = disposeWhere(ctx)
+			} else {
+				report, err = state.DisposeResourcesContext(ctx)
+			}
+			if report != nil && output != "" {
+				if eerr := report.Encode(os.Stdout, output); eerr != nil {
+					logError(eerr)
+				}
+			} else if report != nil {
+				if ls, derr := report.Dump(); derr == nil {
+					fmt.Println(ls)
+				}
+			}
+			if err != nil {
+				logError(err)
 				return
 			}
 		},
 	}
 )
 
+// disposeWhere deletes only the namespaces matching the selector and their
+// links.
+func disposeWhere(ctx context.Context) (*state.DisposeReport, error) {
+	labels, err := state.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	st := state.LoadResources()
+	if st == nil {
+		return nil, network.Errorf(network.ErrNotFound, "resources have already cleared.")
+	}
+
+	return st.DisposeWhere(ctx, labels, deleteDryRun)
+}
+
 func init() {
 	rootCmd.AddCommand(deleteCmd)
+
+	deleteCmd.Flags().BoolVar(&network.DrainNamespaces, "drain", network.DrainNamespaces, "terminate the processes in the namespaces before deleting them")
+	deleteCmd.Flags().DurationVar(&network.DrainGracePeriod, "drain-grace", network.DrainGracePeriod, "grace period after SIGTERM before SIGKILL on --drain")
+	deleteCmd.Flags().BoolVar(&showTeardownOrder, "order", false, "print the order of deletions without deleting anything")
+	deleteCmd.Flags().StringVar(&selector, "selector", "", "delete only the namespaces with the labels and the links used only by them, e.g. run=42")
+	deleteCmd.Flags().BoolVar(&deleteDryRun, "dry-run", false, "show what --selector would delete without deleting anything")
+	deleteCmd.Flags().BoolVar(&state.WarnOrphansOnDispose, "warn-orphans", state.WarnOrphansOnDispose, "warn about the resources with the prefix left on the host which no state tracks")
+	deleteCmd.Flags().BoolVar(&state.CleanOrphansOnDispose, "clean-orphans", state.CleanOrphansOnDispose, "delete the resources with the prefix left on the host which no state tracks. requires prefix")
+	deleteCmd.Flags().BoolVar(&teardownScript, "script", false, "print the bash script deleting the resources without deleting anything. the state is kept")
 }
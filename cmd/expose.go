@@ -0,0 +1,86 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exposeNamespace string
+	exposeHostPort  uint16
+	exposePort      uint16
+	exposeBind      string
+
+	exposeCmd = &cobra.Command{
+		Use:   "expose",
+		Short: "Forward a TCP port on the host to a namespace with socat",
+		Run: func(cmd *cobra.Command, args []string) {
+			st := state.LoadResources()
+			if st == nil {
+				logError(network.Errorf(network.ErrNotFound, "no resources"))
+				return
+			}
+
+			if _, err := st.ExposePort(exposeNamespace, exposeBind, exposeHostPort, exposePort, false); err != nil {
+				logError(err)
+				return
+			}
+
+			if err := st.SaveState(); err != nil {
+				logError(err)
+			}
+		},
+	}
+
+	unexposeCmd = &cobra.Command{
+		Use:   "unexpose",
+		Short: "Stop forwarding the host port started by expose",
+		Run: func(cmd *cobra.Command, args []string) {
+			st := state.LoadResources()
+			if st == nil {
+				logError(network.Errorf(network.ErrNotFound, "no resources"))
+				return
+			}
+
+			if err := st.UnexposePort(exposeHostPort, false); err != nil {
+				logError(err)
+				return
+			}
+
+			if err := st.SaveState(); err != nil {
+				logError(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(exposeCmd)
+	rootCmd.AddCommand(unexposeCmd)
+
+	exposeCmd.Flags().StringVar(&exposeNamespace, "namespace", "", "namespace running the server")
+	exposeCmd.Flags().Uint16Var(&exposePort, "port", 0, "port of the server in the namespace")
+	exposeCmd.Flags().StringVar(&exposeBind, "bind", network.DefaultPortForwardBind, "address on the host to listen on. 0.0.0.0 exposes the port to the network")
+	exposeCmd.MarkFlagRequired("namespace")
+	exposeCmd.MarkFlagRequired("port")
+
+	for _, c := range []*cobra.Command{exposeCmd, unexposeCmd} {
+		c.Flags().Uint16Var(&exposeHostPort, "host-port", 0, "port on the host")
+		c.MarkFlagRequired("host-port")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	hintsPath string
+
+	importCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import existing namespaces into state",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := network.PreflightCheck(); err != nil {
+				logError(err)
+				return
+			}
+
+			var hints []*config.LinkConfig
+			if len(hintsPath) != 0 {
+				bytes, err := ioutil.ReadFile(hintsPath)
+				if err != nil {
+					logError(err)
+					return
+				}
+
+				cfg, err := config.ParseConfig(bytes)
+				if err != nil {
+					logError(err)
+					return
+				}
+				hints = cfg.Links
+			}
+
+			st, err := state.Import(hints)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			log.Info("succeeded to import")
+
+			if err := st.SaveState(); err != nil {
+				logError(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&hintsPath, "config", "c", "", "config path whose links are used as hints of link modes")
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	orphanPrefix string
+	deleteOrphan bool
+
+	orphansCmd = &cobra.Command{
+		Use:   "orphans",
+		Short: "list resources on the host which aren't tracked by state",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Without a prefix every namespace on the host matches, including
+			// the ones of other tools.
+			if deleteOrphan && orphanPrefix == "" {
+				logError(fmt.Errorf("--delete requires --prefix"))
+				return
+			}
+
+			orphans, err := state.FindOrphans(orphanPrefix)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			b, err := json.MarshalIndent(orphans, "", "  ")
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(string(b))
+
+			if !deleteOrphan {
+				return
+			}
+
+			if err := orphans.Cleanup(false); err != nil {
+				logError(err)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(orphansCmd)
+
+	orphansCmd.Flags().StringVarP(&orphanPrefix, "prefix", "p", "", "prefix of the resources")
+	orphansCmd.Flags().BoolVar(&deleteOrphan, "delete", false, "delete the listed resources. requires --prefix")
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pauseCmd = &cobra.Command{
+		Use:   "pause",
+		Short: "set all the links down while keeping namespaces",
+		Run: func(cmd *cobra.Command, args []string) {
+			setPaused(true)
+		},
+	}
+
+	resumeCmd = &cobra.Command{
+		Use:   "resume",
+		Short: "set the links paused by pause up again",
+		Run: func(cmd *cobra.Command, args []string) {
+			setPaused(false)
+		},
+	}
+)
+
+func setPaused(paused bool) {
+	st := state.LoadResources()
+	if st == nil {
+		logError(network.Errorf(network.ErrNotFound, "no resources"))
+		return
+	}
+
+	var err error
+	if paused {
+		err = st.PauseLinks(false)
+	} else {
+		err = st.ResumeLinks(false)
+	}
+	if err != nil {
+		logError(err)
+	}
+
+	// The state is saved even on failure since it tracks the partial result.
+	if err := st.SaveState(); err != nil {
+		logError(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd and planCmd never run any command, so they don't require root.
+var (
+	planScript bool
+
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate config without privileges",
+		Run: func(cmd *cobra.Command, args []string) {
+			if _, err := readConfig(configPath); err != nil {
+				logError(err)
+				return
+			}
+
+			log.Info("config is valid")
+		},
+	}
+
+	planCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show the resources created from config without privileges",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := readConfig(configPath)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			if planScript {
+				// Only the script goes to stdout.
+				log.SetOutput(os.Stderr)
+				fmt.Print(network.ScriptHeader)
+				network.SetScriptWriter(os.Stdout)
+				defer network.SetScriptWriter(nil)
+			}
+
+			st, err := state.InitResources(cfg, true)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			if planScript {
+				return
+			}
+
+			if output != "" {
+				report, err := st.Report()
+				if err != nil {
+					logError(err)
+					return
+				}
+				if err := report.Encode(os.Stdout, output); err != nil {
+					logError(err)
+				}
+				return
+			}
+
+			ls, err := st.DumpAll()
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(ls)
+		},
+	}
+)
+
+// readConfig loads the config from the file or the directory of files.
+func readConfig(path string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range config.CheckTopology(cfg.Namespaces, cfg.Links).Warnings() {
+		log.Warn(w)
+	}
+
+	return cfg, nil
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(planCmd)
+
+	for _, c := range []*cobra.Command{validateCmd, planCmd} {
+		c.Flags().StringVarP(&configPath, "config", "c", "", "config file or directory path")
+		c.MarkFlagRequired("config")
+	}
+
+	planCmd.Flags().BoolVar(&planScript, "script", false, "print the bash script running the commands instead of the resources")
+}
@@ -14,9 +14,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -33,9 +37,75 @@ var rootCmd = &cobra.Command{
 	Short: "A simple network laboratory builder with Linux namespaces",
 }
 
+var (
+	profile  string
+	auditLog string
+	// output is the format of the reports. Each command prints its own default
+	// form if empty.
+	output string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "profile of the state. "+state.ProfileEnv+" is used if empty")
+	rootCmd.PersistentFlags().StringVar(&auditLog, "audit-log", "", "append every command changing the host to this file as JSON Lines")
+	rootCmd.PersistentFlags().BoolVar(&state.IgnoreStateIntegrity, "force-state", state.IgnoreStateIntegrity, "load the state even if it is modified after saved or its version is newer")
+	rootCmd.PersistentFlags().StringVar(&output, "output", "", "format of the reports: json, yaml or table")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if output != "" {
+			if err := state.ValidOutputFormat(output); err != nil {
+				return err
+			}
+		}
+		// Errors are written to stderr as JSON by logError, so the text logs
+		// mustn't be interleaved with them.
+		if output == state.OutputJSON {
+			log.SetOutput(ioutil.Discard)
+		}
+
+		if auditLog != "" {
+			f, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open audit log: %w", err)
+			}
+			network.SetAuditWriter(f)
+		}
+
+		if profile == "" {
+			_, err := state.ActiveProfile()
+			return err
+		}
+		return state.SetProfile(profile)
+	}
+
+	rootCmd.PersistentFlags().DurationVar(&network.CommandTimeout, "command-timeout", network.CommandTimeout, "timeout of each command")
+	rootCmd.PersistentFlags().IntVar(&network.NetnsDeleteRetries, "netns-delete-retries", network.NetnsDeleteRetries, "retries of deleting the busy namespace")
+	rootCmd.PersistentFlags().BoolVar(&network.KillLingeringProcesses, "kill-lingering", network.KillLingeringProcesses, "terminate the processes left in the busy namespace, and kill them after the drain grace period, before retrying the deletion")
+}
+
+// logError logs err, or writes it to stderr as a JSON array of
+// network.ErrorRecord with --output json so that tooling can branch on the
+// codes.
+func logError(err error) {
+	if output != state.OutputJSON {
+		log.Errorf(err.Error())
+		return
+	}
+
+	b, merr := json.Marshal(network.ErrorRecords(err))
+	if merr != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(b))
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		if output == state.OutputJSON {
+			logError(err)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,83 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	forceRestore bool
+
+	snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "save, restore and list snapshots of state",
+	}
+
+	snapshotSaveCmd = &cobra.Command{
+		Use:   "save [label]",
+		Short: "save the current state as a snapshot",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			label := ""
+			if len(args) != 0 {
+				label = args[0]
+			}
+
+			if _, err := state.Snapshot(label); err != nil {
+				logError(err)
+			}
+		},
+	}
+
+	snapshotRestoreCmd = &cobra.Command{
+		Use:   "restore <label>",
+		Short: "restore the snapshot as the current state",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := state.Restore(args[0], forceRestore); err != nil {
+				logError(err)
+			}
+		},
+	}
+
+	snapshotListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list snapshots",
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshots, err := state.ListSnapshots()
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			for _, s := range snapshots {
+				fmt.Printf("%s\t%s\n", s.Label, s.CreatedAt.Format(time.RFC3339))
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotSaveCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+
+	snapshotRestoreCmd.Flags().BoolVar(&forceRestore, "force", false, "overwrite the current state")
+}
@@ -14,14 +14,25 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 
-	log "github.com/sirupsen/logrus"
-
+	"github.com/Shikugawa/ayame/pkg/network"
 	"github.com/Shikugawa/ayame/pkg/state"
 	"github.com/spf13/cobra"
 )
 
+var (
+	rawStatus     bool
+	tableStatus   bool
+	matrixStatus  bool
+	liveStatus    bool
+	mermaidStatus bool
+	selector      string
+)
+
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
 	Use:   "status",
@@ -29,13 +40,107 @@ var statusCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		s := state.LoadResources()
 		if s == nil {
-			log.Errorf("no resources")
+			logError(network.Errorf(network.ErrNotFound, "no resources"))
+			return
+		}
+
+		if rawStatus {
+			ls, err := s.DumpAll()
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(ls)
+			return
+		}
+
+		if matrixStatus {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			matrix, err := s.ConnectivityMatrix(ctx)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			if output != "" {
+				if err := matrix.Encode(os.Stdout, output); err != nil {
+					logError(err)
+				}
+				return
+			}
+
+			fmt.Print(matrix.Dump())
+			return
+		}
+
+		if liveStatus {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			inspections, err := s.Inspect(ctx)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			ls, err := state.DumpInspection(inspections)
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(ls)
 			return
 		}
 
-		ls, err := s.DumpAll()
+		if mermaidStatus {
+			ls, err := s.ToMermaid()
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(ls)
+			return
+		}
+
+		if tableStatus {
+			ls, err := s.DumpTable()
+			if err != nil {
+				logError(err)
+				return
+			}
+
+			fmt.Println(ls)
+			return
+		}
+
+		report, err := s.Report()
 		if err != nil {
-			log.Errorf(err.Error())
+			logError(err)
+			return
+		}
+
+		labels, err := state.ParseLabelSelector(selector)
+		if err != nil {
+			logError(err)
+			return
+		}
+		report.SelectNamespaces(labels)
+
+		if output != "" {
+			if err := report.Encode(os.Stdout, output); err != nil {
+				logError(err)
+			}
+			return
+		}
+
+		ls, err := report.Dump()
+		if err != nil {
+			logError(err)
 			return
 		}
 
@@ -45,4 +150,11 @@ var statusCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVar(&rawStatus, "raw", false, "dump the internal state as is")
+	statusCmd.Flags().BoolVar(&tableStatus, "table", false, "dump devices as a table")
+	statusCmd.Flags().BoolVar(&matrixStatus, "matrix", false, "ping between all the namespaces and dump the connectivity matrix")
+	statusCmd.Flags().BoolVar(&liveStatus, "live", false, "dump addresses and routes captured from the kernel")
+	statusCmd.Flags().StringVar(&selector, "selector", "", "show only the namespaces with the labels, e.g. owner=alice,run=42")
+	statusCmd.Flags().BoolVar(&mermaidStatus, "mermaid", false, "dump the topology as Mermaid diagram markdown")
 }
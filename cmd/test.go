@@ -70,7 +70,7 @@ var (
 
 				return nil
 			}); err != nil {
-				log.Errorf(err.Error())
+				logError(err)
 			}
 
 			for testName, paths := range testdata {
@@ -120,7 +120,12 @@ var (
 
 					c, err := config.ParseConfig(cfg)
 					if err != nil {
-						log.Errorf(err.Error())
+						if !shouldSuccess {
+							log.Infof("failed with error: %s", err.Error())
+							log.Infof("================ test %s OK ================", testName)
+						} else {
+							logError(err)
+						}
 						continue
 					}
 
@@ -130,7 +135,7 @@ var (
 							log.Infof("failed with error: %s", err.Error())
 							log.Infof("================ test %s OK ================", testName)
 						} else {
-							log.Errorf(err.Error())
+							logError(err)
 						}
 
 						continue
@@ -138,7 +143,7 @@ var (
 
 					ls, err := s.DumpAll()
 					if err != nil {
-						log.Errorf(err.Error())
+						logError(err)
 						continue
 					}
 
@@ -149,13 +154,13 @@ var (
 
 					lsRef, err := expectedState.DumpAll()
 					if err != nil {
-						log.Errorf(err.Error())
+						logError(err)
 						continue
 					}
 
 					change, err := diff.Diff(ls, lsRef)
 					if err != nil {
-						log.Errorf(err.Error())
+						logError(err)
 						continue
 					}
 
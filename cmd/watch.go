@@ -0,0 +1,60 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Apply config every time it changes until interrupted",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := network.PreflightCheck(); err != nil {
+			logError(err)
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		w, err := state.WatchConfig(ctx, configPath)
+		if err != nil {
+			logError(err)
+			return
+		}
+
+		log.Infof("watching %s", configPath)
+		<-ctx.Done()
+
+		if err := w.Close(); err != nil {
+			logError(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().StringVarP(&configPath, "config", "c", "", "config file or directory path")
+	watchCmd.MarkFlagRequired("config")
+}
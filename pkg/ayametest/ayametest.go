@@ -0,0 +1,61 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ayametest provides assertions on the topology created by ayame for
+// integration tests.
+package ayametest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/Shikugawa/ayame/pkg/state"
+)
+
+// PingTimeout bounds each ping of the assertions.
+var PingTimeout = 5 * time.Second
+
+// AssertReachable fails the test with the output of ping unless the first
+// address of the namespace to replies to the ping from the namespace from.
+func AssertReachable(t testing.TB, s *state.State, from string, to string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	if _, err := s.Ping(ctx, from, to); err != nil {
+		t.Fatalf("%s should be reachable from %s: %s", to, from, err)
+	}
+}
+
+// AssertUnreachable is the opposite of AssertReachable, e.g. for firewall
+// rules or down links. The test fails if the namespaces are not found or to
+// has no address, rather than regarding them as unreachable.
+func AssertUnreachable(t testing.TB, s *state.State, from string, to string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	rtt, err := s.Ping(ctx, from, to)
+	if err == nil {
+		t.Fatalf("%s should be unreachable from %s, but replied in %s", to, from, rtt)
+	}
+	if errors.Is(err, network.ErrNotFound) || errors.Is(err, network.ErrInactive) {
+		t.Fatalf("failed to ping %s from %s: %s", to, from, err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"go.uber.org/multierr"
+)
+
+// Builder constructs Config programmatically, e.g.
+//
+//	cfg, err := NewBuilder().
+//		AddLink("veth1", ModeDirectLink).
+//		AddNamespace("ns1").WithDevice("veth1", "10.0.0.1/24").
+//		AddNamespace("ns2").WithDevice("veth1", "10.0.0.2/24").
+//		Build()
+//
+// The device in the namespace is named after the link as in the YAML config.
+// Mistakes are collected and returned by Build.
+type Builder struct {
+	cfg     Config
+	current *NamespaceConfig
+	err     error
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// WithPrefix sets the prefix of all the names on the host.
+func (b *Builder) WithPrefix(prefix string) *Builder {
+	b.cfg.Prefix = prefix
+	return b
+}
+
+// AddLink adds the link. Use AddLinkConfig to set the optional fields.
+func (b *Builder) AddLink(name string, mode LinkMode) *Builder {
+	return b.AddLinkConfig(&LinkConfig{Name: name, LinkMode: mode})
+}
+
+func (b *Builder) AddLinkConfig(link *LinkConfig) *Builder {
+	b.cfg.Links = append(b.cfg.Links, link)
+	return b
+}
+
+// AddNamespace adds the namespace. The following With* calls configure it.
+func (b *Builder) AddNamespace(name string) *Builder {
+	b.current = &NamespaceConfig{Name: name}
+	b.cfg.Namespaces = append(b.cfg.Namespaces, b.current)
+	return b
+}
+
+// WithDevice attaches the link to the current namespace with the CIDR.
+func (b *Builder) WithDevice(link string, cidr string) *Builder {
+	if b.current == nil {
+		b.err = multierr.Append(b.err, fmt.Errorf("device %s is added before any namespace", link))
+		return b
+	}
+
+	b.current.Devices = append(b.current.Devices, NamespaceDeviceConfig{Name: link, Cidr: cidr})
+	return b
+}
+
+// WithCommand adds the command run inside the current namespace.
+func (b *Builder) WithCommand(command string) *Builder {
+	if b.current == nil {
+		b.err = multierr.Append(b.err, fmt.Errorf("command %q is added before any namespace", command))
+		return b
+	}
+
+	b.current.Commands = append(b.current.Commands, command)
+	return b
+}
+
+// WithHostname sets the hostname of the current namespace.
+func (b *Builder) WithHostname(hostname string) *Builder {
+	if b.current == nil {
+		b.err = multierr.Append(b.err, fmt.Errorf("hostname %s is set before any namespace", hostname))
+		return b
+	}
+
+	b.current.Hostname = hostname
+	return b
+}
+
+// Build validates the config the same as ParseConfig and returns it. The
+// builder must not be used after Build since the prefix is applied in place.
+func (b *Builder) Build() (*Config, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	cfg := b.cfg
+	if err := cfg.finalize(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
@@ -16,50 +16,446 @@ package config
 
 import (
 	"fmt"
+	"strings"
 
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
+// CidrAuto lets the device get its address from the pool of the link.
+const CidrAuto = "auto"
+
 type NamespaceDeviceConfig struct {
 	Name string `yaml:"name"`
 	Cidr string `yaml:"cidr"`
+	// DisableIPv6 disables IPv6 on the device to avoid link-local addresses and SLAAC.
+	DisableIPv6 bool `yaml:"disable_ipv6" json:",omitempty"`
+	// Label is the label of the address. The address is labeled as
+	// <interface>:<label>, so the whole label must fit in the interface name size.
+	Label string `yaml:"label" json:",omitempty"`
+	// Description is set as the alias of the device, overriding the one of the link.
+	Description string `yaml:"description" json:",omitempty"`
+	// Broadcast is the IPv4 broadcast address of the CIDR. BroadcastAuto lets
+	// the kernel compute it from the prefix. No broadcast is set if empty.
+	Broadcast string `yaml:"broadcast" json:",omitempty"`
+	// Scope is the scope of the address, one of AddrScopes. The kernel default
+	// is used if empty.
+	Scope string `yaml:"scope" json:",omitempty"`
+	// Peer is the address of the other end of the point-to-point link. The
+	// address of Cidr is assigned as the local address, and its prefix applies
+	// to the peer, so that no subnet is needed with /32.
+	Peer string `yaml:"peer" json:",omitempty"`
+	// Offloads turn the offload features of the device on or off with ethtool
+	// -K, e.g. {tso: false}. The features not listed are left as is.
+	Offloads map[string]bool `yaml:"offloads" json:",omitempty"`
+	// Mac is the MAC address set on the device. The kernel assigns a random one
+	// if empty.
+	Mac string `yaml:"mac" json:",omitempty"`
+	// Ipv6Prefix is a /64 ULA prefix in fc00::/7. The device gets the address in
+	// it whose host portion is the EUI-64 derived from the MAC, in addition to
+	// Cidr. The addresses collide only if the MACs do; ayame doesn't detect it,
+	// and the duplicate is left tentative by the DAD of the kernel.
+	Ipv6Prefix string `yaml:"ipv6_prefix" json:",omitempty"`
+	// LeaveDown addresses the device but leaves it down, so that it can be
+	// brought up at a precise moment with SetUp.
+	LeaveDown bool `yaml:"leave_down" json:",omitempty"`
+	// Promisc puts the device in promiscuous mode, e.g. to capture the traffic
+	// of others on a bridge.
+	Promisc bool `yaml:"promisc" json:",omitempty"`
+	// Netem impairs the packets sent from the device with tc netem.
+	Netem *NetemConfig `yaml:"netem" json:",omitempty"`
+	// Link is the link of the device named as one of the endpoints of the link.
+	// It is resolved from the links on parsing, and empty if the device is named
+	// as the link.
+	Link string `yaml:"-" json:",omitempty"`
+}
+
+// NetemConfig is the impairment applied by the netem qdisc. Percentages are
+// from 0 to 100, and zero disables the impairment.
+type NetemConfig struct {
+	// Delay is the delay of every packet, e.g. 10ms. Reordering requires it.
+	Delay            string  `yaml:"delay" json:"delay,omitempty"`
+	LossPercent      float64 `yaml:"loss_percent" json:"loss_percent,omitempty"`
+	DuplicatePercent float64 `yaml:"duplicate_percent" json:"duplicate_percent,omitempty"`
+	CorruptPercent   float64 `yaml:"corrupt_percent" json:"corrupt_percent,omitempty"`
+	// ReorderPercent of the packets are sent immediately and the others are
+	// delayed. ReorderCorrelation is the correlation with the previous packet,
+	// and ReorderGap reorders every Nth packet instead of randomly.
+	ReorderPercent     float64 `yaml:"reorder_percent" json:"reorder_percent,omitempty"`
+	ReorderCorrelation float64 `yaml:"reorder_correlation" json:"reorder_correlation,omitempty"`
+	ReorderGap         uint    `yaml:"reorder_gap" json:"reorder_gap,omitempty"`
+	// Limit is the queue length of netem in packets. The default of tc is 1000,
+	// which overflows at high rates with delay.
+	Limit uint `yaml:"limit" json:"limit,omitempty"`
+	// Rate shapes the packets with tbf under netem, e.g. 100mbit. Burst is the
+	// bucket size of tbf in bytes, which is required with Rate.
+	Rate  string `yaml:"rate" json:"rate,omitempty"`
+	Burst uint   `yaml:"burst" json:"burst,omitempty"`
+}
+
+// LinkName returns the name of the link which the device belongs to.
+func (d NamespaceDeviceConfig) LinkName() string {
+	if d.Link != "" {
+		return d.Link
+	}
+	return d.Name
+}
+
+// Offloads are the offload features which can be set in NamespaceDeviceConfig
+// by the short names of ethtool.
+var Offloads = []string{"tso", "gso", "gro", "lro", "sg", "rx", "tx", "ufo", "rxvlan", "txvlan"}
+
+// BroadcastAuto and its alias "+" set the broadcast address derived from the CIDR.
+const BroadcastAuto = "auto"
+
+// AddrScopes are the valid scopes of addresses.
+var AddrScopes = []string{"global", "link", "host"}
+
+// BondConfig bonds the devices in the namespace. The CIDR is assigned to the
+// bond, so the slave devices must not have CIDR.
+type BondConfig struct {
+	Name string `yaml:"name"`
+	// Mode is the bonding mode e.g. active-backup. The kernel default is used if empty.
+	Mode string `yaml:"mode"`
+	// Slaves are the names of the devices in the namespace.
+	Slaves []string `yaml:"slaves"`
+	Cidr   string   `yaml:"cidr"`
+}
+
+// DummyConfig is a dummy device in the namespace, which isn't connected to
+// anything but can have addresses, e.g. of a service.
+type DummyConfig struct {
+	Name string `yaml:"name"`
+	Cidr string `yaml:"cidr" json:",omitempty"`
+}
+
+// HostInterfaceConfig moves the existing interface on the host, e.g. a physical
+// NIC, into the namespace. It is moved back to the host instead of deleted.
+type HostInterfaceConfig struct {
+	Name string `yaml:"name"`
+	// Cidr is optional. The addresses of the interface are flushed on the move.
+	Cidr string `yaml:"cidr" json:",omitempty"`
+	// AllowCritical allows to move the loopback and the interface of the default route.
+	AllowCritical bool `yaml:"allow_critical" json:",omitempty"`
+}
+
+// RuleConfig is the policy routing rule which looks up the table for the
+// packets matching all the selectors. No selector matches all the packets.
+type RuleConfig struct {
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Fwmark string `yaml:"fwmark"`
+	Table  uint32 `yaml:"table"`
+	// Priority is optional. The kernel chooses it if zero.
+	Priority uint32 `yaml:"priority"`
 }
 
+// RouteConfig is the route added to the table of the namespace. Dev is the
+// name of the device in the config, e.g. the link name, or the interface name.
+type RouteConfig struct {
+	Dst string `yaml:"dst"`
+	Via string `yaml:"via"`
+	Dev string `yaml:"dev"`
+	// Table is the routing table. Zero is the main table.
+	Table uint32 `yaml:"table"`
+	// Nexthops make the route multipath instead of Via and Dev. The flows are
+	// distributed by the kernel in proportion to the weights.
+	Nexthops []NexthopConfig `yaml:"nexthops"`
+}
+
+// NexthopConfig is a nexthop of the multipath route. Dev is the same as the
+// one of RouteConfig.
+type NexthopConfig struct {
+	Via string `yaml:"via" json:"via,omitempty"`
+	Dev string `yaml:"dev" json:"dev,omitempty"`
+	// Weight is from 1 to MaxNexthopWeight.
+	Weight uint `yaml:"weight" json:"weight"`
+}
+
+// MaxNexthopWeight is the maximum weight of nexthops accepted by the kernel.
+const MaxNexthopWeight = 256
+
 type NamespaceConfig struct {
 	Name     string                  `yaml:"name"`
 	Devices  []NamespaceDeviceConfig `yaml:"devices"`
 	Commands []string                `yaml:"commands"`
+	Bonds    []BondConfig            `yaml:"bonds"`
+	// Dummies are created after the bonds and vanish with the namespace.
+	Dummies []DummyConfig `yaml:"dummies"`
+	// HostInterfaces are the existing interfaces on the host moved into the namespace.
+	HostInterfaces []HostInterfaceConfig `yaml:"host_interfaces"`
+	// Hostname is the hostname seen by the commands run inside the namespace.
+	Hostname string `yaml:"hostname"`
+	// DisableIPv6 disables IPv6 on all the devices in the namespace.
+	DisableIPv6 bool `yaml:"disable_ipv6"`
+	// Rules are the policy routing rules looking up Routes in the tables.
+	Rules []RuleConfig `yaml:"rules"`
+	// Routes are added after all the devices are attached.
+	Routes []RouteConfig `yaml:"routes"`
+	// Pid refers the network namespace of the existing process, e.g. a running
+	// container, by the name instead of creating a new one.
+	Pid int `yaml:"pid"`
+	// PostSetup are the shell commands run in order after all the devices and
+	// routes are applied. Unlike Commands, a failure fails the creation.
+	PostSetup []string `yaml:"post_setup"`
+	// Labels are arbitrary key/value pairs, e.g. the owner, kept in the state to
+	// find the namespaces later. The kernel doesn't know them.
+	Labels map[string]string `yaml:"labels"`
+	// Firewall are the iptables rules added in order after the routes, each of
+	// which is the arguments of iptables, e.g. "-A INPUT -p icmp -j DROP". The
+	// rules vanish with the namespace.
+	Firewall []string `yaml:"firewall"`
 }
 
 type LinkMode string
 
 const (
-	ModeDirectLink = "direct_link"
-	ModeBridge     = "bridge"
+	ModeDirectLink LinkMode = "direct_link"
+	ModeBridge     LinkMode = "bridge"
+	ModeTunnel     LinkMode = "tunnel"
+	ModeMacvlan    LinkMode = "macvlan"
+)
+
+// LinkModes are all the valid link modes.
+var LinkModes = []LinkMode{ModeDirectLink, ModeBridge, ModeTunnel, ModeMacvlan}
+
+const (
+	MacvlanModeBridge  = "bridge"
+	MacvlanModeVepa    = "vepa"
+	MacvlanModePrivate = "private"
+)
+
+func (m LinkMode) Valid() bool {
+	for _, mode := range LinkModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *LinkMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	mode := LinkMode(s)
+	if !mode.Valid() {
+		return fmt.Errorf("unknown link mode %q: valid modes are %s", s, validLinkModes())
+	}
+
+	*m = mode
+	return nil
+}
+
+func validLinkModes() string {
+	var modes []string
+	for _, mode := range LinkModes {
+		modes = append(modes, string(mode))
+	}
+	return strings.Join(modes, ", ")
+}
+
+const (
+	TunnelTypeVxlan  = "vxlan"
+	TunnelTypeGretap = "gretap"
 )
 
+// DefaultVxlanPort is the IANA assigned port of VXLAN.
+const DefaultVxlanPort = 4789
+
+type TunnelConfig struct {
+	Type string `yaml:"type"`
+	// VNI is the VXLAN network identifier. It is used as the key for gretap.
+	VNI    uint32 `yaml:"vni"`
+	Local  string `yaml:"local"`
+	Remote string `yaml:"remote"`
+	// Port is the destination UDP port of VXLAN. DefaultVxlanPort is used if 0.
+	Port uint16 `yaml:"port"`
+}
+
 type LinkConfig struct {
 	LinkMode LinkMode `yaml:"mode"`
 	Name     string   `yaml:"name"`
+	// CreateInNamespace creates both ends of the direct link inside the
+	// namespaces directly instead of creating them on the host and moving.
+	CreateInNamespace bool `yaml:"create_in_namespace"`
+	// Tunnel is required if the mode is tunnel.
+	Tunnel *TunnelConfig `yaml:"tunnel"`
+	// HostCidr keeps one end of the direct link on the host with this CIDR. Only
+	// one namespace can have the link then.
+	HostCidr string `yaml:"host_cidr"`
+	// TxQueueLen is the txqueuelen of the veths of direct links and bridges.
+	// Zero leaves the default.
+	TxQueueLen uint `yaml:"txqueuelen"`
+	// Mtu is the MTU of the veths of direct links and bridges, from MinMtu to
+	// MaxMtu. Zero leaves the default.
+	Mtu uint `yaml:"mtu"`
+	// Pool is the CIDR from which the devices whose cidr is "auto" get addresses.
+	Pool string `yaml:"pool"`
+	// Stp enables the spanning tree protocol of the bridge. It is off by default.
+	Stp bool `yaml:"stp"`
+	// VlanFiltering filters the frames on the ports of the bridge by VLAN as
+	// vlan_filtering of the Linux bridge with the default PVID 1: only untagged
+	// frames and the ones tagged with VLAN 1 are forwarded.
+	VlanFiltering bool `yaml:"vlan_filtering"`
+	// Description is set as the alias of the veths of direct links and bridges.
+	Description string `yaml:"description"`
+	// Parent is the device on the host which macvlan devices are created on.
+	Parent string `yaml:"parent"`
+	// MacvlanMode is bridge, vepa or private. bridge is used if empty.
+	MacvlanMode string `yaml:"macvlan_mode"`
+	// Dscp marks the packets leaving the namespaces through the link with the
+	// DSCP value from 0 to MaxDscp. Nothing is marked if nil.
+	Dscp *uint8 `yaml:"dscp"`
+	// Endpoints are the device names of the left and the right ends of the
+	// direct link, so that each namespace can name the device differently. Both
+	// namespaces name the device as the link if empty.
+	Endpoints []string `yaml:"endpoints"`
+	// Namespaces are the names of the namespaces which the left and the right
+	// ends of the direct link are attached to. The ends are assigned in the order
+	// of the namespaces in the config if empty.
+	Namespaces []string `yaml:"namespaces"`
+	// HostDebug is only for debugging. Both ends of the direct link stay on the
+	// host with the CIDRs of the devices in the namespaces, so that both ends can
+	// be captured without entering the namespaces. The namespaces are not
+	// connected through the link then.
+	HostDebug bool `yaml:"host_debug"`
 }
 
+const (
+	// MinMtu is the minimum MTU of IPv4.
+	MinMtu = 68
+	MaxMtu = 65535
+)
+
+// MaxDscp is the maximum DSCP value, i.e. 6 bits.
+const MaxDscp = 63
+
 type Config struct {
+	// Prefix is prepended to every namespace and link name created on the host
+	// so that multiple projects can use the same logical names.
+	Prefix     string             `yaml:"prefix"`
 	Links      []*LinkConfig      `yaml:"links"`
 	Namespaces []*NamespaceConfig `yaml:"namespaces"`
+	// Includes are the files merged into this config by LoadConfig. Relative
+	// paths are resolved from the directory of the including file.
+	Includes []string `yaml:"includes"`
 }
 
+// ParseConfig parses a single config. Includes are ignored, use LoadConfig to
+// merge them.
 func ParseConfig(bytes []byte) (*Config, error) {
 	cfg := Config{}
 	if err := yaml.Unmarshal(bytes, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %s", err)
 	}
 
-	if err := ValidateLinkConfigs(cfg.Links); err != nil {
-		return nil, err
-	}
-	if err := ValidateNamespace(cfg.Namespaces, cfg.Links); err != nil {
+	if err := cfg.finalize(); err != nil {
 		return nil, err
 	}
 
 	return &cfg, nil
 }
+
+// finalize validates the config and applies the prefix in place.
+func (c *Config) finalize() error {
+	c.trimNames()
+	c.resolveEndpoints()
+
+	if err := ValidateLinkConfigs(c.Links); err != nil {
+		return err
+	}
+	if err := ValidateNamespace(c.Namespaces, c.Links); err != nil {
+		return err
+	}
+
+	c.applyPrefix()
+
+	return c.validateInterfaceNames()
+}
+
+// trimNames trims the spaces around the namespace names, which are easily
+// mixed in from shell variables.
+func (c *Config) trimNames() {
+	for _, ns := range c.Namespaces {
+		if trimmed := strings.TrimSpace(ns.Name); trimmed != ns.Name {
+			log.Warnf("namespace name %q is trimmed to %q", ns.Name, trimmed)
+			ns.Name = trimmed
+		}
+	}
+}
+
+// PrefixedName returns the name of the resource actually created on the host.
+func (c *Config) PrefixedName(name string) string {
+	if c.Prefix == "" {
+		return name
+	}
+	return c.Prefix + "-" + name
+}
+
+// resolveEndpoints sets the link of the devices named as the endpoints.
+func (c *Config) resolveEndpoints() {
+	endpoints := make(map[string]string)
+	for _, link := range c.Links {
+		for _, ep := range link.Endpoints {
+			endpoints[ep] = link.Name
+		}
+	}
+
+	for _, ns := range c.Namespaces {
+		for i := range ns.Devices {
+			if link, ok := endpoints[ns.Devices[i].Name]; ok {
+				ns.Devices[i].Link = link
+			}
+		}
+	}
+}
+
+func (c *Config) applyPrefix() {
+	if c.Prefix == "" {
+		return
+	}
+
+	for _, link := range c.Links {
+		link.Name = c.PrefixedName(link.Name)
+		for i := range link.Endpoints {
+			link.Endpoints[i] = c.PrefixedName(link.Endpoints[i])
+		}
+		for i := range link.Namespaces {
+			link.Namespaces[i] = c.PrefixedName(link.Namespaces[i])
+		}
+	}
+
+	for _, ns := range c.Namespaces {
+		ns.Name = c.PrefixedName(ns.Name)
+		for i := range ns.Routes {
+			for _, dev := range ns.Devices {
+				if ns.Routes[i].Dev == dev.Name {
+					ns.Routes[i].Dev = c.PrefixedName(dev.Name)
+					break
+				}
+			}
+			for j := range ns.Routes[i].Nexthops {
+				for _, dev := range ns.Devices {
+					if ns.Routes[i].Nexthops[j].Dev == dev.Name {
+						ns.Routes[i].Nexthops[j].Dev = c.PrefixedName(dev.Name)
+						break
+					}
+				}
+			}
+		}
+		for i := range ns.Devices {
+			ns.Devices[i].Name = c.PrefixedName(ns.Devices[i].Name)
+			if ns.Devices[i].Link != "" {
+				ns.Devices[i].Link = c.PrefixedName(ns.Devices[i].Link)
+			}
+		}
+		for i := range ns.Bonds {
+			for j := range ns.Bonds[i].Slaves {
+				ns.Bonds[i].Slaves[j] = c.PrefixedName(ns.Bonds[i].Slaves[j])
+			}
+		}
+	}
+}
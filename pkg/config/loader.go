@@ -0,0 +1,156 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadConfig loads the config from the file or all the YAML files in the
+// directory in lexical order, following the includes of each file. The files
+// are merged in the order they are loaded: the links and the namespaces are
+// appended, and a non-empty prefix overrides the former one. The same link or
+// namespace name in multiple files is an error.
+func LoadConfig(path string) (*Config, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &merger{
+		visiting:   make(map[string]bool),
+		loaded:     make(map[string]bool),
+		links:      make(map[string]string),
+		namespaces: make(map[string]string),
+	}
+	for _, file := range files {
+		if err := m.load(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.cfg.finalize(); err != nil {
+		return nil, err
+	}
+
+	return &m.cfg, nil
+}
+
+// configFiles returns the YAML files in path if it is a directory, or path itself.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		files = append(files, filepath.Join(path, e.Name()))
+	}
+	sort.Strings(files)
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file in %s", path)
+	}
+	return files, nil
+}
+
+type merger struct {
+	cfg Config
+	// visiting are the files being loaded to detect include cycles.
+	visiting map[string]bool
+	// loaded are the files already merged. A file included twice is merged once.
+	loaded map[string]bool
+	// links and namespaces map the names to the files and the indices defining
+	// them, e.g. "a.yaml links[0]".
+	links      map[string]string
+	namespaces map[string]string
+}
+
+func (m *merger) load(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if m.visiting[abs] {
+		return fmt.Errorf("include cycle at %s", path)
+	}
+	if m.loaded[abs] {
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cfg := Config{}
+	if err := yaml.Unmarshal(bytes, &cfg); err != nil {
+		return fmt.Errorf("failed to parse config %s: %s", path, err)
+	}
+
+	if cfg.Prefix != "" {
+		m.cfg.Prefix = cfg.Prefix
+	}
+
+	for i, link := range cfg.Links {
+		if prev, ok := m.links[link.Name]; ok {
+			return fmt.Errorf("duplicated link %s in %s and %s links[%d]", link.Name, prev, path, i)
+		}
+		m.links[link.Name] = fmt.Sprintf("%s links[%d]", path, i)
+		m.cfg.Links = append(m.cfg.Links, link)
+	}
+
+	for i, ns := range cfg.Namespaces {
+		if prev, ok := m.namespaces[ns.Name]; ok {
+			return fmt.Errorf("duplicated namespace %s in %s and %s namespaces[%d]", ns.Name, prev, path, i)
+		}
+		m.namespaces[ns.Name] = fmt.Sprintf("%s namespaces[%d]", path, i)
+		m.cfg.Namespaces = append(m.cfg.Namespaces, ns)
+	}
+
+	m.visiting[abs] = true
+	defer delete(m.visiting, abs)
+
+	for _, include := range cfg.Includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := m.load(include); err != nil {
+			return fmt.Errorf("failed to include %s: %w", include, err)
+		}
+	}
+
+	m.loaded[abs] = true
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Subset returns the config which has only the named namespaces and the links
+// attached to them. The names may be either with or without the prefix. It is
+// an error if a direct link of a selected namespace has the other end in a
+// namespace which isn't selected, since the device would be left dangling.
+// Bridges, tunnels and macvlans are kept for the selected namespaces only.
+func (c *Config) Subset(names []string) (*Config, error) {
+	selected := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, ns := range c.Namespaces {
+			if ns.Name == name || ns.Name == c.PrefixedName(name) {
+				selected[ns.Name] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("namespace %s is not in config", name)
+		}
+	}
+
+	// users maps the link names to the namespaces using them.
+	users := make(map[string][]string)
+	for _, ns := range c.Namespaces {
+		for _, dev := range ns.Devices {
+			users[dev.LinkName()] = append(users[dev.LinkName()], ns.Name)
+		}
+	}
+
+	sub := *c
+	sub.Namespaces = nil
+	sub.Links = nil
+
+	for _, ns := range c.Namespaces {
+		if selected[ns.Name] {
+			sub.Namespaces = append(sub.Namespaces, ns)
+		}
+	}
+
+	for _, link := range c.Links {
+		var in, out []string
+		for _, ns := range users[link.Name] {
+			if selected[ns] {
+				in = append(in, ns)
+			} else {
+				out = append(out, ns)
+			}
+		}
+		if len(in) == 0 {
+			continue
+		}
+		if link.LinkMode == ModeDirectLink && len(out) != 0 {
+			return nil, fmt.Errorf("direct link %s of %s has the other end in %s which is not selected",
+				link.Name, strings.Join(in, ", "), strings.Join(out, ", "))
+		}
+		sub.Links = append(sub.Links, link)
+	}
+
+	return &sub, nil
+}
@@ -1,58 +1,1085 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/multierr"
+)
+
+// MaxAddrLabelLen is the maximum length of the address label including the
+// interface name, i.e. IFNAMSIZ without the trailing NUL.
+const MaxAddrLabelLen = 15
+
+// MaxInterfaceNameLen is the maximum length of the interface name, i.e.
+// IFNAMSIZ without the trailing NUL.
+const MaxInterfaceNameLen = 15
+
+var addrLabel = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// hostnameLabel is a label of hostname defined in RFC 1123.
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// tcRate is the rate in the units of tc.
+var tcRate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([kmgt]?bit|[kmgt]?bps)$`)
+
+// MaxNamespaceNameLen is NAME_MAX since the namespace is bound to the file
+// /var/run/netns/<name>.
+const MaxNamespaceNameLen = 255
+
+// ValidateNamespaceName rejects the names which `ip netns add` may accept but
+// break later, e.g. with slashes, spaces or a trailing newline from a shell
+// variable.
+func ValidateNamespaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("namespace name must not be empty")
+	}
+	if len(name) > MaxNamespaceNameLen {
+		return fmt.Errorf("namespace name %q must be at most %d characters", name, MaxNamespaceNameLen)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("namespace name %q is reserved", name)
+	}
+	for _, r := range name {
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("namespace name %q must not contain %q", name, r)
+		}
+	}
+	return nil
+}
 
 func ValidateLinkConfigs(linkConfigs []*LinkConfig) error {
+	if err := validateUniqueLinkNames(linkConfigs); err != nil {
+		return err
+	}
+
 	// Check required fields
 	for _, cfg := range linkConfigs {
 		if cfg.LinkMode == "" {
 			return fmt.Errorf("LinkMode must not be empty")
 		}
+		if !cfg.LinkMode.Valid() {
+			return fmt.Errorf("unknown link mode %q in link %s: valid modes are %s", cfg.LinkMode, cfg.Name, validLinkModes())
+		}
 		if cfg.Name == "" {
 			return fmt.Errorf("Name must not be empty")
 		}
 	}
 
-	// Check duplicate of names
-	tmp := make(map[string]bool)
 	for _, cfg := range linkConfigs {
-		if _, ok := tmp[cfg.Name]; ok {
-			return fmt.Errorf("Name must not be duplicated")
+		if cfg.LinkMode != ModeTunnel {
+			continue
 		}
+		if err := validateTunnelConfig(cfg); err != nil {
+			return err
+		}
+	}
 
-		tmp[cfg.Name] = false
+	for _, cfg := range linkConfigs {
+		if cfg.Pool == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cfg.Pool); err != nil {
+			return fmt.Errorf("invalid pool %s in link %s: %s", cfg.Pool, cfg.Name, err)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if cfg.HostCidr == "" {
+			continue
+		}
+		if cfg.LinkMode != ModeDirectLink {
+			return fmt.Errorf("host_cidr is supported only by direct link: %s", cfg.Name)
+		}
+		if cfg.CreateInNamespace {
+			return fmt.Errorf("host_cidr can't be used with create_in_namespace: %s", cfg.Name)
+		}
+		if err := validateHostAddr(cfg.HostCidr); err != nil {
+			return fmt.Errorf("invalid host_cidr %s in link %s: %s", cfg.HostCidr, cfg.Name, err)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if !cfg.HostDebug {
+			continue
+		}
+		if cfg.LinkMode != ModeDirectLink {
+			return fmt.Errorf("host_debug is supported only by direct link: %s", cfg.Name)
+		}
+		if cfg.CreateInNamespace || cfg.HostCidr != "" {
+			return fmt.Errorf("host_debug can't be used with create_in_namespace or host_cidr: %s", cfg.Name)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if cfg.LinkMode == ModeBridge {
+			continue
+		}
+		if cfg.Stp || cfg.VlanFiltering {
+			return fmt.Errorf("stp and vlan_filtering are supported only by bridge: %s", cfg.Name)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if cfg.LinkMode != ModeMacvlan {
+			if cfg.Parent != "" || cfg.MacvlanMode != "" {
+				return fmt.Errorf("parent and macvlan_mode are supported only by macvlan: %s", cfg.Name)
+			}
+			continue
+		}
+		if cfg.Parent == "" {
+			return fmt.Errorf("parent must be configured in macvlan link %s", cfg.Name)
+		}
+		switch cfg.MacvlanMode {
+		case "", MacvlanModeBridge, MacvlanModeVepa, MacvlanModePrivate:
+		default:
+			return fmt.Errorf("unknown macvlan mode %s in macvlan link %s", cfg.MacvlanMode, cfg.Name)
+		}
+	}
+
+	endpoints := make(map[string]bool)
+	for _, cfg := range linkConfigs {
+		if len(cfg.Endpoints) == 0 {
+			continue
+		}
+		if cfg.LinkMode != ModeDirectLink {
+			return fmt.Errorf("endpoints are supported only by direct link: %s", cfg.Name)
+		}
+		if cfg.HostCidr != "" {
+			return fmt.Errorf("endpoints can't be used with host_cidr: %s", cfg.Name)
+		}
+		if len(cfg.Endpoints) != 2 || cfg.Endpoints[0] == "" || cfg.Endpoints[1] == "" || cfg.Endpoints[0] == cfg.Endpoints[1] {
+			return fmt.Errorf("endpoints of link %s must be 2 different device names", cfg.Name)
+		}
+		for _, ep := range cfg.Endpoints {
+			if endpoints[ep] {
+				return fmt.Errorf("endpoint %s of link %s is duplicated", ep, cfg.Name)
+			}
+			endpoints[ep] = true
+		}
+	}
+	for _, cfg := range linkConfigs {
+		if len(cfg.Namespaces) == 0 {
+			continue
+		}
+		if cfg.LinkMode != ModeDirectLink {
+			return fmt.Errorf("namespaces are supported only by direct link: %s", cfg.Name)
+		}
+		if cfg.HostCidr != "" {
+			return fmt.Errorf("namespaces can't be used with host_cidr: %s", cfg.Name)
+		}
+		if len(cfg.Endpoints) != 0 {
+			return fmt.Errorf("namespaces can't be used with endpoints, which decide the ends already: %s", cfg.Name)
+		}
+		if len(cfg.Namespaces) != 2 || cfg.Namespaces[0] == "" || cfg.Namespaces[1] == "" || cfg.Namespaces[0] == cfg.Namespaces[1] {
+			return fmt.Errorf("namespaces of link %s must be 2 different namespace names", cfg.Name)
+		}
+	}
+	for _, cfg := range linkConfigs {
+		if endpoints[cfg.Name] {
+			return fmt.Errorf("endpoint %s must not be the name of a link", cfg.Name)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if cfg.Mtu == 0 {
+			continue
+		}
+		if cfg.LinkMode != ModeDirectLink && cfg.LinkMode != ModeBridge {
+			return fmt.Errorf("mtu is supported only by direct link and bridge: %s", cfg.Name)
+		}
+		if cfg.Mtu < MinMtu || cfg.Mtu > MaxMtu {
+			return fmt.Errorf("mtu %d in link %s must be from %d to %d", cfg.Mtu, cfg.Name, MinMtu, MaxMtu)
+		}
+	}
+
+	for _, cfg := range linkConfigs {
+		if cfg.Dscp != nil && *cfg.Dscp > MaxDscp {
+			return fmt.Errorf("dscp %d in link %s must be from 0 to %d", *cfg.Dscp, cfg.Name, MaxDscp)
+		}
+	}
+
+	return nil
+}
+
+// ValidateNames checks that the names of the links and the namespaces are
+// unique, which the derived interface names rely on, and that the interface
+// names fit in IFNAMSIZ. The config built without ParseConfig should be checked
+// before creating anything.
+func (c *Config) ValidateNames() error {
+	if err := validateUniqueLinkNames(c.Links); err != nil {
+		return err
+	}
+	if err := validateUniqueNamespaceNames(c.Namespaces); err != nil {
+		return err
+	}
+	return c.validateInterfaceNames()
+}
+
+// validateInterfaceNames checks the names of the interfaces derived from the
+// link names with the prefix, e.g. <prefix>-<link>-right. The kernel rejects a
+// longer name only when the link is created, after the others have been.
+func (c *Config) validateInterfaceNames() error {
+	members := make(map[string]int)
+	for _, ns := range c.Namespaces {
+		for _, dev := range ns.Devices {
+			members[dev.LinkName()]++
+		}
+	}
+
+	for _, link := range c.Links {
+		var names []string
+		switch link.LinkMode {
+		case ModeDirectLink:
+			names = []string{link.Name + "-left", link.Name + "-right"}
+		case ModeBridge:
+			// The longest of <bridge>-<N>-right of the members.
+			names = []string{link.Name, fmt.Sprintf("%s-%d-right", link.Name, members[link.Name])}
+		case ModeMacvlan:
+			names = []string{fmt.Sprintf("%s-%d", link.Name, members[link.Name])}
+		default:
+			names = []string{link.Name}
+		}
+
+		for _, name := range names {
+			if len(name) > MaxInterfaceNameLen {
+				return fmt.Errorf("interface name %s of link %s exceeds %d characters: shorten the link name or the prefix", name, link.Name, MaxInterfaceNameLen)
+			}
+		}
+	}
+	return nil
+}
+
+func validateUniqueLinkNames(linkConfigs []*LinkConfig) error {
+	seen := make(map[string]int)
+	for i, cfg := range linkConfigs {
+		if j, ok := seen[cfg.Name]; ok {
+			return fmt.Errorf("link name %s is duplicated in links[%d] and links[%d]", cfg.Name, j, i)
+		}
+		seen[cfg.Name] = i
+	}
+	return nil
+}
+
+func validateUniqueNamespaceNames(configs []*NamespaceConfig) error {
+	seen := make(map[string]int)
+	for i, cfg := range configs {
+		if j, ok := seen[cfg.Name]; ok {
+			return fmt.Errorf("namespace name %s is duplicated in namespaces[%d] and namespaces[%d]", cfg.Name, j, i)
+		}
+		seen[cfg.Name] = i
+	}
+	return nil
+}
+
+func validateTunnelConfig(cfg *LinkConfig) error {
+	tunnel := cfg.Tunnel
+	if tunnel == nil {
+		return fmt.Errorf("tunnel must be configured in tunnel link %s", cfg.Name)
+	}
+
+	switch tunnel.Type {
+	case TunnelTypeVxlan:
+		if tunnel.VNI == 0 || tunnel.VNI >= 1<<24 {
+			return fmt.Errorf("VNI of tunnel link %s must be in range 1-16777215", cfg.Name)
+		}
+	case TunnelTypeGretap:
+		if tunnel.Port != 0 {
+			return fmt.Errorf("port can't be configured for gretap tunnel link %s", cfg.Name)
+		}
+	default:
+		return fmt.Errorf("unknown tunnel type %s in tunnel link %s", tunnel.Type, cfg.Name)
+	}
+
+	if net.ParseIP(tunnel.Remote) == nil {
+		return fmt.Errorf("invalid remote address %s in tunnel link %s", tunnel.Remote, cfg.Name)
+	}
+
+	if tunnel.Local != "" && net.ParseIP(tunnel.Local) == nil {
+		return fmt.Errorf("invalid local address %s in tunnel link %s", tunnel.Local, cfg.Name)
 	}
 
 	return nil
 }
 
 func ValidateNamespace(configs []*NamespaceConfig, linkConfigs []*LinkConfig) error {
-	// Unique Name
-	tmp := make(map[string]bool)
 	for _, cfg := range configs {
-		if _, ok := tmp[cfg.Name]; ok {
-			return fmt.Errorf("namespace name must be unique")
+		if err := ValidateNamespaceName(cfg.Name); err != nil {
+			return err
+		}
+	}
+	if err := validateUniqueNamespaceNames(configs); err != nil {
+		return err
+	}
+
+	// Labels can be written in selectors
+	for _, cfg := range configs {
+		for key, value := range cfg.Labels {
+			if key == "" || strings.ContainsAny(key, "=,") || strings.Contains(value, ",") {
+				return fmt.Errorf("label %s=%s of namespace %s must have non-empty key without '=' and ',', and value without ','", key, value, cfg.Name)
+			}
+		}
+	}
+
+	// Links and devices are wired
+	if err := CheckTopology(configs, linkConfigs).Err(); err != nil {
+		return err
+	}
+
+	// Each endpoint is the device of one namespace
+	for _, link := range linkConfigs {
+		for _, ep := range link.Endpoints {
+			var users []string
+			for _, cfg := range configs {
+				for _, device := range cfg.Devices {
+					if device.Name == ep {
+						users = append(users, cfg.Name)
+					}
+				}
+			}
+			if len(users) != 1 {
+				return fmt.Errorf("endpoint %s of link %s must be used by one namespace, but used by %d", ep, link.Name, len(users))
+			}
+		}
+	}
+
+	// Each end is attached to the namespace which has the link
+	for _, link := range linkConfigs {
+		for _, name := range link.Namespaces {
+			attached := false
+			for _, cfg := range configs {
+				if cfg.Name != name {
+					continue
+				}
+				for _, device := range cfg.Devices {
+					if device.LinkName() == link.Name {
+						attached = true
+					}
+				}
+			}
+			if !attached {
+				return fmt.Errorf("namespace %s of link %s must have a device on the link", name, link.Name)
+			}
+		}
+	}
+
+	// Hostname is legal
+	for _, cfg := range configs {
+		if cfg.Hostname == "" {
+			continue
+		}
+		if err := validateHostname(cfg.Hostname); err != nil {
+			return fmt.Errorf("invalid hostname %s in namespace %s: %s", cfg.Hostname, cfg.Name, err)
+		}
+	}
+
+	// Namespaces of processes are not created by ayame
+	for _, cfg := range configs {
+		if cfg.Pid < 0 {
+			return fmt.Errorf("invalid pid %d in namespace %s", cfg.Pid, cfg.Name)
+		}
+		if cfg.Pid != 0 && cfg.Hostname != "" {
+			return fmt.Errorf("hostname can't be set to namespace %s of pid %d", cfg.Name, cfg.Pid)
+		}
+		if cfg.Pid != 0 && len(cfg.Dummies) != 0 {
+			return fmt.Errorf("dummies can't be created in namespace %s of pid %d because they outlive the topology", cfg.Name, cfg.Pid)
+		}
+		if cfg.Pid != 0 && len(cfg.Firewall) != 0 {
+			return fmt.Errorf("firewall can't be set to namespace %s of pid %d because the rules outlive the topology", cfg.Name, cfg.Pid)
+		}
+	}
+
+	// Firewall rules are iptables commands
+	for _, cfg := range configs {
+		for _, rule := range cfg.Firewall {
+			if err := validateFirewallRule(rule); err != nil {
+				return fmt.Errorf("invalid firewall rule %q in namespace %s: %s", rule, cfg.Name, err)
+			}
+		}
+	}
+
+	// Bond slaves are devices in the namespace without CIDR
+	for _, cfg := range configs {
+		slaves := make(map[string]bool)
+		for _, bond := range cfg.Bonds {
+			if bond.Name == "" {
+				return fmt.Errorf("bond name must not be empty in namespace %s", cfg.Name)
+			}
+			if len(bond.Slaves) == 0 {
+				return fmt.Errorf("bond %s in namespace %s must have slaves", bond.Name, cfg.Name)
+			}
+			if err := validateHostAddr(bond.Cidr); err != nil {
+				return fmt.Errorf("invalid CIDR %s of bond %s in namespace %s: %s", bond.Cidr, bond.Name, cfg.Name, err)
+			}
+
+			for _, slave := range bond.Slaves {
+				if slaves[slave] {
+					return fmt.Errorf("device %s in namespace %s is enslaved twice", slave, cfg.Name)
+				}
+				slaves[slave] = true
+
+				found := false
+				for _, device := range cfg.Devices {
+					if device.Name != slave {
+						continue
+					}
+					if device.Cidr != "" {
+						return fmt.Errorf("slave device %s of bond %s in namespace %s must not have CIDR", slave, bond.Name, cfg.Name)
+					}
+					found = true
+				}
+				if !found {
+					return fmt.Errorf("slave device %s of bond %s is not configured in namespace %s", slave, bond.Name, cfg.Name)
+				}
+			}
+		}
+
+		for _, device := range cfg.Devices {
+			if device.Cidr == "" && !slaves[device.Name] {
+				return fmt.Errorf("device %s in namespace %s must have CIDR", device.Name, cfg.Name)
+			}
+		}
+	}
+
+	// Dummies don't share names with bonds
+	for _, cfg := range configs {
+		names := make(map[string]bool)
+		for _, bond := range cfg.Bonds {
+			names[bond.Name] = true
+		}
+		for _, dummy := range cfg.Dummies {
+			if dummy.Name == "" {
+				return fmt.Errorf("dummy name must not be empty in namespace %s", cfg.Name)
+			}
+			if names[dummy.Name] {
+				return fmt.Errorf("dummy %s in namespace %s is duplicated", dummy.Name, cfg.Name)
+			}
+			names[dummy.Name] = true
+
+			if dummy.Cidr == "" {
+				continue
+			}
+			if err := validateHostAddr(dummy.Cidr); err != nil {
+				return fmt.Errorf("invalid CIDR %s of dummy %s in namespace %s: %s", dummy.Cidr, dummy.Name, cfg.Name, err)
+			}
+		}
+	}
+
+	// Host interfaces are moved into only one namespace
+	hostInterfaces := make(map[string]bool)
+	for _, cfg := range configs {
+		for _, hif := range cfg.HostInterfaces {
+			if hif.Name == "" {
+				return fmt.Errorf("host interface name must not be empty in namespace %s", cfg.Name)
+			}
+			if hostInterfaces[hif.Name] {
+				return fmt.Errorf("host interface %s is moved into multiple namespaces", hif.Name)
+			}
+			hostInterfaces[hif.Name] = true
+
+			if hif.Cidr == "" {
+				continue
+			}
+			if err := validateHostAddr(hif.Cidr); err != nil {
+				return fmt.Errorf("invalid CIDR %s of host interface %s in namespace %s: %s", hif.Cidr, hif.Name, cfg.Name, err)
+			}
+		}
+	}
+
+	// Rules and routes are legal
+	for _, cfg := range configs {
+		for _, rule := range cfg.Rules {
+			if err := validateRuleConfig(&rule); err != nil {
+				return fmt.Errorf("invalid rule in namespace %s: %s", cfg.Name, err)
+			}
+		}
+		for _, route := range cfg.Routes {
+			if err := validateRouteConfig(&route); err != nil {
+				return fmt.Errorf("invalid route %s in namespace %s: %s", route.Dst, cfg.Name, err)
+			}
+		}
+	}
+
+	// Address label is legal
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if device.Label == "" {
+				continue
+			}
+			if device.Cidr == "" {
+				return fmt.Errorf("device %s in namespace %s must have CIDR to be labeled", device.Name, cfg.Name)
+			}
+			if !addrLabel.MatchString(device.Label) {
+				return fmt.Errorf("label %s of device %s in namespace %s must consist of alphanumerics, '_', '.' and '-'", device.Label, device.Name, cfg.Name)
+			}
+			// The label is prefixed by "<interface>:", which is at least 2 characters.
+			if len(device.Label) > MaxAddrLabelLen-2 {
+				return fmt.Errorf("label %s of device %s in namespace %s is too long", device.Label, device.Name, cfg.Name)
+			}
+		}
+	}
+
+	// Broadcast and scope are legal
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if err := validateAddrAttrs(&device); err != nil {
+				return fmt.Errorf("invalid address of device %s in namespace %s: %s", device.Name, cfg.Name, err)
+			}
+		}
+	}
+
+	// Peer is the other end of the point-to-point link
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if device.Peer == "" {
+				continue
+			}
+			if err := validatePeer(&device); err != nil {
+				return fmt.Errorf("invalid peer of device %s in namespace %s: %s", device.Name, cfg.Name, err)
+			}
 		}
-		tmp[cfg.Name] = false
+	}
+	if err := validatePeerEnds(configs, linkConfigs); err != nil {
+		return err
 	}
 
-	// Device Exists
-	deviceNameContainsInLink := func(name string) bool {
-		for _, link := range linkConfigs {
-			if name == link.Name {
-				return true
+	// CIDR is a usable host address
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if device.Cidr == "" || device.Cidr == CidrAuto {
+				continue
+			}
+			if err := validateHostAddr(device.Cidr); err != nil {
+				return fmt.Errorf("invalid CIDR of device %s in namespace %s: %s", device.Name, cfg.Name, err)
 			}
 		}
-		return false
 	}
 
+	// MAC and IPv6 prefix are legal
+	macs := make(map[string]bool)
 	for _, cfg := range configs {
 		for _, device := range cfg.Devices {
-			if !deviceNameContainsInLink(device.Name) {
-				return fmt.Errorf("unconfigured device found")
+			if device.Mac != "" {
+				mac, err := net.ParseMAC(device.Mac)
+				if err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+					return fmt.Errorf("mac %s of device %s in namespace %s must be a unicast EUI-48 address", device.Mac, device.Name, cfg.Name)
+				}
+				if macs[mac.String()] {
+					return fmt.Errorf("mac %s of device %s in namespace %s is duplicated", device.Mac, device.Name, cfg.Name)
+				}
+				macs[mac.String()] = true
+			}
+
+			if device.Ipv6Prefix == "" {
+				continue
+			}
+			if cfg.DisableIPv6 || device.DisableIPv6 {
+				return fmt.Errorf("ipv6_prefix of device %s in namespace %s can't be used with disable_ipv6", device.Name, cfg.Name)
+			}
+			if err := validateUlaPrefix(device.Ipv6Prefix); err != nil {
+				return fmt.Errorf("invalid ipv6_prefix of device %s in namespace %s: %s", device.Name, cfg.Name, err)
+			}
+		}
+	}
+
+	// Netem is legal
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if device.Netem == nil {
+				continue
+			}
+			if err := validateNetem(device.Netem); err != nil {
+				return fmt.Errorf("invalid netem of device %s in namespace %s: %s", device.Name, cfg.Name, err)
+			}
+		}
+	}
+
+	// Offloads are known
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			for feature := range device.Offloads {
+				if !validOffload(feature) {
+					return fmt.Errorf("unknown offload %q of device %s in namespace %s: valid offloads are %s",
+						feature, device.Name, cfg.Name, strings.Join(Offloads, ", "))
+				}
+			}
+		}
+	}
+
+	// Pool exists for auto CIDR
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if device.Cidr != CidrAuto {
+				continue
+			}
+			for _, link := range linkConfigs {
+				if link.Name == device.LinkName() && link.Pool == "" {
+					return fmt.Errorf("device %s in namespace %s requires pool in link %s", device.Name, cfg.Name, link.Name)
+				}
 			}
 		}
 	}
 
 	return nil
 }
+
+// TopologyReport is the result of the cross-check between the links and the
+// devices of the namespaces.
+type TopologyReport struct {
+	// UnusedLinks are the links used by no namespace. They are created but
+	// connect nothing, so they are reported as warnings.
+	UnusedLinks []string
+	// SingleEndedLinks are the direct links without host CIDR used by only one
+	// namespace, i.e. the other end is unconnected.
+	SingleEndedLinks []string
+	// OverusedLinks are the direct links used by more namespaces than their ends.
+	OverusedLinks []string
+	// UnknownDevices are the devices, formatted as <namespace>/<device>, which
+	// are not configured in links.
+	UnknownDevices []string
+}
+
+// CheckTopology cross-checks the links and the devices of the namespaces. It
+// collects all the wiring mistakes at once rather than the first one.
+func CheckTopology(configs []*NamespaceConfig, linkConfigs []*LinkConfig) *TopologyReport {
+	users := make(map[string][]string)
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			users[device.LinkName()] = append(users[device.LinkName()], cfg.Name)
+		}
+	}
+
+	report := &TopologyReport{}
+	links := make(map[string]bool)
+	for _, link := range linkConfigs {
+		links[link.Name] = true
+
+		ends := 2
+		if link.HostCidr != "" {
+			ends = 1
+		}
+
+		nss := users[link.Name]
+		switch {
+		case len(nss) == 0:
+			report.UnusedLinks = append(report.UnusedLinks, link.Name)
+		case link.LinkMode != ModeDirectLink:
+		case len(nss) < ends:
+			report.SingleEndedLinks = append(report.SingleEndedLinks, link.Name)
+		case len(nss) > ends:
+			report.OverusedLinks = append(report.OverusedLinks, link.Name)
+		}
+	}
+
+	for _, cfg := range configs {
+		for _, device := range cfg.Devices {
+			if !links[device.LinkName()] {
+				report.UnknownDevices = append(report.UnknownDevices, cfg.Name+"/"+device.Name)
+			}
+		}
+	}
+
+	return report
+}
+
+// Err returns all the mistakes which make the topology unbuildable.
+func (r *TopologyReport) Err() error {
+	var allerr error
+	for _, link := range r.SingleEndedLinks {
+		allerr = multierr.Append(allerr, fmt.Errorf("link %s is used by only one namespace and the other end is unconnected", link))
+	}
+	for _, link := range r.OverusedLinks {
+		allerr = multierr.Append(allerr, fmt.Errorf("link %s is used by more namespaces than its ends", link))
+	}
+	for _, device := range r.UnknownDevices {
+		allerr = multierr.Append(allerr, fmt.Errorf("device %s is not configured in links", device))
+	}
+	return allerr
+}
+
+// Warnings returns the mistakes which don't prevent building the topology.
+func (r *TopologyReport) Warnings() []string {
+	var warnings []string
+	for _, link := range r.UnusedLinks {
+		warnings = append(warnings, fmt.Sprintf("link %s is not used by any namespace", link))
+	}
+	return warnings
+}
+
+// validateTable rejects the tables which can't be used for the routes of
+// namespaces: 0 is unspecified and 255 is the local table of the kernel.
+func validateTable(table uint32) error {
+	if table == 0 || table == 255 {
+		return fmt.Errorf("table %d is reserved", table)
+	}
+	return nil
+}
+
+// validateSelector accepts an address, a CIDR or "all".
+func validateSelector(selector string) error {
+	if selector == "" || selector == "all" || net.ParseIP(selector) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(selector); err != nil {
+		return fmt.Errorf("invalid selector %s", selector)
+	}
+	return nil
+}
+
+func validateRuleConfig(rule *RuleConfig) error {
+	if err := validateTable(rule.Table); err != nil {
+		return err
+	}
+	if err := validateSelector(rule.From); err != nil {
+		return err
+	}
+	if err := validateSelector(rule.To); err != nil {
+		return err
+	}
+
+	if rule.Fwmark != "" {
+		// e.g. 0x1 or 0x1/0xff
+		for _, part := range strings.SplitN(rule.Fwmark, "/", 2) {
+			if _, err := strconv.ParseUint(part, 0, 32); err != nil {
+				return fmt.Errorf("invalid fwmark %s", rule.Fwmark)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateRouteConfig(route *RouteConfig) error {
+	if route.Dst != "default" {
+		if _, _, err := net.ParseCIDR(route.Dst); err != nil {
+			return fmt.Errorf("invalid destination: %s", err)
+		}
+	}
+	if len(route.Nexthops) != 0 {
+		if err := validateNexthops(route); err != nil {
+			return err
+		}
+	} else {
+		if route.Via == "" && route.Dev == "" {
+			return fmt.Errorf("via or dev is required")
+		}
+		if route.Via != "" && net.ParseIP(route.Via) == nil {
+			return fmt.Errorf("invalid gateway %s", route.Via)
+		}
+	}
+	if route.Table != 0 {
+		return validateTable(route.Table)
+	}
+	return nil
+}
+
+func validateNexthops(route *RouteConfig) error {
+	if route.Via != "" || route.Dev != "" {
+		return fmt.Errorf("via and dev can't be used with nexthops")
+	}
+	if len(route.Nexthops) < 2 {
+		return fmt.Errorf("multipath route requires at least 2 nexthops")
+	}
+	for _, nh := range route.Nexthops {
+		if nh.Via == "" && nh.Dev == "" {
+			return fmt.Errorf("via or dev is required in nexthop")
+		}
+		if nh.Via != "" && net.ParseIP(nh.Via) == nil {
+			return fmt.Errorf("invalid gateway %s of nexthop", nh.Via)
+		}
+		if nh.Weight == 0 || nh.Weight > MaxNexthopWeight {
+			return fmt.Errorf("weight %d of nexthop must be from 1 to %d", nh.Weight, MaxNexthopWeight)
+		}
+	}
+	return nil
+}
+
+func validateHostname(hostname string) error {
+	if len(hostname) > 253 {
+		return fmt.Errorf("hostname must be at most 253 characters")
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("label %q must consist of alphanumerics and hyphens and must not start or end with a hyphen", label)
+		}
+	}
+
+	return nil
+}
+
+func validateAddrAttrs(device *NamespaceDeviceConfig) error {
+	if device.Broadcast == "" && device.Scope == "" {
+		return nil
+	}
+	if device.Cidr == "" {
+		return fmt.Errorf("broadcast and scope require CIDR")
+	}
+
+	if device.Scope != "" {
+		valid := false
+		for _, scope := range AddrScopes {
+			if device.Scope == scope {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown scope %q: valid scopes are %s", device.Scope, strings.Join(AddrScopes, ", "))
+		}
+	}
+
+	// The network of auto CIDR isn't known until it is allocated from the pool.
+	if device.Broadcast == "" || device.Cidr == CidrAuto {
+		return nil
+	}
+
+	ip, ipnet, err := net.ParseCIDR(device.Cidr)
+	if err != nil {
+		return err
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("broadcast is supported only by IPv4: %s", device.Cidr)
+	}
+	if device.Broadcast == BroadcastAuto || device.Broadcast == "+" {
+		return nil
+	}
+
+	brd := net.ParseIP(device.Broadcast)
+	if brd == nil || brd.To4() == nil {
+		return fmt.Errorf("broadcast %s must be an IPv4 address", device.Broadcast)
+	}
+	if !ipnet.Contains(brd) {
+		return fmt.Errorf("broadcast %s is out of %s", device.Broadcast, device.Cidr)
+	}
+	return nil
+}
+
+// validatePeer checks that the peer is another address of the same family
+// in the network of the CIDR unless the CIDR is a single host.
+func validatePeer(device *NamespaceDeviceConfig) error {
+	if device.Cidr == "" || device.Cidr == CidrAuto {
+		return fmt.Errorf("peer requires explicit CIDR")
+	}
+	if device.Broadcast != "" {
+		return fmt.Errorf("peer can't be used with broadcast")
+	}
+
+	ip, ipnet, err := net.ParseCIDR(device.Cidr)
+	if err != nil {
+		return err
+	}
+	peer := net.ParseIP(device.Peer)
+	if peer == nil {
+		return fmt.Errorf("peer %s must be an address without prefix", device.Peer)
+	}
+	if (ip.To4() == nil) != (peer.To4() == nil) {
+		return fmt.Errorf("peer %s and %s must be the same family", device.Peer, device.Cidr)
+	}
+	if peer.Equal(ip) {
+		return fmt.Errorf("peer %s must differ from the local address", device.Peer)
+	}
+
+	if ones, bits := ipnet.Mask.Size(); ones != bits && !ipnet.Contains(peer) {
+		return fmt.Errorf("peer %s is out of %s: use /%d to reach a peer in another network", device.Peer, device.Cidr, bits)
+	}
+	return nil
+}
+
+// validatePeerEnds checks that both ends of a direct link have peers pointing
+// at each other, or neither has.
+func validatePeerEnds(configs []*NamespaceConfig, linkConfigs []*LinkConfig) error {
+	type end struct {
+		ns     string
+		device NamespaceDeviceConfig
+	}
+
+	for _, link := range linkConfigs {
+		var ends []end
+		for _, cfg := range configs {
+			for _, device := range cfg.Devices {
+				if device.LinkName() == link.Name {
+					ends = append(ends, end{cfg.Name, device})
+				}
+			}
+		}
+
+		hasPeer := false
+		for _, e := range ends {
+			if e.device.Peer != "" {
+				hasPeer = true
+			}
+		}
+		if !hasPeer {
+			continue
+		}
+
+		if link.LinkMode != ModeDirectLink || link.HostCidr != "" {
+			return fmt.Errorf("peer is supported only by direct link without host_cidr: %s", link.Name)
+		}
+		if len(ends) != 2 {
+			continue
+		}
+
+		for i, e := range ends {
+			other := ends[1-i]
+			if e.device.Peer == "" {
+				return fmt.Errorf("device %s in namespace %s must have peer as the other end of link %s has", e.device.Name, e.ns, link.Name)
+			}
+			ip, _, err := net.ParseCIDR(other.device.Cidr)
+			if err != nil {
+				continue
+			}
+			if !ip.Equal(net.ParseIP(e.device.Peer)) {
+				return fmt.Errorf("peer %s of device %s in namespace %s must be %s, the address of the other end of link %s", e.device.Peer, e.device.Name, e.ns, ip, link.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateHostAddr checks that the IPv4 address of the CIDR is neither the
+// network nor the broadcast address, which are often copied from the subnet by
+// mistake. /31 and /32 have no such addresses.
+func validateHostAddr(cidr string) error {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil
+	}
+
+	network := make(net.IP, net.IPv4len)
+	copy(network, ipnet.IP.To4())
+	brd := make(net.IP, net.IPv4len)
+	for i := range brd {
+		brd[i] = network[i] | ^ipnet.Mask[i]
+	}
+
+	switch {
+	case ip4.Equal(network):
+		network[3]++
+		return fmt.Errorf("%s is the network address of %s: use a host address, e.g. %s/%d", ip4, ipnet, network, ones)
+	case ip4.Equal(brd):
+		brd[3]--
+		return fmt.Errorf("%s is the broadcast address of %s: use a host address, e.g. %s/%d", ip4, ipnet, brd, ones)
+	}
+	return nil
+}
+
+var ulaNetwork = &net.IPNet{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)}
+
+// validateUlaPrefix checks that the prefix is a /64 of unique local addresses,
+// whose host portion can be an EUI-64.
+func validateUlaPrefix(prefix string) error {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	if ip.To4() != nil || !ulaNetwork.Contains(ip) {
+		return fmt.Errorf("%s is not in %s", prefix, ulaNetwork)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != 64 {
+		return fmt.Errorf("%s must be /64", prefix)
+	}
+	return nil
+}
+
+func validateNetem(netem *NetemConfig) error {
+	if netem.Delay != "" {
+		if d, err := time.ParseDuration(netem.Delay); err != nil || d <= 0 {
+			return fmt.Errorf("delay %s must be a positive duration, e.g. 10ms", netem.Delay)
+		}
+	}
+
+	for _, p := range []struct {
+		name    string
+		percent float64
+	}{
+		{"loss_percent", netem.LossPercent},
+		{"duplicate_percent", netem.DuplicatePercent},
+		{"corrupt_percent", netem.CorruptPercent},
+		{"reorder_percent", netem.ReorderPercent},
+		{"reorder_correlation", netem.ReorderCorrelation},
+	} {
+		if p.percent < 0 || p.percent > 100 {
+			return fmt.Errorf("%s %v must be from 0 to 100", p.name, p.percent)
+		}
+	}
+
+	if netem.ReorderPercent == 0 && (netem.ReorderCorrelation != 0 || netem.ReorderGap != 0) {
+		return fmt.Errorf("reorder_correlation and reorder_gap require reorder_percent")
+	}
+	if netem.ReorderPercent != 0 && netem.Delay == "" {
+		return fmt.Errorf("reorder_percent requires delay")
+	}
+
+	if netem.Rate != "" && !tcRate.MatchString(netem.Rate) {
+		return fmt.Errorf("rate %s must be a number with the unit of tc, e.g. 100mbit", netem.Rate)
+	}
+	if (netem.Rate == "") != (netem.Burst == 0) {
+		return fmt.Errorf("rate and burst must be configured together")
+	}
+
+	if *netem == (NetemConfig{}) {
+		return fmt.Errorf("no impairment is configured")
+	}
+	return nil
+}
+
+// iptablesTables are the tables which can be given by -t in firewall rules.
+var iptablesTables = []string{"filter", "nat", "mangle", "raw", "security"}
+
+// validateFirewallRule checks the table and the command of the iptables rule.
+// The rest is left to iptables. Quotes are rejected because the rule is split
+// by spaces without shell.
+func validateFirewallRule(rule string) error {
+	if strings.ContainsAny(rule, "\"'") {
+		return fmt.Errorf("quotes are not supported")
+	}
+
+	args := strings.Fields(rule)
+	if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+		valid := false
+		for _, table := range iptablesTables {
+			if args[1] == table {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown table %s", args[1])
+		}
+		args = args[2:]
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("a command and a chain are required")
+	}
+	switch args[0] {
+	case "-A", "--append", "-I", "--insert", "-N", "--new-chain", "-P", "--policy":
+	default:
+		return fmt.Errorf("command %s must be -A, -I, -N or -P", args[0])
+	}
+	return nil
+}
+
+func validOffload(feature string) bool {
+	for _, f := range Offloads {
+		if feature == f {
+			return true
+		}
+	}
+	return false
+}
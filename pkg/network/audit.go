@@ -0,0 +1,110 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditRecord is a line of the audit log in JSON Lines.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Args      []string  `json:"args"`
+	DryRun    bool      `json:"dryrun"`
+	// ExitCode is -1 if the command didn't exit normally, e.g. failed to start
+	// or timed out. It is 0 for planned commands in dry-run.
+	ExitCode int           `json:"exit_code"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+var (
+	auditMu     sync.Mutex
+	auditWriter io.Writer
+)
+
+// SetAuditWriter sets the writer to which every command changing the host is
+// appended as JSON Lines. Read-only queries aren't recorded. The commands
+// planned in dry-run are recorded with dryrun true. nil disables the audit log.
+func SetAuditWriter(w io.Writer) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditWriter = w
+}
+
+func auditCommand(cmd *exec.Cmd, started time.Time, err error) {
+	record := AuditRecord{
+		Timestamp: started,
+		Args:      cmd.Args,
+		Duration:  time.Since(started),
+	}
+
+	if err != nil {
+		record.ExitCode = -1
+		record.Error = err.Error()
+	}
+	if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+		record.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	writeAudit(record)
+}
+
+// auditPlannedCommand records the command which isn't run because of dry-run.
+// It is also written to the script.
+func auditPlannedCommand(cmd *exec.Cmd) {
+	writeAudit(AuditRecord{
+		Timestamp: time.Now(),
+		Args:      cmd.Args,
+		DryRun:    true,
+	})
+	scriptCommand(cmd, false)
+}
+
+// auditPlannedTolerantCommand is auditPlannedCommand for the command whose
+// failure is only logged.
+func auditPlannedTolerantCommand(cmd *exec.Cmd) {
+	writeAudit(AuditRecord{
+		Timestamp: time.Now(),
+		Args:      cmd.Args,
+		DryRun:    true,
+	})
+	scriptCommand(cmd, true)
+}
+
+func writeAudit(record AuditRecord) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if auditWriter == nil {
+		return
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Warnf("failed to marshal audit record: %s", err)
+		return
+	}
+
+	if _, err := auditWriter.Write(append(b, '\n')); err != nil {
+		log.Warnf("failed to write audit record: %s", err)
+	}
+}
@@ -2,6 +2,7 @@ package network
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	"go.uber.org/multierr"
@@ -10,21 +11,46 @@ import (
 )
 
 type Bridge struct {
-	Name      string      `json:"name"`
-	VethPairs []*VethPair `json:"veth_pairs"`
+	Name       string      `json:"name"`
+	VethPairs  []*VethPair `json:"veth_pairs"`
+	TxQueueLen uint        `json:"txqueuelen,omitempty"`
+	Mtu        uint        `json:"mtu,omitempty"`
+	// Stp is true if the spanning tree protocol is enabled.
+	Stp bool `json:"stp,omitempty"`
+	// VlanFiltering filters the frames on every port by VLAN as vlan_filtering
+	// of the Linux bridge. See SetPortVlanFiltering.
+	VlanFiltering bool `json:"vlan_filtering,omitempty"`
+	// Description is set as the alias of the veths connected to the bridge.
+	Description string `json:"description,omitempty"`
 }
 
 func InitBridge(cfg *config.LinkConfig, dryrun bool) (*Bridge, error) {
 	if cfg.LinkMode != config.ModeBridge {
 		return nil, fmt.Errorf("invalid mode")
 	}
+	defer recordTiming(string(config.ModeBridge), cfg.Name, time.Now(), dryrun)
+	ScriptComment("bridge %s", cfg.Name)
 
 	if err := CreateNewBridge(cfg.Name, dryrun); err != nil {
 		return nil, err
 	}
 
+	if cfg.Stp {
+		if err := SetBridgeStp(cfg.Name, true, dryrun); err != nil {
+			if derr := DeleteBridge(cfg.Name, dryrun); derr != nil {
+				return nil, multierr.Append(err, derr)
+			}
+			return nil, err
+		}
+	}
+
 	return &Bridge{
-		Name: cfg.Name,
+		Name:          cfg.Name,
+		TxQueueLen:    cfg.TxQueueLen,
+		Mtu:           cfg.Mtu,
+		Stp:           cfg.Stp,
+		VlanFiltering: cfg.VlanFiltering,
+		Description:   cfg.Description,
 	}, nil
 }
 
@@ -43,11 +69,27 @@ func (d *Bridge) Destroy(dryrun bool) error {
 	return nil
 }
 
-// TODO: consider error handling
+// CreateLink connects the namespace to the bridge with a new veth pair. Every
+// member of the bridge has its own address: the CIDR of the device config of
+// the bridge in each namespace is assigned to the end in that namespace. The
+// ends are named <bridge>-<N>-left, so the interface names differ across the
+// members even though the device name in the config is the bridge name. Use
+// $(<bridge>) in commands to refer to the interface.
 func (d *Bridge) CreateLink(target *Namespace, dryrun bool) error {
+	defer observeDuration("create_bridge_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeBridge), d.Name, time.Now(), dryrun)
+
+	// Check before creating the veth pair not to leave it on failure.
+	if _, err := target.findDeviceConfigByLink(d.Name); err != nil {
+		return err
+	}
+
 	num := len(d.VethPairs) + 1
 	conf := VethConfig{
-		Name: d.Name + "-" + fmt.Sprint(num),
+		Name:        d.Name + "-" + fmt.Sprint(num),
+		TxQueueLen:  d.TxQueueLen,
+		Mtu:         d.Mtu,
+		Description: d.Description,
 	}
 
 	pair, err := InitVethPair(conf, dryrun)
@@ -55,19 +97,61 @@ func (d *Bridge) CreateLink(target *Namespace, dryrun bool) error {
 		return err
 	}
 
-	if err := target.Attach(&pair.Left, dryrun); err != nil {
+	if err := target.AttachToDevice(d.Name, &pair.Left, dryrun); err != nil {
+		if derr := pair.Destroy(dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
 		return err
 	}
 
+	if err := d.linkPort(pair, dryrun); err != nil {
+		if derr := d.discardPair(target, pair, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		return err
+	}
+
+	d.VethPairs = append(d.VethPairs, pair)
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeBridge)})
+	return nil
+}
+
+// linkPort adds the right end of the pair to the bridge as the port.
+func (d *Bridge) linkPort(pair *VethPair, dryrun bool) error {
 	if err := LinkBridge(d.Name, &pair.Right, dryrun); err != nil {
 		return err
 	}
 	pair.Right.Attached = true
 
-	d.VethPairs = append(d.VethPairs, pair)
+	if err := RunIpLinkSetHostState(pair.Right.Name, true, dryrun); err != nil {
+		return err
+	}
+
+	if d.VlanFiltering {
+		if err := SetPortVlanFiltering(&pair.Right, dryrun); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// discardPair deletes the pair whose left end is attached to the target, and
+// its port on the bridge if added, on failure of CreateLink.
+func (d *Bridge) discardPair(target *Namespace, pair *VethPair, dryrun bool) error {
+	if pair.Right.Attached {
+		if err := UnlinkBridge(d.Name, &pair.Right, dryrun); err != nil {
+			return err
+		}
+		pair.Right.Attached = false
+	}
+
+	// Deleting the host end deletes the end in the namespace too.
+	if err := RunIpLinkDelete(pair.Right.Name, dryrun); err != nil {
+		return err
+	}
+	return target.Release(&pair.Left)
+}
+
 func InitBridges(links []*config.LinkConfig, dryrun bool) (map[string]*Bridge, error) {
 	brs := make(map[string]*Bridge)
 	for _, link := range links {
@@ -77,7 +161,7 @@ func InitBridges(links []*config.LinkConfig, dryrun bool) (map[string]*Bridge, e
 
 		br, err := InitBridge(link, dryrun)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init bridge: %s: %s", link.Name, err)
+			return nil, fmt.Errorf("failed to init bridge: %s: %w", link.Name, err)
 		}
 
 		brs[br.Name] = br
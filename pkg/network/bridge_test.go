@@ -0,0 +1,67 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+// recordRunner records the commands and fails the ones containing fail.
+func recordRunner(cmds *[]string, fail string) Runner {
+	return func(cmd *exec.Cmd) ([]byte, error) {
+		line := strings.Join(cmd.Args, " ")
+		*cmds = append(*cmds, line)
+		if fail != "" && strings.Contains(line, fail) {
+			return nil, fmt.Errorf("%s: failed", line)
+		}
+		return nil, nil
+	}
+}
+
+func TestBridgeCreateLinkDeletesPairOnFailure(t *testing.T) {
+	for _, fail := range []string{"add-port", "vlan_mode"} {
+		t.Run(fail, func(t *testing.T) {
+			var cmds []string
+			defer NewOptions(WithRunner(recordRunner(&cmds, fail)), WithVerbose(false)).Apply()()
+
+			ns := &Namespace{
+				Name: "ns1",
+				RegisteredDeviceConfig: []RegisteredDeviceConfig{
+					{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "br0", Cidr: "10.0.0.1/24"}},
+				},
+			}
+			br := &Bridge{Name: "br0", VlanFiltering: true}
+
+			if err := br.CreateLink(ns, false); err == nil {
+				t.Fatal("CreateLink succeeded though the port failed")
+			}
+
+			if !strings.HasSuffix(cmds[len(cmds)-1], "link delete br0-1-right") {
+				t.Errorf("veth pair is left: %v", cmds)
+			}
+			if len(br.VethPairs) != 0 {
+				t.Errorf("failed pair is kept in the bridge: %v", br.VethPairs)
+			}
+			if ns.RegisteredDeviceConfig[0].AttachedVeth != "" {
+				t.Errorf("device config is still bound to %s", ns.RegisteredDeviceConfig[0].AttachedVeth)
+			}
+		})
+	}
+}
@@ -2,23 +2,67 @@ package network
 
 import (
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	"go.uber.org/multierr"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type DirectLink struct {
-	VethPair `json:"veth_pair"`
-	Name     string `json:"name"`
+	VethPair          `json:"veth_pair"`
+	Name              string `json:"name"`
+	CreateInNamespace bool   `json:"create_in_namespace,omitempty"`
+	// HostCidr is the CIDR of the right end which stays on the host. The right
+	// end is never attached to namespaces, so it is deleted explicitly on Destroy.
+	HostCidr string `json:"host_cidr,omitempty"`
+	// Endpoints are the device names of the left and the right ends. The ends
+	// are matched with the devices by the name of the link if empty.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Namespaces are the names of the namespaces of the left and the right ends.
+	// The ends are assigned in the order of the namespaces if empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// HostDebug keeps both ends on the host with the CIDRs of the devices. It is
+	// only for debugging.
+	HostDebug bool `json:"host_debug,omitempty"`
 }
 
 func InitDirectLink(cfg *config.LinkConfig, dryrun bool) (*DirectLink, error) {
 	if cfg.LinkMode != config.ModeDirectLink {
 		return nil, fmt.Errorf("invalid mode")
 	}
+	defer recordTiming(string(config.ModeDirectLink), cfg.Name, time.Now(), dryrun)
+	ScriptComment("direct link %s", cfg.Name)
 
 	conf := VethConfig{
-		Name: cfg.Name,
+		Name:        cfg.Name,
+		TxQueueLen:  cfg.TxQueueLen,
+		Mtu:         cfg.Mtu,
+		Description: cfg.Description,
+	}
+
+	// The veth pair will be created with the namespaces on CreateLink.
+	if cfg.CreateInNamespace {
+		return &DirectLink{
+			VethPair: VethPair{
+				Left:        Veth{Name: conf.Name + "-left", Attached: false, Mtu: conf.Mtu},
+				Right:       Veth{Name: conf.Name + "-right", Attached: false, Mtu: conf.Mtu},
+				TxQueueLen:  conf.TxQueueLen,
+				Description: conf.Description,
+			},
+			Name:              cfg.Name,
+			CreateInNamespace: true,
+			Endpoints:         cfg.Endpoints,
+			Namespaces:        cfg.Namespaces,
+		}, nil
+	}
+
+	if cfg.HostCidr != "" {
+		if _, _, err := net.ParseCIDR(cfg.HostCidr); err != nil {
+			return nil, Errorf(ErrInvalidCIDR, "failed to parse host CIDR %s: %s", cfg.HostCidr, err)
+		}
 	}
 
 	pair, err := InitVethPair(conf, dryrun)
@@ -27,30 +71,233 @@ func InitDirectLink(cfg *config.LinkConfig, dryrun bool) (*DirectLink, error) {
 	}
 
 	return &DirectLink{
-		VethPair: *pair,
-		Name:     cfg.Name,
+		VethPair:   *pair,
+		Name:       cfg.Name,
+		HostCidr:   cfg.HostCidr,
+		Endpoints:  cfg.Endpoints,
+		Namespaces: cfg.Namespaces,
+		HostDebug:  cfg.HostDebug,
 	}, nil
 }
 
 func (d *DirectLink) Destroy(dryrun bool) error {
+	// The pair exists only while attached, since RemoveLink and the rollback of
+	// CreateLink delete it. Nothing has been created otherwise.
+	if d.CreateInNamespace && !d.Left.Attached && !d.Right.Attached {
+		return nil
+	}
+
 	return d.VethPair.Destroy(dryrun)
 }
 
-// TODO: consider error handling
+// CreateLink attaches both ends of the veth pair to the namespaces. If the right
+// side fails, the left side is detached again so no half-attached veth is left.
 func (d *DirectLink) CreateLink(left *Namespace, right *Namespace, dryrun bool) error {
 	if d.VethPair.Left.Attached && d.VethPair.Right.Attached {
-		return fmt.Errorf("%s has been already busy\n", d.Name)
+		return Errorf(ErrDeviceAttached, "%s has been already busy\n", d.Name)
+	}
+
+	defer observeDuration("create_direct_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeDirectLink), d.Name, time.Now(), dryrun)
+
+	var err error
+	if d.CreateInNamespace {
+		err = d.createLinkInNamespaces(left, right, dryrun)
+	} else {
+		err = d.createLinkOnHost(left, right, dryrun)
+	}
+	if err != nil {
+		return err
+	}
+
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeDirectLink)})
+	return nil
+}
+
+// attachEnd attaches the veth of the end, 0 for left and 1 for right, to the
+// device of the endpoint, or the device found by the veth name.
+func (d *DirectLink) attachEnd(ns *Namespace, end int, veth *Veth, move bool, dryrun bool) error {
+	if len(d.Endpoints) == 0 {
+		return ns.attach(veth, move, dryrun)
+	}
+	return ns.attachToDevice(d.Endpoints[end], veth, move, dryrun)
+}
+
+// findEnd is the same as attachEnd but only returns the index of the device
+// config.
+func (d *DirectLink) findEnd(ns *Namespace, end int, veth *Veth) (int, error) {
+	if len(d.Endpoints) == 0 {
+		return ns.findDeviceConfig(veth)
+	}
+	return ns.findDeviceConfigByLink(d.Endpoints[end])
+}
+
+func (d *DirectLink) createLinkOnHost(left *Namespace, right *Namespace, dryrun bool) error {
+	if err := d.attachEnd(left, 0, &d.VethPair.Left, true, dryrun); err != nil {
+		return err
 	}
 
-	if err := (*left).Attach(&d.VethPair.Left, dryrun); err != nil {
+	if err := d.attachEnd(right, 1, &d.VethPair.Right, true, dryrun); err != nil {
+		if derr := (*left).Detach(&d.VethPair.Left, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// CreateHostLink attaches the left end to the namespace and assigns HostCidr to
+// the right end which stays on the host.
+func (d *DirectLink) CreateHostLink(left *Namespace, dryrun bool) error {
+	defer observeDuration("create_direct_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeDirectLink), d.Name, time.Now(), dryrun)
+
+	if d.HostCidr == "" {
+		return Errorf(ErrNotFound, "%s doesn't have the host end", d.Name)
+	}
+
+	if d.VethPair.Left.Attached {
+		return Errorf(ErrDeviceAttached, "%s has been already busy\n", d.Name)
+	}
+
+	if err := left.Attach(&d.VethPair.Left, dryrun); err != nil {
+		return err
+	}
+
+	if err := RunAssignCidrToHost(d.VethPair.Right.Name, d.HostCidr, dryrun); err != nil {
+		if derr := left.Detach(&d.VethPair.Left, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
 		return err
 	}
 
-	if err := (*right).Attach(&d.VethPair.Right, dryrun); err != nil {
-		// TODO: add error handling if left succeeded but right failed.
+	if err := RunIpLinkSetHostState(d.VethPair.Right.Name, true, dryrun); err != nil {
+		if derr := left.Detach(&d.VethPair.Left, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
 		return err
 	}
 
+	log.Infof("succeeded to attach CIDR %s to dev %s on host\n", d.HostCidr, d.VethPair.Right.Name)
+
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeDirectLink)})
+	return nil
+}
+
+// CreateDebugLink assigns the CIDRs of the devices in the namespaces to the ends
+// which stay on the host, instead of moving them into the namespaces. This is
+// only for debugging, e.g. to run tcpdump on both ends from the host.
+func (d *DirectLink) CreateDebugLink(left *Namespace, right *Namespace, dryrun bool) error {
+	defer observeDuration("create_direct_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeDirectLink), d.Name, time.Now(), dryrun)
+
+	log.Warnf("%s is in host debug mode: both ends stay on the host and %s and %s are not connected", d.Name, left.Name, right.Name)
+
+	for i, end := range []struct {
+		ns   *Namespace
+		veth *Veth
+	}{{left, &d.VethPair.Left}, {right, &d.VethPair.Right}} {
+		idx, err := d.findEnd(end.ns, i, end.veth)
+		if err != nil {
+			return err
+		}
+
+		cidr := end.ns.RegisteredDeviceConfig[idx].Cidr
+		if cidr != "" {
+			if err := RunAssignCidrToHost(end.veth.Name, cidr, dryrun); err != nil {
+				return err
+			}
+		}
+
+		if err := RunIpLinkSetHostState(end.veth.Name, true, dryrun); err != nil {
+			return err
+		}
+	}
+
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeDirectLink)})
+	return nil
+}
+
+// RemoveLink detaches the ends attached by CreateLink or CreateHostLink from the
+// namespaces. right is ignored for the link with the host end. The pair created
+// in the namespaces is deleted instead, since it has never been on the host.
+func (d *DirectLink) RemoveLink(left *Namespace, right *Namespace, dryrun bool) error {
+	if d.CreateInNamespace {
+		return d.removeLinkInNamespaces(left, right, dryrun)
+	}
+
+	var allerr error
+	if d.VethPair.Left.Attached {
+		if err := left.Detach(&d.VethPair.Left, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	if d.HostCidr == "" && d.VethPair.Right.Attached {
+		if err := right.Detach(&d.VethPair.Right, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	return allerr
+}
+
+func (d *DirectLink) removeLinkInNamespaces(left *Namespace, right *Namespace, dryrun bool) error {
+	if !d.VethPair.Left.Attached && !d.VethPair.Right.Attached {
+		return nil
+	}
+
+	// Deleting one end deletes the whole veth pair.
+	end, ns := d.VethPair.Left, left
+	if !end.Attached {
+		end, ns = d.VethPair.Right, right
+	}
+	if err := RunIpLinkDeleteInNamespace(end.Name, ns.Name, dryrun); err != nil {
+		return err
+	}
+
+	var allerr error
+	if d.VethPair.Left.Attached {
+		allerr = multierr.Append(allerr, left.Release(&d.VethPair.Left))
+	}
+	if d.VethPair.Right.Attached {
+		allerr = multierr.Append(allerr, right.Release(&d.VethPair.Right))
+	}
+	return allerr
+}
+
+func (d *DirectLink) createLinkInNamespaces(left *Namespace, right *Namespace, dryrun bool) error {
+	if _, err := d.findEnd(left, 0, &d.VethPair.Left); err != nil {
+		return err
+	}
+	if _, err := d.findEnd(right, 1, &d.VethPair.Right); err != nil {
+		return err
+	}
+
+	if err := d.VethPair.CreateInNamespaces(left.Name, right.Name, dryrun); err != nil {
+		return err
+	}
+
+	rollback := func(err error) error {
+		// Deleting one end deletes the whole veth pair.
+		if derr := RunIpLinkDeleteInNamespace(d.VethPair.Left.Name, left.Name, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		if d.VethPair.Left.Attached {
+			left.Release(&d.VethPair.Left)
+		}
+		return err
+	}
+
+	if err := d.attachEnd(left, 0, &d.VethPair.Left, false, dryrun); err != nil {
+		return rollback(err)
+	}
+
+	if err := d.attachEnd(right, 1, &d.VethPair.Right, false, dryrun); err != nil {
+		return rollback(err)
+	}
+
 	return nil
 }
 
@@ -63,7 +310,7 @@ func InitDirectLinks(links []*config.LinkConfig, dryrun bool) (map[string]*Direc
 
 		dlink, err := InitDirectLink(link, dryrun)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init direct link: %s: %s", link.Name, err)
+			return nil, fmt.Errorf("failed to init direct link: %s: %w", link.Name, err)
 		}
 
 		dlinks[dlink.Name] = dlink
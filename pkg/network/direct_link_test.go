@@ -0,0 +1,125 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+// fakeHost emulates the namespaces and the veths of the host for the commands
+// deleting them.
+type fakeHost struct {
+	namespaces map[string]bool
+	// links are the namespaces of the devices. The host is "".
+	links map[string]string
+	peers map[string]string
+}
+
+func newFakeHost() *fakeHost {
+	return &fakeHost{
+		namespaces: map[string]bool{},
+		links:      map[string]string{},
+		peers:      map[string]string{},
+	}
+}
+
+func (h *fakeHost) addVeth(left string, leftNs string, right string, rightNs string) {
+	h.links[left], h.links[right] = leftNs, rightNs
+	h.peers[left], h.peers[right] = right, left
+}
+
+func (h *fakeHost) deleteLink(name string) {
+	peer := h.peers[name]
+	delete(h.links, name)
+	delete(h.links, peer)
+}
+
+func (h *fakeHost) run(cmd *exec.Cmd) ([]byte, error) {
+	args := strings.Join(cmd.Args[1:], " ")
+	switch {
+	case args == "netns list":
+		var out string
+		for ns := range h.namespaces {
+			out += ns + "\n"
+		}
+		return []byte(out), nil
+	case strings.HasPrefix(args, "link show "):
+		name := strings.TrimPrefix(args, "link show ")
+		if ns, ok := h.links[name]; !ok || ns != "" {
+			return nil, fmt.Errorf("%s: Device %q does not exist", args, name)
+		}
+	case strings.HasPrefix(args, "link delete "):
+		h.deleteLink(strings.TrimPrefix(args, "link delete "))
+	case strings.HasPrefix(args, "netns delete "):
+		ns := strings.TrimPrefix(args, "netns delete ")
+		delete(h.namespaces, ns)
+		for name, in := range h.links {
+			if in == ns {
+				h.deleteLink(name)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestDirectLinkAndNamespaceDeletionOrders(t *testing.T) {
+	for _, linkFirst := range []bool{true, false} {
+		t.Run(fmt.Sprintf("link first %t", linkFirst), func(t *testing.T) {
+			host := newFakeHost()
+			host.namespaces["ayame-test-ns1"] = true
+			host.addVeth("veth1-left", "ayame-test-ns1", "veth1-right", "")
+			defer NewOptions(WithRunner(host.run), WithVerbose(false)).Apply()()
+
+			link := &DirectLink{
+				Name:     "veth1",
+				HostCidr: "10.0.0.2/24",
+				VethPair: VethPair{
+					Left:  Veth{Name: "veth1-left", Attached: true},
+					Right: Veth{Name: "veth1-right"},
+				},
+			}
+			ns := &Namespace{
+				Name: "ayame-test-ns1",
+				RegisteredDeviceConfig: []RegisteredDeviceConfig{
+					{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.1/24"}, AttachedVeth: "veth1-left"},
+				},
+			}
+
+			// Deleting the namespace deletes the veth in it, and so its peer on
+			// the host. The link is deleted anyway.
+			destroys := []func() error{
+				func() error { return CleanupDirectLinks(map[string]*DirectLink{link.Name: link}, false) },
+				func() error { return ns.Destroy(false) },
+			}
+			if !linkFirst {
+				destroys[0], destroys[1] = destroys[1], destroys[0]
+			}
+			for _, destroy := range destroys {
+				if err := destroy(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(host.namespaces) != 0 || len(host.links) != 0 {
+				t.Errorf("resources are left: %v %v", host.namespaces, host.links)
+			}
+		})
+	}
+}
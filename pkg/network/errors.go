@@ -0,0 +1,139 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/multierr"
+)
+
+// Errors which callers can handle with errors.Is.
+var (
+	// ErrAlreadyActive means that the resources have already been created.
+	ErrAlreadyActive = errors.New("already active")
+	// ErrInactive means that the resources haven't been created or attached.
+	ErrInactive = errors.New("inactive")
+	// ErrInvalidCIDR means that the CIDR can't be parsed.
+	ErrInvalidCIDR = errors.New("invalid CIDR")
+	// ErrDeviceAttached means that the device or the link is already in use.
+	ErrDeviceAttached = errors.New("device attached")
+	// ErrNotFound means that the device, the config or the route doesn't exist.
+	ErrNotFound = errors.New("not found")
+)
+
+// kindError classifies the error as one of the errors above without changing
+// the message.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// Errorf formats the error like fmt.Errorf and makes errors.Is(err, kind) true.
+func Errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// ErrorCode is the stable name of the kind of the error for tooling.
+type ErrorCode string
+
+const (
+	CodeAlreadyActive  ErrorCode = "already_active"
+	CodeInactive       ErrorCode = "inactive"
+	CodeInvalidCIDR    ErrorCode = "invalid_cidr"
+	CodeDeviceAttached ErrorCode = "device_attached"
+	CodeNotFound       ErrorCode = "not_found"
+	CodeCanceled       ErrorCode = "canceled"
+	CodeTimeout        ErrorCode = "timeout"
+	CodeUnknown        ErrorCode = "unknown"
+)
+
+var errorCodes = []struct {
+	kind error
+	code ErrorCode
+}{
+	{ErrAlreadyActive, CodeAlreadyActive},
+	{ErrInactive, CodeInactive},
+	{ErrInvalidCIDR, CodeInvalidCIDR},
+	{ErrDeviceAttached, CodeDeviceAttached},
+	{ErrNotFound, CodeNotFound},
+	{context.Canceled, CodeCanceled},
+	{context.DeadlineExceeded, CodeTimeout},
+}
+
+// CodeOf returns the code of the first kind err matches, or CodeUnknown.
+func CodeOf(err error) ErrorCode {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.kind) {
+			return c.code
+		}
+	}
+	return CodeUnknown
+}
+
+// resourceError records the resource which the error happened on.
+type resourceError struct {
+	resource string
+	err      error
+}
+
+func (e *resourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *resourceError) Unwrap() error {
+	return e.err
+}
+
+// WithResource annotates err with the resource, e.g. namespace/ns1, so that it
+// is reported in ErrorRecord. It returns nil if err is nil.
+func WithResource(err error, resource string) error {
+	if err == nil {
+		return nil
+	}
+	return &resourceError{resource: resource, err: err}
+}
+
+// ErrorRecord is the form of an error for tooling.
+type ErrorRecord struct {
+	Code     ErrorCode `json:"code"`
+	Message  string    `json:"message"`
+	Resource string    `json:"resource,omitempty"`
+}
+
+// ErrorRecords splits the errors combined by multierr and returns a record for
+// each. It returns an empty slice if err is nil.
+func ErrorRecords(err error) []ErrorRecord {
+	records := []ErrorRecord{}
+	for _, e := range multierr.Errors(err) {
+		record := ErrorRecord{Code: CodeOf(e), Message: e.Error()}
+		var rerr *resourceError
+		if errors.As(e, &rerr) {
+			record.Resource = rerr.resource
+		}
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunEthtoolSetOffloads turns the offload features of the interface in the
+// namespace on or off in a single ethtool -K in the order of the names.
+func RunEthtoolSetOffloads(ifname string, nsname string, offloads map[string]bool, dryrun bool) error {
+	if len(offloads) == 0 {
+		return nil
+	}
+
+	var features []string
+	for feature := range offloads {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	args := []string{"netns", "exec", nsname, "ethtool", "-K", ifname}
+	for _, feature := range features {
+		state := "off"
+		if offloads[feature] {
+			state = "on"
+		}
+		args = append(args, feature, state)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if _, err := exec.LookPath("ethtool"); err != nil {
+		return fmt.Errorf("ethtool is not found in PATH %s: install ethtool to set offloads of %s", os.Getenv("PATH"), ifname)
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set offloads of %s in ns %s: %w", ifname, nsname, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// IpBinEnv is the environment variable to override the path of ip.
+const IpBinEnv = "IP_BIN"
+
+// ipBin returns the ip command used by every invocation.
+func ipBin() string {
+	if path := os.Getenv(IpBinEnv); path != "" {
+		return path
+	}
+	return "ip"
+}
+
+// CommandTimeout is the maximum duration of every command. The command is
+// killed if it doesn't finish in time, e.g. blocked on a stuck netlink.
+var CommandTimeout = 30 * time.Second
+
+// runner runs every command. It is replaced by Options.Runner.
+var runner Runner = outputCommandWithTimeout
+
+// runCommand runs the command with CommandTimeout. The returned error contains
+// the full command line and stderr so that failures are self-explanatory.
+func runCommand(cmd *exec.Cmd) error {
+	_, err := outputCommand(cmd)
+	return err
+}
+
+// outputCommand is the same as runCommand but returns stdout.
+func outputCommand(cmd *exec.Cmd) ([]byte, error) {
+	started := time.Now()
+	out, err := runner(cmd)
+	auditCommand(cmd, started, err)
+	return out, err
+}
+
+// queryCommand is the same as outputCommand for the read-only commands, e.g.
+// listing, probing or polling. They aren't recorded in the audit log, which
+// tracks the changes made to the host.
+func queryCommand(cmd *exec.Cmd) ([]byte, error) {
+	return runner(cmd)
+}
+
+func outputCommandWithTimeout(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %s", cmd.String(), err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return stdout.Bytes(), commandError(cmd, err, stderr.String())
+		}
+		return stdout.Bytes(), nil
+	case <-time.After(CommandTimeout):
+		cmd.Process.Kill()
+		<-done
+		return stdout.Bytes(), fmt.Errorf("%s: timed out after %s", cmd.String(), CommandTimeout)
+	}
+}
+
+// CommandError is the failure of the command which exited with non-zero status.
+type CommandError struct {
+	Cmd    string
+	Err    error
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %s", e.Cmd, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Cmd, e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the command failed with the errno, e.g. syscall.EBUSY. The
+// tools such as ip exit with the same status for any failure and only print
+// the message of the errno, so it is looked up in stderr.
+func (e *CommandError) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	return strings.Contains(strings.ToLower(e.Stderr), strings.ToLower(errno.Error()))
+}
+
+func commandError(cmd *exec.Cmd, err error, stderr string) error {
+	return &CommandError{Cmd: cmd.String(), Err: err, Stderr: strings.TrimSpace(stderr)}
+}
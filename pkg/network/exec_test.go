@@ -0,0 +1,68 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeleteNetnsRetriesOnlyBusy(t *testing.T) {
+	prevRetries, prevBackoff := NetnsDeleteRetries, NetnsDeleteBackoff
+	NetnsDeleteRetries, NetnsDeleteBackoff = 2, time.Millisecond
+	defer func() { NetnsDeleteRetries, NetnsDeleteBackoff = prevRetries, prevBackoff }()
+
+	for _, tc := range []struct {
+		stderr string
+		runs   int
+	}{
+		{stderr: "Cannot remove namespace file \"/run/netns/ns1\": Device or resource busy", runs: 3},
+		{stderr: "Cannot remove namespace file \"/run/netns/ns1\": No such file or directory", runs: 1},
+	} {
+		runs := 0
+		fail := func(cmd *exec.Cmd) ([]byte, error) {
+			runs++
+			return nil, commandError(cmd, errors.New("exit status 1"), tc.stderr)
+		}
+		restore := NewOptions(WithRunner(fail), WithVerbose(false)).Apply()
+
+		err := deleteNetns("ns1", false, false)
+		restore()
+
+		if err == nil {
+			t.Fatalf("%s: deletion succeeded", tc.stderr)
+		}
+		if errors.Is(err, syscall.EBUSY) != (tc.runs > 1) {
+			t.Errorf("%s: errors.Is(EBUSY) is %t", tc.stderr, errors.Is(err, syscall.EBUSY))
+		}
+		if runs != tc.runs {
+			t.Errorf("%s: run %d times, want %d", tc.stderr, runs, tc.runs)
+		}
+	}
+}
+
+func TestCommandErrorKeepsMessage(t *testing.T) {
+	cmd := exec.Command("ip", "netns", "delete", "ns1")
+	err := fmt.Errorf("failed to delete ns ns1: %w", commandError(cmd, errors.New("exit status 1"), "busy\n"))
+
+	want := "failed to delete ns ns1: " + cmd.String() + ": exit status 1: busy"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
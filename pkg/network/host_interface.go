@@ -0,0 +1,135 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// HostInterface is the existing interface on the host moved into the namespace.
+type HostInterface struct {
+	config.HostInterfaceConfig `json:"config"`
+	Adopted                    bool `json:"adopted"`
+}
+
+// checkCriticalInterface returns an error if the interface is the loopback or
+// the interface of the default route, whose move would cut off the host.
+func checkCriticalInterface(name string, dryrun bool) error {
+	if name == "lo" {
+		return fmt.Errorf("loopback must not be moved")
+	}
+
+	if dryrun {
+		return nil
+	}
+
+	devs, err := ListDefaultRouteDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, dev := range devs {
+		if dev == name {
+			return fmt.Errorf("%s is the device of the default route", name)
+		}
+	}
+
+	return nil
+}
+
+// AdoptInterface moves the existing interface on the host into the namespace
+// and assigns the CIDR to it. The loopback and the interface of the default
+// route are refused unless AllowCritical is set.
+func (n *Namespace) AdoptInterface(cfg config.HostInterfaceConfig, dryrun bool) error {
+	for _, hif := range n.HostInterfaces {
+		if hif.Name == cfg.Name && hif.Adopted {
+			return Errorf(ErrDeviceAttached, "host interface %s is already adopted by ns %s", cfg.Name, n.Name)
+		}
+	}
+
+	if !CheckIpLinkExists(cfg.Name, dryrun) {
+		return Errorf(ErrNotFound, "host interface %s doesn't exist", cfg.Name)
+	}
+
+	if !cfg.AllowCritical {
+		if err := checkCriticalInterface(cfg.Name, dryrun); err != nil {
+			return fmt.Errorf("refused to move host interface %s: %w", cfg.Name, err)
+		}
+	}
+
+	if err := RunIpLinkSetNamespaces(cfg.Name, n.Name, dryrun); err != nil {
+		return err
+	}
+
+	hif := HostInterface{HostInterfaceConfig: cfg, Adopted: true}
+	n.setHostInterface(hif)
+
+	if err := waitForInterface(n.Name, cfg.Name, InterfaceWaitTimeout, dryrun); err != nil {
+		return err
+	}
+
+	if cfg.Cidr != "" {
+		if err := RunAssignCidrToNamespaces(cfg.Name, n.Name, cfg.Cidr, "", "", "", "", dryrun); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("succeeded to adopt host interface %s in ns %s\n", cfg.Name, n.Name)
+	return nil
+}
+
+// AdoptInterfaces adopts all the host interfaces configured in the namespace.
+func (n *Namespace) AdoptInterfaces(dryrun bool) error {
+	for _, hif := range n.HostInterfaces {
+		if hif.Adopted {
+			continue
+		}
+		if err := n.AdoptInterface(hif.HostInterfaceConfig, dryrun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseInterfaces moves the adopted interfaces back to the host.
+func (n *Namespace) ReleaseInterfaces(dryrun bool) error {
+	for i := range n.HostInterfaces {
+		hif := &n.HostInterfaces[i]
+		if !hif.Adopted {
+			continue
+		}
+
+		if err := RunIpLinkSetHostNamespace(hif.Name, n.Name, dryrun); err != nil {
+			return err
+		}
+		hif.Adopted = false
+
+		log.Infof("succeeded to release host interface %s from ns %s\n", hif.Name, n.Name)
+	}
+	return nil
+}
+
+func (n *Namespace) setHostInterface(hif HostInterface) {
+	for i := range n.HostInterfaces {
+		if n.HostInterfaces[i].Name == hif.Name {
+			n.HostInterfaces[i] = hif
+			return
+		}
+	}
+	n.HostInterfaces = append(n.HostInterfaces, hif)
+}
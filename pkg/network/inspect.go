@@ -0,0 +1,231 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LiveInterface is the interface as seen by the kernel.
+type LiveInterface struct {
+	Name      string        `json:"name"`
+	OperState string        `json:"operstate"`
+	Mtu       int           `json:"mtu"`
+	Addresses []LiveAddress `json:"addresses"`
+}
+
+type LiveAddress struct {
+	Family string `json:"family"`
+	Cidr   string `json:"cidr"`
+	Scope  string `json:"scope,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
+// LiveRoute is the route as seen by the kernel.
+type LiveRoute struct {
+	Dst      string `json:"dst"`
+	Gateway  string `json:"gateway,omitempty"`
+	Dev      string `json:"dev,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	PrefSrc  string `json:"prefsrc,omitempty"`
+	Metric   int    `json:"metric,omitempty"`
+}
+
+// outputJSONInNamespace runs `ip -j <args>` in the namespace and decodes stdout.
+// It runs on the host if nsname is empty.
+func outputJSONInNamespace(ctx context.Context, nsname string, v interface{}, args ...string) error {
+	cmdArgs := append([]string{"-j"}, args...)
+	if nsname != "" {
+		cmdArgs = append([]string{"netns", "exec", nsname, ipBin()}, cmdArgs...)
+	}
+	cmd := exec.CommandContext(ctx, ipBin(), cmdArgs...)
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(output, v); err != nil {
+		return fmt.Errorf("failed to parse the output of %s: %w", cmd.String(), err)
+	}
+
+	return nil
+}
+
+// InspectAddrsInNamespace returns the interfaces and their addresses in the
+// namespace, parsed from `ip -j addr`.
+func InspectAddrsInNamespace(ctx context.Context, nsname string) ([]LiveInterface, error) {
+	var raw []struct {
+		Ifname    string `json:"ifname"`
+		OperState string `json:"operstate"`
+		Mtu       int    `json:"mtu"`
+		AddrInfo  []struct {
+			Family    string `json:"family"`
+			Local     string `json:"local"`
+			PrefixLen int    `json:"prefixlen"`
+			Scope     string `json:"scope"`
+			Label     string `json:"label"`
+		} `json:"addr_info"`
+	}
+
+	if err := outputJSONInNamespace(ctx, nsname, &raw, "addr"); err != nil {
+		return nil, fmt.Errorf("failed to inspect addresses in ns %s: %w", nsname, err)
+	}
+
+	ifaces := []LiveInterface{}
+	for _, r := range raw {
+		iface := LiveInterface{
+			Name:      r.Ifname,
+			OperState: r.OperState,
+			Mtu:       r.Mtu,
+			Addresses: []LiveAddress{},
+		}
+		for _, a := range r.AddrInfo {
+			iface.Addresses = append(iface.Addresses, LiveAddress{
+				Family: a.Family,
+				Cidr:   fmt.Sprintf("%s/%d", a.Local, a.PrefixLen),
+				Scope:  a.Scope,
+				Label:  a.Label,
+			})
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, nil
+}
+
+// InspectRoutesInNamespace returns the routes of the main table in the
+// namespace, parsed from `ip -j route`.
+func InspectRoutesInNamespace(ctx context.Context, nsname string) ([]LiveRoute, error) {
+	routes := []LiveRoute{}
+	if err := outputJSONInNamespace(ctx, nsname, &routes, "route"); err != nil {
+		return nil, fmt.Errorf("failed to inspect routes in ns %s: %w", nsname, err)
+	}
+
+	return routes, nil
+}
+
+// VethPeer maps the interface in the namespace to the other end of the veth
+// pair by the interface indexes, which survive renaming.
+type VethPeer struct {
+	Namespace string `json:"namespace"`
+	Interface string `json:"interface"`
+	Index     int    `json:"index"`
+	// PeerNamespace is empty if the peer is on the host.
+	PeerNamespace string `json:"peer_namespace,omitempty"`
+	PeerInterface string `json:"peer_interface"`
+	PeerIndex     int    `json:"peer_index"`
+}
+
+type rawLink struct {
+	Ifindex   int    `json:"ifindex"`
+	Ifname    string `json:"ifname"`
+	LinkIndex int    `json:"link_index"`
+}
+
+// InspectVethPeer finds the peer of the veth in the namespace among the
+// candidate namespaces, where "" is the host. The peer is the interface whose
+// index is the link index of the veth and whose link index is the veth.
+func InspectVethPeer(ctx context.Context, nsname string, ifname string, candidates []string) (*VethPeer, error) {
+	var links []rawLink
+	if err := outputJSONInNamespace(ctx, nsname, &links, "link", "show", "dev", ifname); err != nil {
+		return nil, fmt.Errorf("failed to inspect %s in ns %s: %w", ifname, nsname, err)
+	}
+	if len(links) != 1 {
+		return nil, Errorf(ErrNotFound, "%s is not found in ns %s", ifname, nsname)
+	}
+
+	self := links[0]
+	// The link index is shown only if the peer is in another namespace.
+	if self.LinkIndex == 0 {
+		return nil, Errorf(ErrNotFound, "%s in ns %s has no peer in other namespaces", ifname, nsname)
+	}
+
+	for _, candidate := range candidates {
+		var peers []rawLink
+		if err := outputJSONInNamespace(ctx, candidate, &peers, "link", "show"); err != nil {
+			return nil, fmt.Errorf("failed to inspect links in ns %s: %w", candidate, err)
+		}
+
+		for _, peer := range peers {
+			if peer.Ifindex != self.LinkIndex || peer.LinkIndex != self.Ifindex {
+				continue
+			}
+			return &VethPeer{
+				Namespace:     nsname,
+				Interface:     self.Ifname,
+				Index:         self.Ifindex,
+				PeerNamespace: candidate,
+				PeerInterface: peer.Ifname,
+				PeerIndex:     peer.Ifindex,
+			}, nil
+		}
+	}
+
+	return nil, Errorf(ErrNotFound, "peer of %s in ns %s with index %d is not found", ifname, nsname, self.LinkIndex)
+}
+
+// AddressWaitTimeout makes the creation block until the assigned addresses are
+// usable, e.g. IPv6 DAD has finished, with WaitForAddresses. Zero doesn't wait.
+var AddressWaitTimeout time.Duration
+
+// WaitForAddress polls the interface in the namespace until the address of the
+// CIDR is present and no longer tentative.
+func WaitForAddress(nsname string, ifname string, cidr string, timeout time.Duration) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Errorf(ErrInvalidCIDR, "failed to parse CIDR %s: %s", cidr, err)
+	}
+
+	type addrInfo struct {
+		Local     string `json:"local"`
+		Tentative bool   `json:"tentative"`
+	}
+	var raw []struct {
+		AddrInfo []addrInfo `json:"addr_info"`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		err := outputJSONInNamespace(ctx, nsname, &raw, "addr", "show", "dev", ifname)
+		if err == nil {
+			for _, r := range raw {
+				for _, a := range r.AddrInfo {
+					if ip.Equal(net.ParseIP(a.Local)) && !a.Tentative {
+						return nil
+					}
+				}
+			}
+			err = fmt.Errorf("address is absent or tentative")
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("address %s of %s in ns %s isn't usable within %s: %w", cidr, ifname, nsname, timeout, err)
+		case <-time.After(interfaceWaitInterval):
+		}
+	}
+}
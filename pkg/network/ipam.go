@@ -0,0 +1,170 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// AddressPool allocates host addresses of a link sequentially. Allocated
+// addresses keep the prefix length of the pool so that the devices on the same
+// link can reach each other.
+type AddressPool struct {
+	network *net.IPNet
+	next    net.IP
+	used    map[string]bool
+}
+
+func NewAddressPool(cidr string) (*AddressPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pool %s: %w", cidr, err)
+	}
+
+	return &AddressPool{
+		network: ipnet,
+		// The network address is never allocated.
+		next: nextIP(ipnet.IP),
+		used: make(map[string]bool),
+	}, nil
+}
+
+// Reserve marks the address as used so that it is never allocated.
+func (p *AddressPool) Reserve(ip net.IP) {
+	p.used[ip.String()] = true
+}
+
+func (p *AddressPool) Allocate() (string, error) {
+	for ip := p.next; p.network.Contains(ip); ip = nextIP(ip) {
+		if p.used[ip.String()] || p.isBroadcast(ip) {
+			continue
+		}
+
+		p.used[ip.String()] = true
+		p.next = nextIP(ip)
+
+		ones, _ := p.network.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip, ones), nil
+	}
+
+	return "", fmt.Errorf("pool %s is exhausted", p.network)
+}
+
+func (p *AddressPool) isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+
+	mask := p.network.Mask[len(p.network.Mask)-net.IPv4len:]
+	for i := range ip4 {
+		if ip4[i]|mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// AssignAddresses replaces the auto CIDRs of the devices with the addresses
+// allocated from the pools of the links. The namespaces are processed in the
+// given order, so the allocation is deterministic for the same config. The
+// addresses explicitly configured in the pools are never allocated.
+func AssignAddresses(namespaces []*Namespace, links []*config.LinkConfig) error {
+	pools := make(map[string]*AddressPool)
+	for _, link := range links {
+		if link.Pool == "" {
+			continue
+		}
+
+		pool, err := NewAddressPool(link.Pool)
+		if err != nil {
+			return err
+		}
+		pools[link.Name] = pool
+	}
+
+	for _, ns := range namespaces {
+		for _, dev := range ns.RegisteredDeviceConfig {
+			pool, ok := pools[dev.LinkName()]
+			if !ok || dev.Cidr == config.CidrAuto {
+				continue
+			}
+
+			if ip, _, err := net.ParseCIDR(dev.Cidr); err == nil {
+				pool.Reserve(ip)
+			}
+		}
+	}
+
+	for _, ns := range namespaces {
+		for i := range ns.RegisteredDeviceConfig {
+			dev := &ns.RegisteredDeviceConfig[i]
+			if dev.Cidr != config.CidrAuto {
+				continue
+			}
+
+			pool, ok := pools[dev.LinkName()]
+			if !ok {
+				return Errorf(ErrNotFound, "no pool for device %s in ns %s", dev.Name, ns.Name)
+			}
+
+			cidr, err := pool.Allocate()
+			if err != nil {
+				return fmt.Errorf("failed to allocate address to device %s in ns %s: %w", dev.Name, ns.Name, err)
+			}
+
+			log.Infof("allocated %s to device %s in ns %s", cidr, dev.Name, ns.Name)
+			dev.Cidr = cidr
+		}
+	}
+
+	return nil
+}
+
+// EUI64Addr returns the address in the /64 prefix whose host portion is the
+// modified EUI-64 of the MAC, with the prefix length.
+func EUI64Addr(prefix string, mac string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", Errorf(ErrInvalidCIDR, "failed to parse prefix %s: %s", prefix, err)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid EUI-48 MAC %s", mac)
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipnet.IP.To16())
+	// The universal/local bit is inverted, and ff:fe is inserted in the middle.
+	copy(ip[8:], []byte{hw[0] ^ 0x02, hw[1], hw[2], 0xff, 0xfe, hw[3], hw[4], hw[5]})
+
+	return fmt.Sprintf("%s/64", ip), nil
+}
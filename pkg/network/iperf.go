@@ -0,0 +1,141 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IperfServerTimeout is the maximum duration to wait for the iperf3 server to
+// listen, and for it to exit after the measurement.
+var IperfServerTimeout = 5 * time.Second
+
+// Throughput is the result of the iperf3 TCP measurement from the client.
+type Throughput struct {
+	SentBitsPerSecond     float64 `json:"sent_bits_per_second"`
+	ReceivedBitsPerSecond float64 `json:"received_bits_per_second"`
+	Retransmits           int     `json:"retransmits"`
+}
+
+// iperfResult is the part of the JSON output of iperf3 -c -J.
+type iperfResult struct {
+	End struct {
+		SumSent struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+			Retransmits   int     `json:"retransmits"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// MeasureThroughput runs the iperf3 server in the server namespace and the
+// client connecting to addr in the client namespace for the duration. The
+// server serves only this client on a random dynamic port and has exited when
+// it returns. The duration must be shorter than CommandTimeout.
+func MeasureThroughput(ctx context.Context, serverNs string, clientNs string, addr string, duration time.Duration) (*Throughput, error) {
+	if _, err := exec.LookPath("iperf3"); err != nil {
+		return nil, fmt.Errorf("iperf3 is not found in PATH %s: install iperf3 to measure throughput", os.Getenv("PATH"))
+	}
+
+	port := fmt.Sprint(49152 + rand.New(rand.NewSource(time.Now().UnixNano())).Intn(65535-49152))
+
+	server := exec.CommandContext(ctx, ipBin(), "netns", "exec", serverNs, "iperf3", "-s", "-1", "-p", port)
+	log.Infoln("execute ", server.String())
+
+	stdout, err := server.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start iperf3 server in ns %s: %w", serverNs, err)
+	}
+
+	exited := make(chan error, 1)
+	listening := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		notified := false
+		for scanner.Scan() {
+			if !notified && strings.Contains(scanner.Text(), "Server listening") {
+				close(listening)
+				notified = true
+			}
+		}
+		exited <- server.Wait()
+	}()
+
+	// stop kills the server unless it has exited by itself after the client.
+	stop := func() {
+		select {
+		case <-exited:
+		case <-time.After(IperfServerTimeout):
+			server.Process.Kill()
+			<-exited
+		}
+	}
+
+	select {
+	case <-listening:
+	case err := <-exited:
+		return nil, fmt.Errorf("iperf3 server in ns %s exited: %v", serverNs, err)
+	case <-time.After(IperfServerTimeout):
+		server.Process.Kill()
+		<-exited
+		return nil, fmt.Errorf("iperf3 server in ns %s didn't listen in %s", serverNs, IperfServerTimeout)
+	}
+
+	secs := int(duration.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	client := exec.CommandContext(ctx, ipBin(), "netns", "exec", clientNs, "iperf3", "-c", addr, "-p", port, "-t", fmt.Sprint(secs), "-J")
+	log.Infoln("execute ", client.String())
+
+	out, err := queryCommand(client)
+	defer stop()
+
+	var result iperfResult
+	if jerr := json.Unmarshal(out, &result); jerr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("iperf3 client in ns %s failed: %w", clientNs, err)
+		}
+		return nil, fmt.Errorf("failed to parse the output of iperf3: %w", jerr)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("iperf3 client in ns %s failed: %s", clientNs, result.Error)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("iperf3 client in ns %s failed: %w", clientNs, err)
+	}
+
+	return &Throughput{
+		SentBitsPerSecond:     result.End.SumSent.BitsPerSecond,
+		ReceivedBitsPerSecond: result.End.SumReceived.BitsPerSecond,
+		Retransmits:           result.End.SumSent.Retransmits,
+	}, nil
+}
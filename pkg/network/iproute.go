@@ -16,111 +16,741 @@ package network
 
 import (
 	"fmt"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Shikugawa/ayame/pkg/config"
 	log "github.com/sirupsen/logrus"
 )
 
+// MaxIfnameLen is the maximum length of interface names, i.e. IFNAMSIZ without
+// the trailing NUL. The kernel rejects longer names.
+const MaxIfnameLen = 15
+
+// checkIfname returns an error if the kernel would reject the name. It is
+// checked before the dry-run returns, so that a dry run catches it.
+func checkIfname(names ...string) error {
+	for _, name := range names {
+		if len(name) > MaxIfnameLen {
+			return fmt.Errorf("interface name %s exceeds %d characters", name, MaxIfnameLen)
+		}
+	}
+	return nil
+}
+
 func RunIpLinkCreate(left string, right string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "add", "name", left, "type", "veth", "peer", right)
+	if err := checkIfname(left, right); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(ipBin(), "link", "add", "name", left, "type", "veth", "peer", right)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create veth name %s@%s: %w", left, right, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkCreateInNamespaces(left string, leftNs string, right string, rightNs string, dryrun bool) error {
+	if err := checkIfname(left, right); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(ipBin(), "link", "add", left, "netns", leftNs, "type", "veth", "peer", "name", right, "netns", rightNs)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create veth name %s@%s in ns %s@%s: %w", left, right, leftNs, rightNs, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetTxQueueLen sets txqueuelen of the device. The device is on the
+// host if nsname is empty.
+func RunIpLinkSetTxQueueLen(ifname string, nsname string, qlen uint, dryrun bool) error {
+	args := []string{"link", "set", ifname, "txqueuelen", fmt.Sprint(qlen)}
+	if nsname != "" {
+		args = append([]string{"netns", "exec", nsname, ipBin()}, args...)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set txqueuelen of %s to %d: %w", ifname, qlen, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetMtu sets the MTU of the device. The device is on the host if
+// nsname is empty.
+func RunIpLinkSetMtu(ifname string, nsname string, mtu uint, dryrun bool) error {
+	args := []string{"link", "set", ifname, "mtu", fmt.Sprint(mtu)}
+	if nsname != "" {
+		args = append([]string{"netns", "exec", nsname, ipBin()}, args...)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set mtu of %s to %d: %w", ifname, mtu, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetAlias sets the alias of the device, which is shown by
+// `ip -d link show`. The device is on the host if nsname is empty.
+func RunIpLinkSetAlias(ifname string, nsname string, alias string, dryrun bool) error {
+	args := []string{"link", "set", ifname, "alias", alias}
+	if nsname != "" {
+		args = append([]string{"netns", "exec", nsname, ipBin()}, args...)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set alias of %s: %w", ifname, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetPromisc sets promiscuous mode of the device in the namespace.
+func RunIpLinkSetPromisc(ifname string, nsname string, on bool, dryrun bool) error {
+	state := "off"
+	if on {
+		state = "on"
+	}
+
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "set", ifname, "promisc", state)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set promisc of %s in ns %s %s: %w", ifname, nsname, state, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetAddress sets the MAC address of the device in the namespace.
+func RunIpLinkSetAddress(ifname string, nsname string, mac string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "set", ifname, "address", mac)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set MAC %s of %s in ns %s: %w", mac, ifname, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetState sets the device in the namespace administratively up or
+// down.
+func RunIpLinkSetState(ifname string, nsname string, up bool, dryrun bool) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "set", ifname, state)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set %s in ns %s %s: %w", ifname, nsname, state, err)
+	}
+
+	return nil
+}
+
+// RunIpLinkSetHostState sets the device on the host administratively up or
+// down.
+func RunIpLinkSetHostState(ifname string, up bool, dryrun bool) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+
+	cmd := exec.Command(ipBin(), "link", "set", ifname, state)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set %s on host %s: %w", ifname, state, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkDeleteInNamespace(name string, nsname string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "delete", name)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete device %s in ns %s: %w", name, nsname, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkCreateTunnel(name string, tunnel *config.TunnelConfig, dryrun bool) error {
+	if err := checkIfname(name); err != nil {
+		return err
+	}
+
+	args := []string{"link", "add", name, "type", tunnel.Type}
+	switch tunnel.Type {
+	case config.TunnelTypeVxlan:
+		port := tunnel.Port
+		if port == 0 {
+			port = config.DefaultVxlanPort
+		}
+		args = append(args, "id", fmt.Sprint(tunnel.VNI), "remote", tunnel.Remote, "dstport", fmt.Sprint(port))
+	case config.TunnelTypeGretap:
+		args = append(args, "remote", tunnel.Remote)
+		if tunnel.VNI != 0 {
+			args = append(args, "key", fmt.Sprint(tunnel.VNI))
+		}
+	}
+	if tunnel.Local != "" {
+		args = append(args, "local", tunnel.Local)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create %s tunnel %s: %w", tunnel.Type, name, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkAddMacvlan(name string, parent string, mode string, dryrun bool) error {
+	if err := checkIfname(name); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(ipBin(), "link", "add", name, "link", parent, "type", "macvlan", "mode", mode)
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create veth name %s@%s: %s", left, right, err)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create macvlan %s on %s: %w", name, parent, err)
 	}
 
 	return nil
 }
 
 func RunIpLinkDelete(name string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "delete", name)
+	cmd := exec.Command(ipBin(), "link", "delete", name)
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete device %s: %s", name, err)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete device %s: %w", name, err)
 	}
 
 	return nil
 }
 
 func RunIpLinkSetNamespaces(ifname string, nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "link", "set", ifname, "netns", nsname)
+	cmd := exec.Command(ipBin(), "link", "set", ifname, "netns", nsname)
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to attach device %s to ns %s", ifname, nsname)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to attach device %s to ns %s: %w", ifname, nsname, err)
 	}
 
 	return nil
 }
 
-func RunAssignCidrToNamespaces(ifname string, nsname string, cidr string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "exec", nsname, "ip", "addr", "add", cidr, "dev", ifname)
+func RunIpLinkSetHostNamespace(ifname string, nsname string, dryrun bool) error {
+	return RunIpLinkMoveNamespace(ifname, nsname, "1", dryrun)
+}
+
+// RunIpLinkMoveNamespace moves the device in nsname to the target namespace
+// directly. The target is the name of the namespace or the pid, e.g. 1 for the
+// host.
+func RunIpLinkMoveNamespace(ifname string, nsname string, target string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "set", ifname, "netns", target)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to move device %s from ns %s to %s: %w", ifname, nsname, target, err)
+	}
+
+	return nil
+}
+
+// InterfaceWaitTimeout is how long waitForInterface polls until the device
+// moved into a namespace becomes visible.
+var InterfaceWaitTimeout = 2 * time.Second
+
+const interfaceWaitInterval = 50 * time.Millisecond
+
+func waitForInterface(nsname string, ifname string, timeout time.Duration, dryrun bool) error {
+	args := []string{"netns", "exec", nsname, ipBin(), "link", "show", ifname}
+	log.Infoln("execute ", exec.Command(ipBin(), args...).String())
+
+	if dryrun {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := queryCommand(exec.Command(ipBin(), args...))
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %s didn't appear in ns %s within %s: %w", ifname, nsname, timeout, err)
+		}
+
+		time.Sleep(interfaceWaitInterval)
+	}
+}
+
+// RunAssignCidrToNamespaces assigns the CIDR to the interface in the namespace.
+// The address is labeled as <ifname>:<label> unless label is empty. broadcast
+// and scope are passed to ip as is unless empty; "auto" is the alias of "+".
+// If peer isn't empty, the address of the CIDR is the local address of the
+// point-to-point link and the prefix of the CIDR applies to the peer.
+func RunAssignCidrToNamespaces(ifname string, nsname string, cidr string, peer string, label string, broadcast string, scope string, dryrun bool) error {
+	args := []string{"netns", "exec", nsname, ipBin(), "addr", "add", cidr}
+	if peer != "" {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return Errorf(ErrInvalidCIDR, "failed to parse CIDR %s: %s", cidr, err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		args = append(args[:len(args)-1], ip.String(), "peer", fmt.Sprintf("%s/%d", peer, ones))
+	}
+	if broadcast == config.BroadcastAuto {
+		broadcast = "+"
+	}
+	if broadcast != "" {
+		args = append(args, "broadcast", broadcast)
+	}
+	if scope != "" {
+		args = append(args, "scope", scope)
+	}
+	args = append(args, "dev", ifname)
+	if label != "" {
+		full := ifname + ":" + label
+		if len(full) > config.MaxAddrLabelLen {
+			return fmt.Errorf("label %s exceeds %d characters", full, config.MaxAddrLabelLen)
+		}
+		args = append(args, "label", full)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s", cidr, nsname, ifname)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s: %w", cidr, nsname, ifname, err)
+	}
+
+	return nil
+}
+
+// RunIpRouteAdd adds the route to the routing table in the namespace. The main
+// table is used if table is zero.
+func RunIpRouteAdd(nsname string, dst string, via string, dev string, table uint32, dryrun bool) error {
+	args := []string{"netns", "exec", nsname, ipBin(), "route", "add", dst}
+	if via != "" {
+		args = append(args, "via", via)
+	}
+	if dev != "" {
+		args = append(args, "dev", dev)
+	}
+	if table != 0 {
+		args = append(args, "table", fmt.Sprint(table))
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to add route %s to ns %s: %w", dst, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIpRouteAddMultipath adds the route with the weighted nexthops to the
+// routing table in the namespace. The main table is used if table is zero.
+func RunIpRouteAddMultipath(nsname string, dst string, nexthops []config.NexthopConfig, table uint32, dryrun bool) error {
+	args := []string{"netns", "exec", nsname, ipBin(), "route", "add", dst}
+	if table != 0 {
+		args = append(args, "table", fmt.Sprint(table))
+	}
+	for _, nh := range nexthops {
+		args = append(args, "nexthop")
+		if nh.Via != "" {
+			args = append(args, "via", nh.Via)
+		}
+		if nh.Dev != "" {
+			args = append(args, "dev", nh.Dev)
+		}
+		args = append(args, "weight", fmt.Sprint(nh.Weight))
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to add multipath route %s to ns %s: %w", dst, nsname, err)
+	}
+
+	return nil
+}
+
+func RunIpRouteDel(nsname string, dst string, table uint32, dryrun bool) error {
+	args := []string{"netns", "exec", nsname, ipBin(), "route", "del", dst}
+	if table != 0 {
+		args = append(args, "table", fmt.Sprint(table))
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete route %s from ns %s: %w", dst, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIpRuleAdd adds the policy routing rule in the namespace.
+func RunIpRuleAdd(nsname string, from string, to string, fwmark string, table uint32, priority uint32, dryrun bool) error {
+	cmd := exec.Command(ipBin(), ipRuleArgs("add", nsname, from, to, fwmark, table, priority)...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to add rule to table %d in ns %s: %w", table, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIpRuleDel deletes the policy routing rule added by RunIpRuleAdd.
+func RunIpRuleDel(nsname string, from string, to string, fwmark string, table uint32, priority uint32, dryrun bool) error {
+	cmd := exec.Command(ipBin(), ipRuleArgs("del", nsname, from, to, fwmark, table, priority)...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete rule to table %d in ns %s: %w", table, nsname, err)
+	}
+
+	return nil
+}
+
+func ipRuleArgs(action string, nsname string, from string, to string, fwmark string, table uint32, priority uint32) []string {
+	args := []string{"netns", "exec", nsname, ipBin(), "rule", action}
+	if priority != 0 {
+		args = append(args, "priority", fmt.Sprint(priority))
+	}
+	if from != "" {
+		args = append(args, "from", from)
+	}
+	if to != "" {
+		args = append(args, "to", to)
+	}
+	if fwmark != "" {
+		args = append(args, "fwmark", fwmark)
+	}
+	return append(args, "table", fmt.Sprint(table))
+}
+
+func RunSysctlInNamespace(nsname string, key string, value string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, "sysctl", "-w", key+"="+value)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set %s=%s in ns %s: %w", key, value, nsname, err)
+	}
+
+	return nil
+}
+
+func RunAssignCidrToHost(ifname string, cidr string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "addr", "add", cidr, "dev", ifname)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to assign CIDR %s to host on %s: %w", cidr, ifname, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkAddBond(nsname string, bond string, mode string, dryrun bool) error {
+	if err := checkIfname(bond); err != nil {
+		return err
+	}
+
+	args := []string{"netns", "exec", nsname, ipBin(), "link", "add", bond, "type", "bond"}
+	if mode != "" {
+		args = append(args, "mode", mode)
+	}
+
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create bond %s in ns %s: %w", bond, nsname, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkAddDummy(nsname string, name string, dryrun bool) error {
+	if err := checkIfname(name); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "add", name, "type", "dummy")
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create dummy %s in ns %s: %w", name, nsname, err)
+	}
+
+	return nil
+}
+
+func RunIpLinkSetMaster(nsname string, ifname string, master string, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "link", "set", ifname, "master", master)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set master of %s to %s in ns %s: %w", ifname, master, nsname, err)
 	}
 
 	return nil
 }
 
 func RunIpNetnsAdd(nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "add", nsname)
+	cmd := exec.Command(ipBin(), "netns", "add", nsname)
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create ns %s", nsname)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create ns %s: %w", nsname, err)
 	}
 
 	return nil
 }
 
 func RunIpNetnsDelete(nsname string, dryrun bool) error {
-	cmd := exec.Command("ip", "netns", "delete", nsname)
+	cmd := exec.Command(ipBin(), "netns", "delete", nsname)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete ns %s: %w", nsname, err)
+	}
+
+	return nil
+}
+
+// ListIpNetnsPids returns the processes running in the namespace.
+func ListIpNetnsPids(nsname string) ([]int, error) {
+	cmd := exec.Command(ipBin(), "netns", "pids", nsname)
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes in ns %s: %w", nsname, err)
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(output)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
+}
+
+// RunIpNetnsAttach names the network namespace of the process, e.g. a running
+// container, so that it can be used as a named namespace.
+func RunIpNetnsAttach(nsname string, pid int, dryrun bool) error {
+	cmd := exec.Command(ipBin(), "netns", "attach", nsname, fmt.Sprint(pid))
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete ns %s", nsname)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to attach ns %s to pid %d: %w", nsname, pid, err)
 	}
 
 	return nil
 }
 
+// CheckIpNetnsExists returns whether the namespace exists. On dry-run it
+// assumes that the namespace exists so that the commands to delete it are shown.
 func CheckIpNetnsExists(nsname string, dryrun bool) bool {
-	cmd := exec.Command("ip", "netns", "list")
+	cmd := exec.Command(ipBin(), "netns", "list")
 	log.Infoln("execute ", cmd.String())
 
 	if dryrun {
-		return false
+		return true
 	}
 
-	output, err := cmd.Output()
+	output, err := queryCommand(cmd)
 	if err != nil {
 		return false
 	}
@@ -136,3 +766,126 @@ func CheckIpNetnsExists(nsname string, dryrun bool) bool {
 
 	return false
 }
+
+// CheckIpLinkExists returns whether the device exists on the host. On dry-run it
+// assumes that the device exists so that the commands to delete it are shown.
+func CheckIpLinkExists(name string, dryrun bool) bool {
+	cmd := exec.Command(ipBin(), "link", "show", name)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		return true
+	}
+
+	_, err := queryCommand(cmd)
+	return err == nil
+}
+
+// ListDefaultRouteDevices returns the devices of the default routes on the host.
+func ListDefaultRouteDevices() ([]string, error) {
+	cmd := exec.Command(ipBin(), "route", "show", "default")
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list default routes: %w", err)
+	}
+
+	var devs []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "dev" {
+				devs = append(devs, fields[i+1])
+			}
+		}
+	}
+
+	return devs, nil
+}
+
+func ListIpNetns() ([]string, error) {
+	cmd := exec.Command(ipBin(), "netns", "list")
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ns: %w", err)
+	}
+
+	var nsnames []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		nsnames = append(nsnames, fields[0])
+	}
+
+	return nsnames, nil
+}
+
+func ListIpLinks() ([]string, error) {
+	cmd := exec.Command(ipBin(), "-o", "link", "show")
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	return parseIpLinkOutput(string(output)), nil
+}
+
+func ListIpLinksInNamespace(nsname string) ([]string, error) {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "-o", "link", "show")
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices in ns %s: %w", nsname, err)
+	}
+
+	return parseIpLinkOutput(string(output)), nil
+}
+
+func parseIpLinkOutput(output string) []string {
+	var ifnames []string
+	for _, line := range strings.Split(output, "\n") {
+		// e.g. "2: veth1-left@if3: <BROADCAST,MULTICAST> mtu 1500 ..."
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ifname := strings.TrimSuffix(fields[1], ":")
+		ifname = strings.SplitN(ifname, "@", 2)[0]
+		ifnames = append(ifnames, ifname)
+	}
+
+	return ifnames
+}
+
+func ListIpAddrsInNamespace(nsname string) (map[string][]string, error) {
+	cmd := exec.Command(ipBin(), "netns", "exec", nsname, ipBin(), "-o", "addr", "show")
+	log.Infoln("execute ", cmd.String())
+
+	output, err := queryCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses in ns %s: %w", nsname, err)
+	}
+
+	addrs := make(map[string][]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		// e.g. "2: veth1-left    inet 192.168.100.10/24 scope global veth1-left ..."
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[2] != "inet" && fields[2] != "inet6" {
+			continue
+		}
+		addrs[fields[1]] = append(addrs[fields[1]], fields[3])
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dscpRuleArgs returns the mangle rule marking the packets sent from the
+// interface. op is -A to append or -D to delete.
+func dscpRuleArgs(nsname string, ifname string, dscp uint8, op string) []string {
+	return []string{"netns", "exec", nsname, "iptables", "-t", "mangle", op, "POSTROUTING",
+		"-o", ifname, "-j", "DSCP", "--set-dscp", fmt.Sprint(dscp)}
+}
+
+// RunIptablesSetDscp marks the packets sent from the interface in the namespace
+// with the DSCP value.
+func RunIptablesSetDscp(nsname string, ifname string, dscp uint8, dryrun bool) error {
+	cmd := exec.Command(ipBin(), dscpRuleArgs(nsname, ifname, dscp, "-A")...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set dscp %d on %s in ns %s: %w", dscp, ifname, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIptablesUnsetDscp deletes the rule added by RunIptablesSetDscp.
+func RunIptablesUnsetDscp(nsname string, ifname string, dscp uint8, dryrun bool) error {
+	cmd := exec.Command(ipBin(), dscpRuleArgs(nsname, ifname, dscp, "-D")...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to unset dscp %d on %s in ns %s: %w", dscp, ifname, nsname, err)
+	}
+
+	return nil
+}
+
+// RunIptablesRule adds the rule, which is the arguments of iptables, in the
+// namespace.
+func RunIptablesRule(nsname string, rule string, dryrun bool) error {
+	args := append([]string{"netns", "exec", nsname, "iptables"}, strings.Fields(rule)...)
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if out, err := outputCommand(cmd); err != nil {
+		return fmt.Errorf("failed to add rule %q in ns %s: %w\n%s", rule, nsname, err, string(out))
+	}
+
+	return nil
+}
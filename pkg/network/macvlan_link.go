@@ -0,0 +1,129 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"go.uber.org/multierr"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MacvlanLink connects the namespaces to the L2 of the parent device on the
+// host. Every namespace has its own macvlan device named <link>-<N>.
+type MacvlanLink struct {
+	Name    string  `json:"name"`
+	Parent  string  `json:"parent"`
+	Mode    string  `json:"macvlan_mode"`
+	Devices []*Veth `json:"devices"`
+}
+
+func InitMacvlanLink(cfg *config.LinkConfig, dryrun bool) (*MacvlanLink, error) {
+	if cfg.LinkMode != config.ModeMacvlan {
+		return nil, fmt.Errorf("invalid mode")
+	}
+	defer recordTiming(string(config.ModeMacvlan), cfg.Name, time.Now(), dryrun)
+	ScriptComment("macvlan link %s", cfg.Name)
+
+	if !CheckIpLinkExists(cfg.Parent, dryrun) {
+		return nil, Errorf(ErrNotFound, "parent device %s doesn't exist on host", cfg.Parent)
+	}
+
+	mode := cfg.MacvlanMode
+	if mode == "" {
+		mode = config.MacvlanModeBridge
+	}
+
+	return &MacvlanLink{
+		Name:   cfg.Name,
+		Parent: cfg.Parent,
+		Mode:   mode,
+	}, nil
+}
+
+// Destroy deletes the devices left on the host. The attached ones are deleted
+// with the namespaces.
+func (m *MacvlanLink) Destroy(dryrun bool) error {
+	var allerr error
+	for _, dev := range m.Devices {
+		if dev.Attached {
+			continue
+		}
+		if err := RunIpLinkDelete(dev.Name, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	return allerr
+}
+
+func (m *MacvlanLink) CreateLink(target *Namespace, dryrun bool) error {
+	defer observeDuration("create_macvlan_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeMacvlan), m.Name, time.Now(), dryrun)
+
+	// Check before creating the device not to leave it on failure.
+	if _, err := target.findDeviceConfigByLink(m.Name); err != nil {
+		return err
+	}
+
+	dev := &Veth{Name: m.Name + "-" + fmt.Sprint(len(m.Devices)+1)}
+	if err := RunIpLinkAddMacvlan(dev.Name, m.Parent, m.Mode, dryrun); err != nil {
+		return err
+	}
+
+	if err := target.AttachToDevice(m.Name, dev, dryrun); err != nil {
+		if derr := RunIpLinkDelete(dev.Name, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		return err
+	}
+
+	log.Infof("succeeded to create macvlan %s on %s", dev.Name, m.Parent)
+
+	m.Devices = append(m.Devices, dev)
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeMacvlan)})
+	return nil
+}
+
+func InitMacvlanLinks(links []*config.LinkConfig, dryrun bool) (map[string]*MacvlanLink, error) {
+	macvlans := make(map[string]*MacvlanLink)
+	for _, link := range links {
+		if link.LinkMode != config.ModeMacvlan {
+			continue
+		}
+
+		macvlan, err := InitMacvlanLink(link, dryrun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init macvlan link: %s: %w", link.Name, err)
+		}
+
+		macvlans[macvlan.Name] = macvlan
+	}
+
+	return macvlans, nil
+}
+
+func CleanupMacvlanLinks(links map[string]*MacvlanLink, dryrun bool) error {
+	var allerr error
+	for _, link := range links {
+		if err := link.Destroy(dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	MetricNamespacesCreated   = "namespaces_created_total"
+	MetricNamespacesDestroyed = "namespaces_destroyed_total"
+	MetricLinksCreated        = "links_created_total"
+	MetricOperationDuration   = "operation_duration_seconds"
+)
+
+// Metrics receives the metrics of the operations. Every call has the "dryrun"
+// label so that the dry-run operations can be distinguished.
+type Metrics interface {
+	Inc(name string, labels map[string]string)
+	Observe(name string, value float64, labels map[string]string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Inc(name string, labels map[string]string) {}
+
+func (noopMetrics) Observe(name string, value float64, labels map[string]string) {}
+
+var metrics Metrics = noopMetrics{}
+
+// SetMetrics replaces the metrics sink. Passing nil restores the no-op one.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	metrics = m
+}
+
+func incMetric(name string, dryrun bool, labels map[string]string) {
+	metrics.Inc(name, withDryrunLabel(labels, dryrun))
+}
+
+func observeDuration(operation string, start time.Time, dryrun bool) {
+	metrics.Observe(MetricOperationDuration, time.Since(start).Seconds(),
+		withDryrunLabel(map[string]string{"operation": operation}, dryrun))
+}
+
+func withDryrunLabel(labels map[string]string, dryrun bool) map[string]string {
+	res := map[string]string{"dryrun": strconv.FormatBool(dryrun)}
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
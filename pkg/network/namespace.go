@@ -15,11 +15,17 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	log "github.com/sirupsen/logrus"
@@ -29,94 +35,937 @@ import (
 type RegisteredDeviceConfig struct {
 	config.NamespaceDeviceConfig `json:"device_config"`
 	AttachedVeth                 string `json:"attached_veth"`
+	// CarrierOff is true while the attached interface has no carrier because
+	// its peer is set down by State.SetCarrier. The interface itself stays up.
+	CarrierOff bool `json:"carrier_off,omitempty"`
+	// Down is true while the attached interface is left down by LeaveDown.
+	Down bool `json:"down,omitempty"`
+	// Paused is true while the attached interface is set down by PauseLinks.
+	Paused bool `json:"paused,omitempty"`
+	// Dscp is the DSCP value marked by MarkDscp on the packets sent from the
+	// attached interface.
+	Dscp *uint8 `json:"dscp,omitempty"`
+	// Ipv6Addr is the address derived from Ipv6Prefix and the MAC on attach.
+	Ipv6Addr string `json:"ipv6_addr,omitempty"`
+}
+
+type Route struct {
+	Dst string `json:"dst"`
+	Via string `json:"via,omitempty"`
+	Dev string `json:"dev,omitempty"`
+	// Table is the routing table. Zero is the main table.
+	Table uint32 `json:"table,omitempty"`
+	// Nexthops are the nexthops of the multipath route instead of Via and Dev.
+	Nexthops []config.NexthopConfig `json:"nexthops,omitempty"`
 }
 
 type Namespace struct {
 	Name                   string                   `json:"name"`
 	RegisteredDeviceConfig []RegisteredDeviceConfig `json:"registered_device_config"`
+	// Routes are the routes added at runtime with AddRoute.
+	Routes []Route `json:"routes,omitempty"`
+	// Bonds are created by CreateBonds after all the devices are attached.
+	Bonds []config.BondConfig `json:"bonds,omitempty"`
+	// Dummies are created by CreateDummies after the bonds.
+	Dummies []config.DummyConfig `json:"dummies,omitempty"`
+	// Hostname is set in the UTS namespace in which commands are executed.
+	Hostname string `json:"hostname,omitempty"`
+	// HostInterfaces are moved back to the host on Destroy.
+	HostInterfaces []HostInterface `json:"host_interfaces,omitempty"`
+	// Rules are the policy routing rules added with AddRule.
+	Rules []config.RuleConfig `json:"rules,omitempty"`
+	// Pid is the process whose network namespace is attached as this namespace.
+	// Destroy removes only the name, and the namespace lives with the process.
+	Pid int `json:"pid,omitempty"`
+	// Labels are the key/value pairs of the config to find the namespace.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
-func InitNamespace(config *config.NamespaceConfig, dryrun bool) (*Namespace, error) {
+// InitNamespace creates the namespace. Once the netns has been created, the
+// returned namespace is non-nil even with an error, so that the caller can
+// Destroy it. Both are nil only if the netns hasn't been created.
+func InitNamespace(cfg *config.NamespaceConfig, dryrun bool) (*Namespace, error) {
+	defer observeDuration("create_namespace", time.Now(), dryrun)
+	defer recordTiming("namespace", cfg.Name, time.Now(), dryrun)
+
+	if err := config.ValidateNamespaceName(cfg.Name); err != nil {
+		return nil, err
+	}
+	ScriptComment("namespace %s", cfg.Name)
+
 	var configs []RegisteredDeviceConfig
-	for _, c := range config.Devices {
+	for _, c := range cfg.Devices {
 		tmp := RegisteredDeviceConfig{
 			AttachedVeth: "",
 		}
 		tmp.NamespaceDeviceConfig = c
+		if cfg.DisableIPv6 {
+			tmp.DisableIPv6 = true
+		}
 		configs = append(configs, tmp)
 	}
 
 	ns := &Namespace{
-		Name:                   config.Name,
+		Name:                   cfg.Name,
 		RegisteredDeviceConfig: configs,
+		Bonds:                  cfg.Bonds,
+		Dummies:                cfg.Dummies,
+		Hostname:               cfg.Hostname,
+		Labels:                 cfg.Labels,
 	}
 
-	if err := RunIpNetnsAdd(config.Name, dryrun); err != nil {
+	for _, hif := range cfg.HostInterfaces {
+		ns.HostInterfaces = append(ns.HostInterfaces, HostInterface{HostInterfaceConfig: hif})
+	}
+
+	if cfg.Pid != 0 {
+		ns.Pid = cfg.Pid
+		if err := RunIpNetnsAttach(cfg.Name, cfg.Pid, dryrun); err != nil {
+			return nil, err
+		}
+	} else if err := RunIpNetnsAdd(cfg.Name, dryrun); err != nil {
 		return nil, err
 	}
 
-	log.Infof("succeeded to create ns %s\n", config.Name)
+	if ns.Hostname != "" {
+		if err := CreateUtsNamespace(ns.Name, ns.Hostname, dryrun); err != nil {
+			return ns, err
+		}
+	}
+
+	log.Infof("succeeded to create ns %s\n", cfg.Name)
+	incMetric(MetricNamespacesCreated, dryrun, nil)
 	return ns, nil
 }
 
 func (n *Namespace) Destroy(dryrun bool) error {
+	defer observeDuration("destroy_namespace", time.Now(), dryrun)
+
 	// namespaces don't exist anymore after host shutted down. Here ignores the closed netns.
+	// /etc/netns is on disk though, so it is removed anyway.
 	if !CheckIpNetnsExists(n.Name, dryrun) {
 		log.Infof("%s doesn't exist\n", n.Name)
+		if err := removeNetnsEtc(n.Name, dryrun); err != nil {
+			log.Warnf(err.Error())
+		}
 		return nil
 	}
 
-	if err := RunIpNetnsDelete(n.Name, dryrun); err != nil {
+	// Deleting the namespace would delete virtual interfaces, e.g. dummy.
+	if err := n.ReleaseInterfaces(dryrun); err != nil {
+		log.Warnf(err.Error())
+	}
+
+	if n.Hostname != "" {
+		if err := DeleteUtsNamespace(n.Name, dryrun); err != nil {
+			log.Warnf(err.Error())
+		}
+	}
+
+	// The namespace of the process outlives the name, so the rules and the
+	// devices attached by ayame are deleted explicitly.
+	if n.Pid != 0 {
+		if err := n.DelRules(dryrun); err != nil {
+			log.Warnf(err.Error())
+		}
+		for _, dev := range n.RegisteredDeviceConfig {
+			if len(dev.AttachedVeth) == 0 {
+				continue
+			}
+			if dev.Dscp != nil {
+				if err := RunIptablesUnsetDscp(n.Name, dev.AttachedVeth, *dev.Dscp, dryrun); err != nil {
+					log.Warnf(err.Error())
+				}
+			}
+			if err := RunIpLinkDeleteInNamespace(dev.AttachedVeth, n.Name, dryrun); err != nil {
+				log.Warnf(err.Error())
+			}
+		}
+	}
+
+	// The processes of the namespace not owned by ayame are never signaled.
+	if DrainNamespaces && n.Pid == 0 {
+		drainNetns(n.Name, dryrun)
+	}
+
+	if err := deleteNetns(n.Name, n.Pid == 0, dryrun); err != nil {
 		return err
 	}
 
+	if err := removeNetnsEtc(n.Name, dryrun); err != nil {
+		log.Warnf(err.Error())
+	}
+
 	log.Infof("succeeded to delete ns %s\n", n.Name)
+	incMetric(MetricNamespacesDestroyed, dryrun, nil)
 	return nil
 }
 
+// netnsEtcDir is where `ip netns exec` finds the per namespace files bind
+// mounted over /etc, e.g. resolv.conf.
+var netnsEtcDir = "/etc/netns"
+
+// removeNetnsEtc removes the per namespace /etc directory so that it doesn't
+// leak into a future namespace with the same name. A missing one is ignored.
+func removeNetnsEtc(nsname string, dryrun bool) error {
+	path := netnsEtcDir + "/" + nsname
+	log.Infof("remove %s", path)
+
+	if dryrun {
+		scriptCommand(exec.Command("rm", "-rf", path), false)
+		return nil
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	return nil
+}
+
+var (
+	// NetnsDeleteRetries is how many times the deletion of the namespace is
+	// retried while it is busy, e.g. a process still holds it open.
+	NetnsDeleteRetries = 3
+	// NetnsDeleteBackoff is the wait before the first retry. It doubles on
+	// every retry.
+	NetnsDeleteBackoff = 200 * time.Millisecond
+	// KillLingeringProcesses drains the processes left in the namespace before
+	// the retry, e.g. the commands run by RunCommands which outlived ayame. They
+	// are terminated with SIGTERM and killed after DrainGracePeriod.
+	KillLingeringProcesses = false
+	// DrainNamespaces terminates the processes in the namespace owned by ayame
+	// before deleting it, so that the deletion doesn't fail as busy and no
+	// socket is orphaned. It is off by default.
+	DrainNamespaces = false
+	// DrainGracePeriod is how long the processes have after SIGTERM before they
+	// are killed with SIGKILL.
+	DrainGracePeriod = 5 * time.Second
+)
+
+// drainNetns sends SIGTERM to the processes in the namespace, and SIGKILL to
+// the ones still there after DrainGracePeriod.
+func drainNetns(nsname string, dryrun bool) {
+	if dryrun {
+		log.Infof("drain processes in ns %s", nsname)
+		pids := fmt.Sprintf("%s netns pids %s", ipBin(), shellQuote(nsname))
+		drain := fmt.Sprintf("pids=$(%s); [ -z \"$pids\" ] || { kill -TERM $pids; sleep %g; %s | xargs -r kill -KILL; }",
+			pids, DrainGracePeriod.Seconds(), pids)
+		scriptCommand(exec.Command("bash", "-c", drain), true)
+		return
+	}
+
+	pids, err := ListIpNetnsPids(nsname)
+	if err != nil {
+		log.Warnf(err.Error())
+		return
+	}
+
+	for _, pid := range pids {
+		log.Infof("terminate process %d in ns %s", pid, nsname)
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Warnf("failed to terminate process %d in ns %s: %s", pid, nsname, err)
+		}
+	}
+
+	deadline := time.Now().Add(DrainGracePeriod)
+	for len(pids) != 0 && time.Now().Before(deadline) {
+		time.Sleep(interfaceWaitInterval)
+		if pids, err = ListIpNetnsPids(nsname); err != nil {
+			log.Warnf(err.Error())
+			return
+		}
+	}
+
+	if len(pids) != 0 {
+		killNetnsProcesses(nsname)
+	}
+}
+
+// deleteNetns deletes the namespace, retrying while it is busy. The lingering
+// processes are killed only if killable, i.e. the namespace is owned by ayame.
+func deleteNetns(nsname string, killable bool, dryrun bool) error {
+	backoff := NetnsDeleteBackoff
+	for i := 0; ; i++ {
+		err := RunIpNetnsDelete(nsname, dryrun)
+		if err == nil || i >= NetnsDeleteRetries || !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+
+		log.Warnf("ns %s is busy, retry in %s: %s", nsname, backoff, err)
+
+		// The processes may clean up on SIGTERM in the grace period as on drain.
+		if KillLingeringProcesses && killable {
+			drainNetns(nsname, false)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func killNetnsProcesses(nsname string) {
+	pids, err := ListIpNetnsPids(nsname)
+	if err != nil {
+		log.Warnf(err.Error())
+		return
+	}
+
+	for _, pid := range pids {
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		log.Infof("kill process %d in ns %s", pid, nsname)
+		if err := p.Kill(); err != nil {
+			log.Warnf("failed to kill process %d in ns %s: %s", pid, nsname, err)
+		}
+	}
+}
+
 func (n *Namespace) Attach(veth *Veth, dryrun bool) error {
+	return n.attach(veth, true, dryrun)
+}
+
+// AttachCreated registers the veth which has been created inside the namespace
+// directly and assigns CIDR to it.
+func (n *Namespace) AttachCreated(veth *Veth, dryrun bool) error {
+	return n.attach(veth, false, dryrun)
+}
+
+// AttachToDevice is the same as Attach, but the veth is attached to the device
+// config of the link explicitly rather than the one found by the veth name.
+func (n *Namespace) AttachToDevice(link string, veth *Veth, dryrun bool) error {
+	return n.attachToDevice(link, veth, true, dryrun)
+}
+
+func (n *Namespace) attachToDevice(link string, veth *Veth, move bool, dryrun bool) error {
+	if veth.Attached {
+		return Errorf(ErrDeviceAttached, "device %s is already attached", veth.Name)
+	}
+
+	targetCfgIdx, err := n.findDeviceConfigByLink(link)
+	if err != nil {
+		return err
+	}
+
+	return n.attachDevice(targetCfgIdx, veth, move, dryrun)
+}
+
+// hasDevice reports whether the namespace has the device config of the name.
+func (n *Namespace) hasDevice(name string) bool {
+	for _, cfg := range n.RegisteredDeviceConfig {
+		if cfg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Namespace) attach(veth *Veth, move bool, dryrun bool) error {
 	if veth.Attached {
-		return fmt.Errorf("device %s is already attached", veth.Name)
+		return Errorf(ErrDeviceAttached, "device %s is already attached", veth.Name)
+	}
+
+	targetCfgIdx, err := n.findDeviceConfig(veth)
+	if err != nil {
+		return err
+	}
+
+	return n.attachDevice(targetCfgIdx, veth, move, dryrun)
+}
+
+// attachDevice moves the veth into the namespace if move, and configures it as
+// the device config. If the configuration fails, e.g. the CIDR can't be
+// assigned, the moved veth is moved back to the host, so that it is never left
+// half configured in the namespace.
+func (n *Namespace) attachDevice(targetCfgIdx int, veth *Veth, move bool, dryrun bool) error {
+	if !move {
+		return n.configureDevice(targetCfgIdx, veth, move, dryrun)
+	}
+
+	if err := RunIpLinkSetNamespaces(veth.Name, n.Name, dryrun); err != nil {
+		return fmt.Errorf("failed to set device %s in namespace %s: %w", n.RegisteredDeviceConfig[targetCfgIdx].Name, n.Name, err)
+	}
+
+	if err := n.configureDevice(targetCfgIdx, veth, move, dryrun); err != nil {
+		n.RegisteredDeviceConfig[targetCfgIdx].Ipv6Addr = ""
+		if rerr := RunIpLinkSetHostNamespace(veth.Name, n.Name, dryrun); rerr != nil {
+			return multierr.Append(err, fmt.Errorf("failed to move %s back to the host: %w", veth.Name, rerr))
+		}
+		return err
+	}
+	return nil
+}
+
+func (n *Namespace) configureDevice(targetCfgIdx int, veth *Veth, move bool, dryrun bool) error {
+	targetCfg := n.RegisteredDeviceConfig[targetCfgIdx]
+
+	if err := waitForInterface(n.Name, veth.Name, InterfaceWaitTimeout, dryrun); err != nil {
+		return err
+	}
+
+	if move && veth.Mtu != 0 {
+		if err := RunIpLinkSetMtu(veth.Name, n.Name, veth.Mtu, dryrun); err != nil {
+			return err
+		}
+	}
+
+	if targetCfg.Description != "" {
+		if err := RunIpLinkSetAlias(veth.Name, n.Name, targetCfg.Description, dryrun); err != nil {
+			return err
+		}
+	}
+
+	if targetCfg.DisableIPv6 {
+		if err := RunSysctlInNamespace(n.Name, "net.ipv6.conf."+veth.Name+".disable_ipv6", "1", dryrun); err != nil {
+			return err
+		}
+	}
+
+	if err := RunEthtoolSetOffloads(veth.Name, n.Name, targetCfg.Offloads, dryrun); err != nil {
+		return err
+	}
+
+	if err := RunTcSetNetem(veth.Name, n.Name, targetCfg.Netem, dryrun); err != nil {
+		return err
+	}
+
+	if targetCfg.Mac != "" {
+		if err := RunIpLinkSetAddress(veth.Name, n.Name, targetCfg.Mac, dryrun); err != nil {
+			return err
+		}
+	}
+
+	if targetCfg.Promisc {
+		if err := RunIpLinkSetPromisc(veth.Name, n.Name, true, dryrun); err != nil {
+			return err
+		}
 	}
 
+	if targetCfg.Ipv6Prefix != "" {
+		addr, err := n.assignEUI64Addr(veth.Name, targetCfg.NamespaceDeviceConfig, dryrun)
+		if err != nil {
+			return err
+		}
+		n.RegisteredDeviceConfig[targetCfgIdx].Ipv6Addr = addr
+	}
+
+	// The CIDR of bond slaves is assigned to the bond instead. Slaves must be
+	// down to be enslaved, so they are left down for the bond.
+	if !n.isBondSlave(targetCfg.Name) {
+		if err := RunAssignCidrToNamespaces(veth.Name, n.Name, targetCfg.Cidr, targetCfg.Peer, targetCfg.Label, targetCfg.Broadcast, targetCfg.Scope, dryrun); err != nil {
+			return fmt.Errorf("failed to assign CIDR %s to ns %s on %s: %w", targetCfg.Cidr, n.Name, veth.Name, err)
+		}
+
+		if !targetCfg.LeaveDown {
+			if err := RunIpLinkSetState(veth.Name, n.Name, true, dryrun); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("succeeded to attach CIDR %s to dev %s on ns %s\n", targetCfg.Cidr, veth.Name, n.Name)
+		n.RegisteredDeviceConfig[targetCfgIdx].Down = targetCfg.LeaveDown
+	}
+
+	n.RegisteredDeviceConfig[targetCfgIdx].AttachedVeth = veth.Name
+	veth.Attached = true
+	return nil
+}
+
+// WaitForAddresses waits for the addresses of the attached devices to be usable
+// as AddressWaitTimeout. It must be called after both ends of the links are up,
+// since DAD doesn't start without carrier. The devices left down are skipped.
+func (n *Namespace) WaitForAddresses(dryrun bool) error {
+	if AddressWaitTimeout == 0 || dryrun {
+		return nil
+	}
+
+	for _, dev := range n.RegisteredDeviceConfig {
+		if dev.AttachedVeth == "" || dev.Cidr == "" || dev.LeaveDown || n.isBondSlave(dev.Name) {
+			continue
+		}
+		if err := WaitForAddress(n.Name, dev.AttachedVeth, dev.Cidr, AddressWaitTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignEUI64Addr assigns the address derived from the IPv6 prefix and the MAC
+// of the device. The random MAC isn't known on dry run, so nothing is assigned
+// then unless the MAC is configured.
+func (n *Namespace) assignEUI64Addr(ifname string, cfg config.NamespaceDeviceConfig, dryrun bool) (string, error) {
+	mac := cfg.Mac
+	if mac == "" {
+		if dryrun {
+			log.Infof("IPv6 address of %s in ns %s is derived from the MAC on creation", ifname, n.Name)
+			return "", nil
+		}
+
+		var links []struct {
+			Address string `json:"address"`
+		}
+		if err := outputJSONInNamespace(context.Background(), n.Name, &links, "link", "show", "dev", ifname); err != nil {
+			return "", fmt.Errorf("failed to get MAC of %s in ns %s: %w", ifname, n.Name, err)
+		}
+		if len(links) != 1 {
+			return "", Errorf(ErrNotFound, "%s is not found in ns %s", ifname, n.Name)
+		}
+		mac = links[0].Address
+	}
+
+	addr, err := EUI64Addr(cfg.Ipv6Prefix, mac)
+	if err != nil {
+		return "", err
+	}
+
+	if err := RunAssignCidrToNamespaces(ifname, n.Name, addr, "", "", "", "", dryrun); err != nil {
+		return "", fmt.Errorf("failed to assign %s to ns %s on %s: %w", addr, n.Name, ifname, err)
+	}
+
+	log.Infof("succeeded to attach %s to dev %s on ns %s\n", addr, ifname, n.Name)
+	return addr, nil
+}
+
+// findDeviceConfigByLink returns the index of the unattached device config of
+// the link.
+func (n *Namespace) findDeviceConfigByLink(link string) (int, error) {
+	for idx, config := range n.RegisteredDeviceConfig {
+		if config.Name != link {
+			continue
+		}
+
+		if len(config.AttachedVeth) != 0 {
+			return -1, Errorf(ErrDeviceAttached, "device %s has been attached to namespace %s", link, n.Name)
+		}
+
+		if !n.isBondSlave(config.Name) {
+			if _, _, err := net.ParseCIDR(config.Cidr); err != nil {
+				return -1, Errorf(ErrInvalidCIDR, "failed to parse CIDR %s in namespace %s device %s: %s\n",
+					config.Cidr, n.Name, config.Name, err)
+			}
+		}
+
+		return idx, nil
+	}
+
+	return -1, Errorf(ErrNotFound, "link %s can't be attached to %s", link, n.Name)
+}
+
+// derivedSuffix matches what follows "<device>-" in the names of the devices
+// derived from the device name: <link>-left/right of direct links,
+// <bridge>-<N>-left/right of bridges and <link>-<N> of macvlan links.
+var derivedSuffix = regexp.MustCompile(`^(([0-9]+-)?(left|right)|[0-9]+)$`)
+
+// derivedFrom returns whether the veth is named after the device, e.g. "eth-left"
+// is derived from "eth" but "eth1-left" isn't. Tunnels are named as the device.
+func derivedFrom(vethName string, device string) bool {
+	if vethName == device {
+		return true
+	}
+	if !strings.HasPrefix(vethName, device+"-") {
+		return false
+	}
+	return derivedSuffix.MatchString(strings.TrimPrefix(vethName, device+"-"))
+}
+
+// findDeviceConfig returns the index of the unattached device config which
+// the veth can be attached to.
+func (n *Namespace) findDeviceConfig(veth *Veth) (int, error) {
 	targetCfgIdx := -1
 	for idx, config := range n.RegisteredDeviceConfig {
-		if !strings.HasPrefix(veth.Name, config.Name) {
+		if !derivedFrom(veth.Name, config.Name) {
 			continue
 		}
 
 		if len(config.AttachedVeth) != 0 {
-			return fmt.Errorf("device %s has been attached to namexpace %s", config.NamespaceDeviceConfig.Name, n.Name)
+			return -1, Errorf(ErrDeviceAttached, "device %s has been attached to namexpace %s", config.NamespaceDeviceConfig.Name, n.Name)
+		}
+
+		// More than one device matching the veth would apply the config of the
+		// wrong one depending on the order.
+		if targetCfgIdx != -1 {
+			return -1, fmt.Errorf("proposed device %s matches both %s and %s in %s",
+				veth.Name, n.RegisteredDeviceConfig[targetCfgIdx].Name, config.Name, n.Name)
 		}
 
 		targetCfgIdx = idx
-		break
 	}
 
 	if targetCfgIdx == -1 {
-		return fmt.Errorf("proposed device %s can't be attached to %s", veth.Name, n.Name)
+		return -1, Errorf(ErrNotFound, "proposed device %s can't be attached to %s", veth.Name, n.Name)
 	}
 
 	targetCfg := n.RegisteredDeviceConfig[targetCfgIdx]
 
+	if n.isBondSlave(targetCfg.Name) {
+		return targetCfgIdx, nil
+	}
+
 	_, _, err := net.ParseCIDR(targetCfg.Cidr)
 	if err != nil {
-		return fmt.Errorf("failed to parse CIDR %s in namespace %s device %s: %s\n",
+		return -1, Errorf(ErrInvalidCIDR, "failed to parse CIDR %s in namespace %s device %s: %s\n",
 			targetCfg.Cidr, n.Name, targetCfg.Name, err)
 	}
 
-	if err := RunIpLinkSetNamespaces(veth.Name, n.Name, dryrun); err != nil {
-		return fmt.Errorf("failed to set device %s in namespace %s: %s", targetCfg.Name, n.Name, err)
+	return targetCfgIdx, nil
+}
+
+func (n *Namespace) isBondSlave(name string) bool {
+	for _, bond := range n.Bonds {
+		for _, slave := range bond.Slaves {
+			if slave == name {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	if err := RunAssignCidrToNamespaces(veth.Name, n.Name, targetCfg.Cidr, dryrun); err != nil {
-		return fmt.Errorf("failed to assign CIDR %s to ns %s on %s", targetCfg.Cidr, n.Name, veth.Name)
+// CreateBonds creates the bonds, enslaves the attached devices, assigns CIDR
+// to the bonds and sets them up. The bond is left down if any of its slaves is
+// configured with LeaveDown. It must be called after all the devices are
+// attached.
+func (n *Namespace) CreateBonds(dryrun bool) error {
+	for _, bond := range n.Bonds {
+		var slaveVeths []string
+		leaveDown := false
+		for _, slave := range bond.Slaves {
+			attachedVeth := ""
+			for _, dev := range n.RegisteredDeviceConfig {
+				if dev.Name == slave {
+					attachedVeth = dev.AttachedVeth
+					leaveDown = leaveDown || dev.LeaveDown
+					break
+				}
+			}
+
+			if len(attachedVeth) == 0 {
+				return fmt.Errorf("slave device %s of bond %s isn't attached to ns %s", slave, bond.Name, n.Name)
+			}
+			slaveVeths = append(slaveVeths, attachedVeth)
+		}
+
+		if err := RunIpLinkAddBond(n.Name, bond.Name, bond.Mode, dryrun); err != nil {
+			return err
+		}
+
+		for _, veth := range slaveVeths {
+			if err := RunIpLinkSetMaster(n.Name, veth, bond.Name, dryrun); err != nil {
+				return err
+			}
+		}
+
+		if err := RunAssignCidrToNamespaces(bond.Name, n.Name, bond.Cidr, "", "", "", "", dryrun); err != nil {
+			return fmt.Errorf("failed to assign CIDR %s to ns %s on %s: %w", bond.Cidr, n.Name, bond.Name, err)
+		}
+
+		if !leaveDown {
+			if err := RunIpLinkSetState(bond.Name, n.Name, true, dryrun); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("succeeded to create bond %s of %s on ns %s\n", bond.Name, strings.Join(slaveVeths, ","), n.Name)
 	}
 
-	log.Infof("succeeded to attach CIDR %s to dev %s on ns %s\n", targetCfg.Cidr, veth.Name, n.Name)
+	return nil
+}
 
-	n.RegisteredDeviceConfig[targetCfgIdx].AttachedVeth = veth.Name
-	veth.Attached = true
+// CreateDummies creates the dummy devices, assigns CIDR to them and sets them
+// up. They are deleted with the namespace.
+func (n *Namespace) CreateDummies(dryrun bool) error {
+	for _, dummy := range n.Dummies {
+		if err := RunIpLinkAddDummy(n.Name, dummy.Name, dryrun); err != nil {
+			return err
+		}
+
+		if dummy.Cidr != "" {
+			if err := RunAssignCidrToNamespaces(dummy.Name, n.Name, dummy.Cidr, "", "", "", "", dryrun); err != nil {
+				return err
+			}
+		}
+
+		if err := RunIpLinkSetState(dummy.Name, n.Name, true, dryrun); err != nil {
+			return err
+		}
+
+		log.Infof("succeeded to create dummy %s on ns %s\n", dummy.Name, n.Name)
+	}
+
+	return nil
+}
+
+// Detach moves the veth back to the host and releases the device config bound
+// to it. The veth itself is left alive, so it can be attached again elsewhere.
+func (n *Namespace) Detach(veth *Veth, dryrun bool) error {
+	targetCfgIdx, err := n.findAttachedDeviceConfig(veth)
+	if err != nil {
+		return err
+	}
+
+	if err := RunIpLinkSetHostNamespace(veth.Name, n.Name, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to detach dev %s from ns %s\n", veth.Name, n.Name)
+
+	n.RegisteredDeviceConfig[targetCfgIdx].AttachedVeth = ""
+	veth.Attached = false
+	return nil
+}
+
+// DetachTo moves the veth into the target namespace directly without going
+// through the host, and attaches it to the device config of the target found by
+// the veth name. The addresses are flushed by the kernel on the move, so the
+// CIDR of the target is assigned from scratch.
+func (n *Namespace) DetachTo(veth *Veth, target *Namespace, dryrun bool) error {
+	targetCfgIdx, err := n.findAttachedDeviceConfig(veth)
+	if err != nil {
+		return err
+	}
+
+	if _, err := target.findDeviceConfig(veth); err != nil {
+		return err
+	}
+
+	if err := RunIpLinkMoveNamespace(veth.Name, n.Name, target.Name, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to move dev %s from ns %s to ns %s\n", veth.Name, n.Name, target.Name)
+
+	n.RegisteredDeviceConfig[targetCfgIdx].AttachedVeth = ""
+	veth.Attached = false
+
+	if err := target.attach(veth, false, dryrun); err != nil {
+		return fmt.Errorf("dev %s was moved to ns %s but failed to be configured: %w", veth.Name, target.Name, err)
+	}
+
+	return nil
+}
+
+// Release releases the device config bound to the veth without touching the
+// device itself. It is used when the veth has been already deleted.
+func (n *Namespace) Release(veth *Veth) error {
+	targetCfgIdx, err := n.findAttachedDeviceConfig(veth)
+	if err != nil {
+		return err
+	}
+
+	n.RegisteredDeviceConfig[targetCfgIdx].AttachedVeth = ""
+	veth.Attached = false
+	return nil
+}
+
+func (n *Namespace) findAttachedDeviceConfig(veth *Veth) (int, error) {
+	if !veth.Attached {
+		return -1, Errorf(ErrInactive, "device %s is not attached", veth.Name)
+	}
+
+	for idx, config := range n.RegisteredDeviceConfig {
+		if config.AttachedVeth == veth.Name {
+			return idx, nil
+		}
+	}
+
+	return -1, Errorf(ErrNotFound, "device %s is not attached to %s", veth.Name, n.Name)
+}
+
+// SetUp brings the device left down by LeaveDown up.
+func (n *Namespace) SetUp(dev string, dryrun bool) error {
+	for i := range n.RegisteredDeviceConfig {
+		cfg := &n.RegisteredDeviceConfig[i]
+		if cfg.Name != dev {
+			continue
+		}
+
+		if len(cfg.AttachedVeth) == 0 {
+			return Errorf(ErrInactive, "device %s is not attached to ns %s", dev, n.Name)
+		}
+
+		if err := RunIpLinkSetState(cfg.AttachedVeth, n.Name, true, dryrun); err != nil {
+			return err
+		}
+
+		cfg.Down = false
+		return nil
+	}
+
+	return Errorf(ErrNotFound, "device %s is not configured in ns %s", dev, n.Name)
+}
+
+// PauseLinks sets the attached devices which are up down, and marks them as
+// paused. The devices left down by LeaveDown are kept as they are. Unlike
+// State.SetCarrier, the interfaces themselves are set down administratively. It
+// tries all the devices even if some of them fail.
+func (n *Namespace) PauseLinks(dryrun bool) error {
+	var allerr error
+	for i := range n.RegisteredDeviceConfig {
+		cfg := &n.RegisteredDeviceConfig[i]
+		if len(cfg.AttachedVeth) == 0 || cfg.Down || cfg.Paused {
+			continue
+		}
+
+		if err := RunIpLinkSetState(cfg.AttachedVeth, n.Name, false, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+			continue
+		}
+		cfg.Paused = true
+	}
+	return allerr
+}
+
+// ResumeLinks sets only the devices paused by PauseLinks up again. It tries all
+// the devices even if some of them fail, and those stay paused.
+func (n *Namespace) ResumeLinks(dryrun bool) error {
+	var allerr error
+	for i := range n.RegisteredDeviceConfig {
+		cfg := &n.RegisteredDeviceConfig[i]
+		if !cfg.Paused {
+			continue
+		}
+
+		if err := RunIpLinkSetState(cfg.AttachedVeth, n.Name, true, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+			continue
+		}
+		cfg.Paused = false
+	}
+	return allerr
+}
+
+// AddRoute adds the route to dst, which is a CIDR or "default", inside the
+// namespace. At least one of via and dev must be specified.
+func (n *Namespace) AddRoute(dst string, via string, dev string, dryrun bool) error {
+	return n.AddRouteToTable(dst, via, dev, 0, dryrun)
+}
+
+// AddRouteToTable is the same as AddRoute but adds the route to the routing
+// table, which is looked up by policy routing rules. Zero is the main table.
+func (n *Namespace) AddRouteToTable(dst string, via string, dev string, table uint32, dryrun bool) error {
+	if dst != "default" {
+		if _, _, err := net.ParseCIDR(dst); err != nil {
+			return Errorf(ErrInvalidCIDR, "failed to parse route destination %s: %s", dst, err)
+		}
+	}
+
+	if via == "" && dev == "" {
+		return fmt.Errorf("route %s requires via or dev", dst)
+	}
+
+	if via != "" && net.ParseIP(via) == nil {
+		return fmt.Errorf("invalid gateway %s of route %s", via, dst)
+	}
+
+	for _, route := range n.Routes {
+		if route.Dst == dst && route.Table == table {
+			return fmt.Errorf("route %s has been already added to ns %s", dst, n.Name)
+		}
+	}
+
+	if err := RunIpRouteAdd(n.Name, dst, via, dev, table, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to add route %s to ns %s\n", dst, n.Name)
+
+	n.Routes = append(n.Routes, Route{Dst: dst, Via: via, Dev: dev, Table: table})
+	return nil
+}
+
+// AddMultipathRoute adds the route with the weighted nexthops. The devices of
+// the nexthops must be interface names.
+func (n *Namespace) AddMultipathRoute(dst string, nexthops []config.NexthopConfig, table uint32, dryrun bool) error {
+	if dst != "default" {
+		if _, _, err := net.ParseCIDR(dst); err != nil {
+			return Errorf(ErrInvalidCIDR, "failed to parse route destination %s: %s", dst, err)
+		}
+	}
+
+	if len(nexthops) < 2 {
+		return fmt.Errorf("multipath route %s requires at least 2 nexthops", dst)
+	}
+
+	for _, route := range n.Routes {
+		if route.Dst == dst && route.Table == table {
+			return fmt.Errorf("route %s has been already added to ns %s", dst, n.Name)
+		}
+	}
+
+	if err := RunIpRouteAddMultipath(n.Name, dst, nexthops, table, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to add multipath route %s to ns %s\n", dst, n.Name)
+
+	n.Routes = append(n.Routes, Route{Dst: dst, Table: table, Nexthops: nexthops})
+	return nil
+}
+
+// DelRoute deletes the route to dst added with AddRoute.
+func (n *Namespace) DelRoute(dst string, dryrun bool) error {
+	return n.DelRouteFromTable(dst, 0, dryrun)
+}
+
+// DelRouteFromTable deletes the route to dst added to the routing table with
+// AddRouteToTable or AddMultipathRoute. Zero is the main table.
+func (n *Namespace) DelRouteFromTable(dst string, table uint32, dryrun bool) error {
+	routeIdx := -1
+	for idx, route := range n.Routes {
+		if route.Dst == dst && route.Table == table {
+			routeIdx = idx
+			break
+		}
+	}
+
+	if routeIdx == -1 {
+		return Errorf(ErrNotFound, "route %s is not added to table %d in ns %s", dst, table, n.Name)
+	}
+
+	if err := RunIpRouteDel(n.Name, dst, table, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to delete route %s from table %d in ns %s\n", dst, table, n.Name)
+
+	n.Routes = append(n.Routes[:routeIdx], n.Routes[routeIdx+1:]...)
+	return nil
+}
+
+// MarkDscp marks the packets sent from the interfaces attached to the link with
+// the DSCP value. The rules are deleted with the namespace. The namespace of a
+// process outlives the name, so its rules are deleted on Destroy.
+func (n *Namespace) MarkDscp(link string, dscp uint8, dryrun bool) error {
+	for i := range n.RegisteredDeviceConfig {
+		dev := &n.RegisteredDeviceConfig[i]
+		if dev.LinkName() != link || len(dev.AttachedVeth) == 0 {
+			continue
+		}
+
+		if err := RunIptablesSetDscp(n.Name, dev.AttachedVeth, dscp, dryrun); err != nil {
+			return err
+		}
+		dev.Dscp = &dscp
+
+		log.Infof("succeeded to mark dscp %d on %s in ns %s\n", dscp, dev.AttachedVeth, n.Name)
+	}
+	return nil
+}
+
+// ApplyFirewall adds the iptables rules in order and stops at the first
+// failure. The rules are not kept in the state because they are deleted with
+// the namespace.
+func (n *Namespace) ApplyFirewall(rules []string, dryrun bool) error {
+	for _, rule := range rules {
+		if err := RunIptablesRule(n.Name, rule, dryrun); err != nil {
+			return err
+		}
+	}
+	if len(rules) != 0 {
+		log.Infof("succeeded to add %d firewall rules in ns %s\n", len(rules), n.Name)
+	}
 	return nil
 }
 
@@ -133,9 +982,10 @@ func (n *Namespace) RunCommands(commands []string, dryrun bool) {
 		log.Infof("execute %s", cmd.String())
 
 		if dryrun {
+			auditPlannedTolerantCommand(cmd)
 			continue
 		}
-		res, err := cmd.Output()
+		res, err := outputCommand(cmd)
 		if err != nil {
 			log.Warn(err.Error())
 			continue
@@ -145,17 +995,52 @@ func (n *Namespace) RunCommands(commands []string, dryrun bool) {
 	}
 }
 
-func (n *Namespace) buildCommand(command string) ([]string, error) {
-	splited := strings.Split(command, " ")
-	if len(splited) == 0 {
-		return nil, fmt.Errorf("malformed command: %s", command)
+// RunPostSetup runs the commands with sh in order and stops at the first
+// failure. The output of the failed command is included in the error. The
+// command must redirect the output of the daemons it starts, otherwise it is
+// regarded as running until CommandTimeout.
+func (n *Namespace) RunPostSetup(commands []string, dryrun bool) error {
+	for _, command := range commands {
+		netnsCmd := append(n.execPrefix(), "sh", "-c", command)
+		cmd := exec.Command(netnsCmd[0], netnsCmd[1:]...)
+		log.Infoln("execute ", cmd.String())
+
+		if dryrun {
+			auditPlannedCommand(cmd)
+			continue
+		}
+
+		res, err := outputCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("post setup %q failed in ns %s: %w\n%s", command, n.Name, err, string(res))
+		}
+
+		log.Infof("\n%s", string(res))
 	}
+	return nil
+}
 
+// execPrefix returns the command to execute a command inside the namespace.
+func (n *Namespace) execPrefix() []string {
 	netnsCmd := []string{}
-	netnsCmd = append(netnsCmd, "ip")
+	if n.Hostname != "" {
+		netnsCmd = append(netnsCmd, "nsenter")
+		netnsCmd = append(netnsCmd, "--uts="+utsNamespacePath(n.Name))
+	}
+	netnsCmd = append(netnsCmd, ipBin())
 	netnsCmd = append(netnsCmd, "netns")
 	netnsCmd = append(netnsCmd, "exec")
 	netnsCmd = append(netnsCmd, n.Name)
+	return netnsCmd
+}
+
+func (n *Namespace) buildCommand(command string) ([]string, error) {
+	splited := strings.Split(command, " ")
+	if len(splited) == 0 {
+		return nil, fmt.Errorf("malformed command: %s", command)
+	}
+
+	netnsCmd := n.execPrefix()
 
 	re := regexp.MustCompile(`[0-9a-zA-Z]*`)
 
@@ -176,6 +1061,9 @@ func (n *Namespace) buildCommand(command string) ([]string, error) {
 	return netnsCmd, nil
 }
 
+// InitNamespaces creates the namespaces in order and stops at the first
+// failure. The namespaces created so far are returned with the error, so that
+// the caller can clean them up.
 func InitNamespaces(conf []*config.NamespaceConfig, dryrun bool) ([]*Namespace, error) {
 	var namespaces []*Namespace
 
@@ -183,7 +1071,10 @@ func InitNamespaces(conf []*config.NamespaceConfig, dryrun bool) ([]*Namespace,
 	for _, c := range conf {
 		ns, err := InitNamespace(c, dryrun)
 		if err != nil {
-			return nil, err
+			if ns != nil {
+				namespaces = append(namespaces, ns)
+			}
+			return namespaces, err
 		}
 
 		namespaces = append(namespaces, ns)
@@ -201,30 +1092,93 @@ func InitNamespacesLinks(namespaces []*Namespace, links map[string]*DirectLink,
 				continue
 			}
 
-			if _, ok := links[devConf.Name]; !ok {
+			linkName := devConf.LinkName()
+			if _, ok := links[linkName]; !ok {
 				continue
 			}
 
-			if _, ok := netLinks[devConf.Name]; !ok {
-				netLinks[devConf.Name] = []int{}
+			if _, ok := netLinks[linkName]; !ok {
+				netLinks[linkName] = []int{}
 			}
-			netLinks[devConf.Name] = append(netLinks[devConf.Name], i)
+			netLinks[linkName] = append(netLinks[linkName], i)
 		}
 	}
 
-	for linkName, idxs := range netLinks {
-		if len(idxs) != 2 {
-			return fmt.Errorf("%s should have only 2 link in %s\n", linkName, namespaces[idxs[0]].Name)
+	type createdLink struct {
+		link  *DirectLink
+		left  *Namespace
+		right *Namespace
+	}
+	var created []createdLink
+
+	// rollback removes exactly the links created in this call, so that the
+	// namespaces are restored to a clean slate.
+	rollback := func(err error) error {
+		for i := len(created) - 1; i >= 0; i-- {
+			c := created[i]
+			if rerr := c.link.RemoveLink(c.left, c.right, dryrun); rerr != nil {
+				err = multierr.Append(err, rerr)
+			}
 		}
+		return err
+	}
+
+	// Process links in sorted order so that the creation order and the errors
+	// surfaced first are the same on every run.
+	linkNames := make([]string, 0, len(netLinks))
+	for linkName := range netLinks {
+		linkNames = append(linkNames, linkName)
+	}
+	sort.Strings(linkNames)
 
+	for _, linkName := range linkNames {
+		idxs := netLinks[linkName]
 		targetLink, ok := links[linkName]
 		if !ok {
-			return fmt.Errorf("can't find device %s in configured links", linkName)
+			return rollback(Errorf(ErrNotFound, "can't find device %s in configured links", linkName))
+		}
+
+		if targetLink.HostCidr != "" {
+			if len(idxs) != 1 {
+				return rollback(fmt.Errorf("%s should have only 1 link in %s because the other end is on host\n", linkName, namespaces[idxs[0]].Name))
+			}
+
+			if err := targetLink.CreateHostLink(namespaces[idxs[0]], dryrun); err != nil {
+				return rollback(fmt.Errorf("failed to create links %s: %w", linkName, err))
+			}
+			created = append(created, createdLink{link: targetLink, left: namespaces[idxs[0]]})
+			continue
+		}
+
+		if len(idxs) != 2 {
+			return rollback(fmt.Errorf("%s should have only 2 link in %s\n", linkName, namespaces[idxs[0]].Name))
+		}
+
+		// The left end goes to the namespace of the first endpoint, or the first
+		// namespace declared in the link.
+		if len(targetLink.Endpoints) != 0 && !namespaces[idxs[0]].hasDevice(targetLink.Endpoints[0]) {
+			idxs[0], idxs[1] = idxs[1], idxs[0]
+		}
+		if len(targetLink.Namespaces) != 0 && namespaces[idxs[0]].Name != targetLink.Namespaces[0] {
+			idxs[0], idxs[1] = idxs[1], idxs[0]
+		}
+		if len(targetLink.Namespaces) != 0 && (namespaces[idxs[0]].Name != targetLink.Namespaces[0] || namespaces[idxs[1]].Name != targetLink.Namespaces[1]) {
+			return rollback(fmt.Errorf("%s should be attached to %s and %s, but %s and %s have it", linkName, targetLink.Namespaces[0], targetLink.Namespaces[1], namespaces[idxs[0]].Name, namespaces[idxs[1]].Name))
+		}
+
+		// Nothing is attached to the namespaces, so there is nothing to roll back
+		// but the veth pair itself, which is deleted by the caller.
+		if targetLink.HostDebug {
+			if err := targetLink.CreateDebugLink(namespaces[idxs[0]], namespaces[idxs[1]], dryrun); err != nil {
+				return rollback(fmt.Errorf("failed to create links %s: %w", linkName, err))
+			}
+			continue
 		}
 
 		if err := targetLink.CreateLink(namespaces[idxs[0]], namespaces[idxs[1]], dryrun); err != nil {
-			return fmt.Errorf("failed to create links %s: %s", linkName, err.Error())
+			return rollback(fmt.Errorf("failed to create links %s: %w", linkName, err))
 		}
+		created = append(created, createdLink{link: targetLink, left: namespaces[idxs[0]], right: namespaces[idxs[1]]})
 	}
 
 	return nil
@@ -243,7 +1197,49 @@ func InitNamespacesBridges(namespaces []*Namespace, bridges map[string]*Bridge,
 			}
 
 			if err := targetLink.CreateLink(ns, dryrun); err != nil {
-				return fmt.Errorf("failed to link %s to bridge %s", ns.Name, targetLink.Name)
+				return fmt.Errorf("failed to link %s to bridge %s: %w", ns.Name, targetLink.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func InitNamespacesMacvlans(namespaces []*Namespace, macvlans map[string]*MacvlanLink, dryrun bool) error {
+	for _, ns := range namespaces {
+		for _, dev := range ns.RegisteredDeviceConfig {
+			if len(dev.AttachedVeth) != 0 {
+				continue
+			}
+
+			targetLink, ok := macvlans[dev.Name]
+			if !ok {
+				continue
+			}
+
+			if err := targetLink.CreateLink(ns, dryrun); err != nil {
+				return fmt.Errorf("failed to link %s to macvlan %s: %w", ns.Name, targetLink.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func InitNamespacesTunnels(namespaces []*Namespace, tunnels map[string]*TunnelLink, dryrun bool) error {
+	for _, ns := range namespaces {
+		for _, dev := range ns.RegisteredDeviceConfig {
+			if len(dev.AttachedVeth) != 0 {
+				continue
+			}
+
+			targetLink, ok := tunnels[dev.Name]
+			if !ok {
+				continue
+			}
+
+			if err := targetLink.CreateLink(ns, dryrun); err != nil {
+				return fmt.Errorf("failed to link %s to tunnel %s: %w", ns.Name, targetLink.Name, err)
 			}
 		}
 	}
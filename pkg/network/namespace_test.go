@@ -0,0 +1,172 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+func TestDestroyRemovesNetnsEtc(t *testing.T) {
+	prevDir := netnsEtcDir
+	netnsEtcDir = t.TempDir()
+	defer func() { netnsEtcDir = prevDir }()
+
+	// The namespaces are gone after the host is rebooted, but /etc/netns isn't.
+	for _, exists := range []bool{true, false} {
+		host := newFakeHost()
+		if exists {
+			host.namespaces["ns1"] = true
+		}
+		restore := NewOptions(WithRunner(host.run), WithVerbose(false)).Apply()
+
+		dir := filepath.Join(netnsEtcDir, "ns1")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "resolv.conf"), []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := (&Namespace{Name: "ns1"}).Destroy(false)
+		restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s is left after destroying the namespace (exists %t)", dir, exists)
+		}
+		if len(host.namespaces) != 0 {
+			t.Errorf("namespace is left: %v", host.namespaces)
+		}
+	}
+}
+
+func TestDestroyToleratesMissingNetnsEtc(t *testing.T) {
+	prevDir := netnsEtcDir
+	netnsEtcDir = t.TempDir()
+	defer func() { netnsEtcDir = prevDir }()
+
+	host := newFakeHost()
+	host.namespaces["ns1"] = true
+	defer NewOptions(WithRunner(host.run), WithVerbose(false)).Apply()()
+
+	if err := (&Namespace{Name: "ns1"}).Destroy(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttachKeepsMtuInNamespace(t *testing.T) {
+	// The move into the namespace resets the MTU as some drivers do.
+	mtus := map[string]string{}
+	run := func(cmd *exec.Cmd) ([]byte, error) {
+		args := cmd.Args[1:]
+		if len(args) > 4 && args[0] == "netns" && args[1] == "exec" {
+			args = args[4:]
+		}
+		if len(args) == 5 && args[0] == "link" && args[1] == "set" {
+			switch args[3] {
+			case "netns":
+				mtus[args[2]] = "1500"
+			case "mtu":
+				mtus[args[2]] = args[4]
+			}
+		}
+		return nil, nil
+	}
+	defer NewOptions(WithRunner(run), WithVerbose(false)).Apply()()
+
+	ns := &Namespace{
+		Name: "ns1",
+		RegisteredDeviceConfig: []RegisteredDeviceConfig{
+			{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.1/24"}},
+		},
+	}
+	veth := &Veth{Name: "veth1-left", Mtu: 9000}
+	mtus[veth.Name] = strconv.Itoa(int(veth.Mtu))
+
+	if err := ns.Attach(veth, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if mtu := mtus[veth.Name]; mtu != "9000" {
+		t.Errorf("MTU of %s in ns1 is %s, want 9000", veth.Name, mtu)
+	}
+	if ns.RegisteredDeviceConfig[0].AttachedVeth != veth.Name {
+		t.Errorf("%s isn't attached", veth.Name)
+	}
+}
+
+func TestAttachMovesVethBackOnFailure(t *testing.T) {
+	var cmds []string
+	defer NewOptions(WithRunner(recordRunner(&cmds, "addr add")), WithVerbose(false)).Apply()()
+
+	ns := &Namespace{
+		Name: "ns1",
+		RegisteredDeviceConfig: []RegisteredDeviceConfig{
+			{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.1/24"}},
+		},
+	}
+	veth := &Veth{Name: "veth1-left"}
+
+	if err := ns.Attach(veth, false); err == nil {
+		t.Fatal("Attach succeeded though the CIDR failed")
+	}
+
+	if last := cmds[len(cmds)-1]; !strings.HasSuffix(last, "link set veth1-left netns 1") {
+		t.Errorf("%s isn't moved back to the host: %v", veth.Name, cmds)
+	}
+	if veth.Attached || ns.RegisteredDeviceConfig[0].AttachedVeth != "" {
+		t.Errorf("%s is still attached", veth.Name)
+	}
+}
+
+func TestCreateBondsSetsBondUp(t *testing.T) {
+	for _, leaveDown := range []bool{false, true} {
+		t.Run(fmt.Sprintf("leave down %t", leaveDown), func(t *testing.T) {
+			var cmds []string
+			defer NewOptions(WithRunner(recordRunner(&cmds, "")), WithVerbose(false)).Apply()()
+
+			ns := &Namespace{
+				Name: "ns1",
+				RegisteredDeviceConfig: []RegisteredDeviceConfig{
+					{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1"}, AttachedVeth: "veth1-left"},
+					{NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth2", LeaveDown: leaveDown}, AttachedVeth: "veth2-left"},
+				},
+				Bonds: []config.BondConfig{
+					{Name: "bond0", Mode: "active-backup", Slaves: []string{"veth1", "veth2"}, Cidr: "10.0.0.1/24"},
+				},
+			}
+
+			if err := ns.CreateBonds(false); err != nil {
+				t.Fatal(err)
+			}
+
+			up := strings.HasSuffix(cmds[len(cmds)-1], "link set bond0 up")
+			if up == leaveDown {
+				t.Errorf("bond0 is set up %t with leave_down %t: %v", up, leaveDown, cmds)
+			}
+		})
+	}
+}
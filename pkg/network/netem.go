@@ -0,0 +1,118 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// netemArgs builds the parameters of the netem qdisc in the order tc expects.
+func netemArgs(netem *config.NetemConfig) ([]string, error) {
+	percent := func(p float64) string {
+		return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+	}
+
+	var args []string
+	if netem.Delay != "" {
+		d, err := time.ParseDuration(netem.Delay)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "delay", fmt.Sprintf("%dus", d.Microseconds()))
+	}
+	if netem.LossPercent != 0 {
+		args = append(args, "loss", percent(netem.LossPercent))
+	}
+	if netem.DuplicatePercent != 0 {
+		args = append(args, "duplicate", percent(netem.DuplicatePercent))
+	}
+	if netem.CorruptPercent != 0 {
+		args = append(args, "corrupt", percent(netem.CorruptPercent))
+	}
+	if netem.ReorderPercent != 0 {
+		args = append(args, "reorder", percent(netem.ReorderPercent))
+		if netem.ReorderCorrelation != 0 {
+			args = append(args, percent(netem.ReorderCorrelation))
+		}
+		if netem.ReorderGap != 0 {
+			args = append(args, "gap", fmt.Sprint(netem.ReorderGap))
+		}
+	}
+
+	if netem.Limit != 0 {
+		args = append(args, "limit", fmt.Sprint(netem.Limit))
+	}
+	return args, nil
+}
+
+// tbfLatency is the longest time a packet can wait in the bucket of tbf.
+const tbfLatency = "50ms"
+
+// RunTcSetNetem replaces the root qdisc of the interface in the namespace with
+// netem applying all the impairments in a single command. The rate is shaped
+// by tbf attached under netem.
+func RunTcSetNetem(ifname string, nsname string, netem *config.NetemConfig, dryrun bool) error {
+	if netem == nil {
+		return nil
+	}
+
+	params, err := netemArgs(netem)
+	if err != nil {
+		return err
+	}
+
+	if !dryrun {
+		if _, err := exec.LookPath("tc"); err != nil {
+			return fmt.Errorf("tc is not found in PATH %s: install iproute2 to set netem of %s", os.Getenv("PATH"), ifname)
+		}
+	}
+
+	args := append([]string{"root", "handle", "1:", "netem"}, params...)
+	if err := runTcQdisc(ifname, nsname, args, dryrun); err != nil {
+		return fmt.Errorf("failed to set netem of %s in ns %s: %w", ifname, nsname, err)
+	}
+
+	if netem.Rate == "" {
+		return nil
+	}
+
+	args = []string{"parent", "1:1", "handle", "10:", "tbf", "rate", netem.Rate, "burst", fmt.Sprint(netem.Burst), "latency", tbfLatency}
+	if err := runTcQdisc(ifname, nsname, args, dryrun); err != nil {
+		return fmt.Errorf("failed to set rate %s of %s in ns %s: %w", netem.Rate, ifname, nsname, err)
+	}
+
+	return nil
+}
+
+// runTcQdisc replaces the qdisc of the interface in the namespace.
+func runTcQdisc(ifname string, nsname string, args []string, dryrun bool) error {
+	args = append([]string{"netns", "exec", nsname, "tc", "qdisc", "replace", "dev", ifname}, args...)
+	cmd := exec.Command(ipBin(), args...)
+	log.Infoln("execute ", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	return runCommand(cmd)
+}
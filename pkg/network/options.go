@@ -0,0 +1,165 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Runner runs the command and returns stdout. The error must contain the
+// command line so that failures are self-explanatory.
+type Runner func(cmd *exec.Cmd) ([]byte, error)
+
+// Options are the knobs of an operation passed once at the entry point, e.g.
+// state.InitResourcesWithOptions, instead of threading each of them through
+// every function. New knobs are added here with their Option.
+type Options struct {
+	DryRun bool
+	// Verbose logs every command executed. Only warnings and errors are logged
+	// otherwise.
+	Verbose bool
+	// Concurrency is the maximum number of commands run at the same time by the
+	// operations which run them in parallel. Only ConnectivityMatrix does so
+	// for now, the others run the commands one by one.
+	Concurrency int
+	// Runner runs the commands instead of executing them, e.g. to fake them.
+	Runner Runner
+	// Logger receives the logs instead of the standard logger of logrus.
+	Logger *logrus.Logger
+	// Context cancels the operation.
+	Context context.Context
+}
+
+// RefuseRunner fails every command. It is used in dry-run so that planning
+// never touches the host and never requires privileges.
+func RefuseRunner(cmd *exec.Cmd) ([]byte, error) {
+	return nil, fmt.Errorf("%s: commands must not be run in dry-run", cmd.String())
+}
+
+type Option func(*Options)
+
+// NewOptions returns the default options overridden by opts: no dry-run,
+// verbose, 8 concurrent commands and the background context.
+func NewOptions(opts ...Option) *Options {
+	o := &Options{
+		Verbose:     true,
+		Concurrency: 8,
+		Context:     context.Background(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithDryRun(dryrun bool) Option {
+	return func(o *Options) { o.DryRun = dryrun }
+}
+
+func WithVerbose(verbose bool) Option {
+	return func(o *Options) { o.Verbose = verbose }
+}
+
+func WithConcurrency(n int) Option {
+	return func(o *Options) { o.Concurrency = n }
+}
+
+func WithRunner(runner Runner) Option {
+	return func(o *Options) { o.Runner = runner }
+}
+
+func WithLogger(logger *logrus.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func WithContext(ctx context.Context) Option {
+	return func(o *Options) { o.Context = ctx }
+}
+
+// applyMu guards applyOwner and applyDepth. The operation applying options
+// owns the process wide knobs until it restores them, and the other goroutines
+// wait for applyCond.
+var (
+	applyMu    sync.Mutex
+	applyCond  = sync.NewCond(&applyMu)
+	applyOwner uint64
+	applyDepth int
+)
+
+// goroutineID returns the ID of the calling goroutine, which is parsed from
+// the header of its stack, e.g. "goroutine 18 [running]:".
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	id, _ := strconv.ParseUint(string(buf[:bytes.IndexByte(buf, ' ')]), 10, 64)
+	return id
+}
+
+// Apply installs the process wide knobs, i.e. the runner and the logger, and
+// returns the function restoring the previous ones. The operations applying
+// options on different goroutines are serialized: Apply blocks until the one
+// in progress restores its knobs, so concurrent operations never see each
+// other's runner or logger. Apply is re-entrant on the same goroutine, e.g. an
+// operation planning with other options in the middle, and the nested options
+// are in effect until restored.
+func (o *Options) Apply() (restore func()) {
+	id := goroutineID()
+	applyMu.Lock()
+	for applyDepth != 0 && applyOwner != id {
+		applyCond.Wait()
+	}
+	applyOwner = id
+	applyDepth++
+	applyMu.Unlock()
+
+	std := logrus.StandardLogger()
+	prevOut, prevFormatter, prevLevel := std.Out, std.Formatter, std.GetLevel()
+	prevRunner := runner
+
+	if o.Logger != nil {
+		std.SetOutput(o.Logger.Out)
+		std.SetFormatter(o.Logger.Formatter)
+		std.SetLevel(o.Logger.GetLevel())
+	}
+	if !o.Verbose && std.GetLevel() > logrus.WarnLevel {
+		std.SetLevel(logrus.WarnLevel)
+	}
+	if o.Runner != nil {
+		runner = o.Runner
+	}
+
+	return func() {
+		std.SetOutput(prevOut)
+		std.SetFormatter(prevFormatter)
+		std.SetLevel(prevLevel)
+		runner = prevRunner
+
+		applyMu.Lock()
+		applyDepth--
+		if applyDepth == 0 {
+			applyCond.Broadcast()
+		}
+		applyMu.Unlock()
+	}
+}
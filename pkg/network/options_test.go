@@ -0,0 +1,108 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"testing"
+)
+
+func TestApplyKeepsRunnerPerOperation(t *testing.T) {
+	const operations = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, operations)
+	for i := 0; i < operations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ifname := fmt.Sprintf("veth%d", i)
+			seen := []string{}
+			record := func(cmd *exec.Cmd) ([]byte, error) {
+				seen = append(seen, cmd.Args[len(cmd.Args)-2])
+				return nil, nil
+			}
+
+			restore := NewOptions(WithRunner(record), WithVerbose(false)).Apply()
+			defer restore()
+
+			for j := 0; j < 10; j++ {
+				if err := RunIpLinkSetHostState(ifname, true, false); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for _, name := range seen {
+				if name != ifname {
+					errs <- fmt.Errorf("operation on %s ran the command on %s", ifname, name)
+					return
+				}
+			}
+			if len(seen) != 10 {
+				errs <- fmt.Errorf("operation on %s ran %d commands, want 10", ifname, len(seen))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestApplyIsReentrant(t *testing.T) {
+	var outer, inner []string
+	restoreOuter := NewOptions(WithRunner(recordRunner(&outer, "")), WithVerbose(false)).Apply()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		restoreInner := NewOptions(WithRunner(recordRunner(&inner, "")), WithVerbose(false)).Apply()
+		defer restoreInner()
+		if err := RunIpLinkSetHostState("veth1", true, false); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The nested options are in effect until restored, and the outer ones are
+	// back after that.
+	if err := RunIpLinkSetHostState("veth1", true, false); err != nil {
+		t.Fatal(err)
+	}
+	restoreNested := NewOptions(WithRunner(RefuseRunner), WithVerbose(false)).Apply()
+	if err := RunIpLinkSetHostState("veth1", true, false); err == nil {
+		t.Error("nested runner isn't in effect")
+	}
+	restoreNested()
+	if err := RunIpLinkSetHostState("veth1", true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("other goroutine applies options in the middle of the operation")
+	default:
+	}
+	restoreOuter()
+	<-done
+
+	if len(outer) != 2 || len(inner) != 1 {
+		t.Errorf("commands are run by the wrong runner: %v %v", outer, inner)
+	}
+}
@@ -8,15 +8,20 @@ import (
 )
 
 func CreateNewBridge(name string, dryrun bool) error {
+	if err := checkIfname(name); err != nil {
+		return err
+	}
+
 	cmd := exec.Command("ovs-vsctl", "add-br", name)
 
 	log.Infof("execute %s", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create bridge %s", name)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %w", name, err)
 	}
 
 	return nil
@@ -28,10 +33,11 @@ func DeleteBridge(name string, dryrun bool) error {
 	log.Infof("execute %s", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete bridge %s", name)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %w", name, err)
 	}
 
 	return nil
@@ -43,10 +49,65 @@ func LinkBridge(name string, veth *Veth, dryrun bool) error {
 	log.Infof("execute %s", cmd.String())
 
 	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed link %s to %s: %w", veth.Name, name, err)
+	}
+
+	return nil
+}
+
+// UnlinkBridge removes the port of the veth from the bridge.
+func UnlinkBridge(name string, veth *Veth, dryrun bool) error {
+	cmd := exec.Command("ovs-vsctl", "--if-exists", "del-port", name, veth.Name)
+
+	log.Infof("execute %s", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed unlink %s from %s: %w", veth.Name, name, err)
+	}
+
+	return nil
+}
+
+func SetBridgeStp(name string, enable bool, dryrun bool) error {
+	cmd := exec.Command("ovs-vsctl", "set", "bridge", name, fmt.Sprintf("stp_enable=%t", enable))
+
+	log.Infof("execute %s", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return nil
+	}
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set stp of bridge %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// SetPortVlanFiltering filters the frames on the port by VLAN in the same way
+// as the port of the Linux bridge with vlan_filtering 1 and the default PVID 1:
+// untagged frames and the ones tagged with VLAN 1 are forwarded on VLAN 1, which
+// egresses untagged, and the frames tagged with other VLANs are dropped. OVS
+// bridges have no bridge wide VLAN filtering, so it is set on every port.
+func SetPortVlanFiltering(veth *Veth, dryrun bool) error {
+	cmd := exec.Command("ovs-vsctl", "set", "port", veth.Name, "tag=1", "vlan_mode=native-untagged", "trunks=1")
+
+	log.Infof("execute %s", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
 		return nil
 	}
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed link %s to %s", veth.Name, name)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set vlan mode of port %s: %w", veth.Name, err)
 	}
 
 	return nil
@@ -0,0 +1,52 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var pingTimeRegex = regexp.MustCompile(`time=([0-9.]+) ms`)
+
+// Ping sends a single ICMP echo request to addr from the namespace and returns
+// the round trip time. An error is returned if no reply has been received.
+func Ping(ctx context.Context, nsname string, addr string) (time.Duration, error) {
+	cmd := exec.CommandContext(ctx, ipBin(), "netns", "exec", nsname, "ping", "-c", "1", "-W", "1", addr)
+	log.Infof("execute %s", cmd.String())
+
+	out, err := queryCommand(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("%s is unreachable from %s: %w\n%s", addr, nsname, err, string(out))
+	}
+
+	m := pingTimeRegex.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("failed to parse the output of ping: %s", string(out))
+	}
+
+	ms, err := strconv.ParseFloat(string(m[1]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the output of ping: %w", err)
+	}
+
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PortMapping forwards the TCP port on the host to the address and the port in
+// the namespace with socat running on the host. No route to the namespace is
+// needed since each connection is relayed by socat run inside the namespace.
+type PortMapping struct {
+	Namespace string `json:"namespace"`
+	// Bind is the address on the host which socat listens on.
+	Bind     string `json:"bind,omitempty"`
+	HostPort uint16 `json:"host_port"`
+	Addr     string `json:"addr"`
+	Port     uint16 `json:"port"`
+	// Pid is the process of socat listening on the host port, which leads the
+	// process group of the relays. It is zero in dry-run.
+	Pid int `json:"pid,omitempty"`
+	// LogPath is the file receiving stderr of socat. It is removed on stop.
+	LogPath string `json:"log_path,omitempty"`
+}
+
+// DefaultPortForwardBind is the address on the host to listen on by default, so
+// that the server in the namespace isn't exposed to the network.
+const DefaultPortForwardBind = "127.0.0.1"
+
+// PortForwardStartTimeout is how long socat is watched after the start, so that
+// the failure to listen, e.g. the port in use, is reported.
+var PortForwardStartTimeout = 200 * time.Millisecond
+
+// StartPortForward starts socat listening on the host port of the bind address
+// in the background. socat outlives ayame until StopPortForward.
+func StartPortForward(nsname string, addr string, bind string, hostPort uint16, port uint16, dryrun bool) (*PortMapping, error) {
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address %q", bind)
+	}
+	listen := "TCP-LISTEN"
+	if ip.To4() == nil {
+		listen = "TCP6-LISTEN"
+	}
+
+	target := fmt.Sprintf("EXEC:%s netns exec %s socat STDIO TCP:%s", ipBin(), nsname, net.JoinHostPort(addr, fmt.Sprint(port)))
+	cmd := exec.Command("socat", fmt.Sprintf("%s:%d,bind=%s,fork,reuseaddr", listen, hostPort, bind), target)
+	log.Infoln("execute ", cmd.String())
+
+	mapping := &PortMapping{Namespace: nsname, Bind: bind, HostPort: hostPort, Addr: addr, Port: port}
+	if dryrun {
+		auditPlannedCommand(cmd)
+		return mapping, nil
+	}
+
+	if _, err := exec.LookPath("socat"); err != nil {
+		return nil, fmt.Errorf("socat is not found in PATH %s: install socat to expose port %d", os.Getenv("PATH"), hostPort)
+	}
+
+	// stderr goes to a file rather than a pipe, which would break once ayame
+	// exits and kill socat with SIGPIPE on the first error.
+	logFile, err := ioutil.TempFile("", fmt.Sprintf("ayame-socat-%d-*.log", hostPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log of socat on port %d: %w", hostPort, err)
+	}
+	defer logFile.Close()
+
+	cmd.Stderr = logFile
+	// The new session isn't killed with the terminal of ayame.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		os.Remove(logFile.Name())
+		return nil, fmt.Errorf("failed to start socat on port %d: %w", hostPort, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		stderr, _ := ioutil.ReadFile(logFile.Name())
+		os.Remove(logFile.Name())
+		return nil, fmt.Errorf("socat on port %d exited: %v: %s", hostPort, err, strings.TrimSpace(string(stderr)))
+	case <-time.After(PortForwardStartTimeout):
+	}
+
+	mapping.Pid = cmd.Process.Pid
+	mapping.LogPath = logFile.Name()
+	log.Infof("succeeded to forward port %d to %s in ns %s", hostPort, net.JoinHostPort(addr, fmt.Sprint(port)), nsname)
+	return mapping, nil
+}
+
+// StopPortForward terminates socat of the mapping together with the relays
+// forked for the connections, i.e. its process group. The process which has
+// already gone, or whose pid has been reused by another program, is regarded as
+// stopped.
+func StopPortForward(m *PortMapping, dryrun bool) error {
+	log.Infof("stop forwarding port %d to ns %s", m.HostPort, m.Namespace)
+
+	if dryrun || m.Pid == 0 {
+		return nil
+	}
+
+	if m.LogPath != "" {
+		defer os.Remove(m.LogPath)
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", m.Pid))
+	if err != nil || !bytes.Contains(cmdline, []byte("socat")) {
+		log.Infof("socat %d of port %d doesn't exist", m.Pid, m.HostPort)
+		return nil
+	}
+
+	// socat leads its own session, so the group id is the pid.
+	if err := syscall.Kill(-m.Pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to stop socat %d of port %d: %w", m.Pid, m.HostPort, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Capability numbers defined in linux/capability.h
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+var requiredCapabilities = []struct {
+	bit    uint
+	name   string
+	reason string
+}{
+	{capNetAdmin, "CAP_NET_ADMIN", "ip netns operations"},
+	{capSysAdmin, "CAP_SYS_ADMIN", "mounting network namespaces on ip netns add"},
+}
+
+// PreflightCheck verifies that the process has the capabilities and the
+// commands required to build networks, so that it can fail fast with an
+// actionable message instead of "Operation not permitted" from ip. Root is not
+// required as long as the capabilities are granted.
+func PreflightCheck() error {
+	if err := checkIpBin(); err != nil {
+		return err
+	}
+
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range requiredCapabilities {
+		if caps&(1<<c.bit) == 0 {
+			return fmt.Errorf("needs %s for %s", c.name, c.reason)
+		}
+	}
+
+	return nil
+}
+
+// checkIpBin verifies that ip, or the path set by IP_BIN, is executable.
+func checkIpBin() error {
+	bin := ipBin()
+	if _, err := exec.LookPath(bin); err != nil {
+		if os.Getenv(IpBinEnv) != "" {
+			return fmt.Errorf("%s set by %s is not executable: %w", bin, IpBinEnv, err)
+		}
+		return fmt.Errorf("ip is not found in PATH %s: install iproute2 or set %s to the path of ip", os.Getenv("PATH"), IpBinEnv)
+	}
+	return nil
+}
+
+func effectiveCapabilities() (uint64, error) {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read capabilities: %w", err)
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse capabilities %s: %w", line, err)
+		}
+		return caps, nil
+	}
+
+	return 0, fmt.Errorf("failed to find effective capabilities in /proc/self/status")
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"github.com/Shikugawa/ayame/pkg/config"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// AddRule adds the policy routing rule inside the namespace.
+func (n *Namespace) AddRule(rule config.RuleConfig, dryrun bool) error {
+	if err := RunIpRuleAdd(n.Name, rule.From, rule.To, rule.Fwmark, rule.Table, rule.Priority, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to add rule to table %d in ns %s\n", rule.Table, n.Name)
+
+	n.Rules = append(n.Rules, rule)
+	return nil
+}
+
+// DelRules deletes all the rules added with AddRule. It tries all the rules
+// even if some of them fail, and those are kept.
+func (n *Namespace) DelRules(dryrun bool) error {
+	var allerr error
+	var left []config.RuleConfig
+	for _, rule := range n.Rules {
+		if err := RunIpRuleDel(n.Name, rule.From, rule.To, rule.Fwmark, rule.Table, rule.Priority, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+			left = append(left, rule)
+		}
+	}
+
+	n.Rules = left
+	return allerr
+}
+
+// ApplyRouting adds the routes and then the rules which look them up. It must
+// be called after all the devices are attached, since the routes refer them.
+func (n *Namespace) ApplyRouting(routes []config.RouteConfig, rules []config.RuleConfig, dryrun bool) error {
+	for _, route := range routes {
+		if len(route.Nexthops) != 0 {
+			var nexthops []config.NexthopConfig
+			for _, nh := range route.Nexthops {
+				nh.Dev = n.interfaceName(nh.Dev)
+				nexthops = append(nexthops, nh)
+			}
+			if err := n.AddMultipathRoute(route.Dst, nexthops, route.Table, dryrun); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := n.AddRouteToTable(route.Dst, route.Via, n.interfaceName(route.Dev), route.Table, dryrun); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		if err := n.AddRule(rule, dryrun); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// interfaceName returns the interface attached to the device of the name. The
+// name is returned as is if it isn't a device, e.g. a bond.
+func (n *Namespace) interfaceName(dev string) string {
+	for _, cfg := range n.RegisteredDeviceConfig {
+		if cfg.Name == dev && len(cfg.AttachedVeth) != 0 {
+			return cfg.AttachedVeth
+		}
+	}
+	return dev
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ScriptHeader starts the script written by SetScriptWriter, which stops at the
+// first failure like ayame does.
+const ScriptHeader = "#!/usr/bin/env bash\nset -euo pipefail\n"
+
+var (
+	scriptMu     sync.Mutex
+	scriptWriter io.Writer
+	// scriptSection is the comment written before the next command, so that
+	// the sections without any command are omitted.
+	scriptSection string
+)
+
+// SetScriptWriter sets the writer to which the commands planned in dry-run are
+// appended as a bash script, so that it can be reviewed and run by hand. The
+// caller writes ScriptHeader first. nil disables the script.
+func SetScriptWriter(w io.Writer) {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	scriptWriter = w
+}
+
+// ScriptComment starts the section of the script with the comment describing
+// the following commands, e.g. the resource they create.
+func ScriptComment(format string, args ...interface{}) {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	scriptSection = fmt.Sprintf(format, args...)
+}
+
+// scriptCommand writes the planned command to the script. The failure of the
+// tolerant command is ignored as ayame does.
+func scriptCommand(cmd *exec.Cmd, tolerant bool) {
+	quoted := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	line := strings.Join(quoted, " ")
+	if tolerant {
+		line += " || true"
+	}
+
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+
+	if scriptWriter == nil {
+		return
+	}
+
+	if scriptSection != "" {
+		line = "\n# " + scriptSection + "\n" + line
+		scriptSection = ""
+	}
+	if _, err := io.WriteString(scriptWriter, line+"\n"); err != nil {
+		log.Warnf("failed to write script: %s", err)
+	}
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,-]+$`)
+
+// shellQuote quotes the argument for bash unless it is safe as is.
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
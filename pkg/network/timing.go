@@ -0,0 +1,73 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Timing is the total time spent on creating the resource, e.g. creating the
+// veth pair of a link and attaching it to the namespaces.
+type Timing struct {
+	Kind     string        `json:"kind"`
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+var (
+	timingMu sync.Mutex
+	// timings is nil unless collecting.
+	timings []Timing
+)
+
+// CollectTimings starts collecting the timings of the resources created until
+// the returned function is called, which returns them in the order of the
+// first step of each resource. Dry-run isn't timed.
+func CollectTimings() (stop func() []Timing) {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	timings = []Timing{}
+
+	return func() []Timing {
+		timingMu.Lock()
+		defer timingMu.Unlock()
+		res := timings
+		timings = nil
+		return res
+	}
+}
+
+// recordTiming adds the time since start to the timing of the resource.
+func recordTiming(kind string, name string, start time.Time, dryrun bool) {
+	if dryrun {
+		return
+	}
+	d := time.Since(start)
+
+	timingMu.Lock()
+	defer timingMu.Unlock()
+
+	if timings == nil {
+		return
+	}
+	for i := range timings {
+		if timings[i].Kind == kind && timings[i].Name == name {
+			timings[i].Duration += d
+			return
+		}
+	}
+	timings = append(timings, Timing{Kind: kind, Name: name, Duration: d})
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"go.uber.org/multierr"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TunnelLink connects a namespace to a remote host with VXLAN or gretap. The
+// tunnel device is created on the host and moved into the namespace, so that
+// its underlay stays on the host.
+type TunnelLink struct {
+	Device Veth                `json:"device"`
+	Name   string              `json:"name"`
+	Tunnel config.TunnelConfig `json:"tunnel"`
+}
+
+func InitTunnelLink(cfg *config.LinkConfig, dryrun bool) (*TunnelLink, error) {
+	if cfg.LinkMode != config.ModeTunnel {
+		return nil, fmt.Errorf("invalid mode")
+	}
+	defer recordTiming(string(config.ModeTunnel), cfg.Name, time.Now(), dryrun)
+	ScriptComment("tunnel link %s", cfg.Name)
+
+	if cfg.Tunnel == nil {
+		return nil, fmt.Errorf("tunnel is not configured")
+	}
+
+	if err := RunIpLinkCreateTunnel(cfg.Name, cfg.Tunnel, dryrun); err != nil {
+		return nil, err
+	}
+
+	log.Infof("succeeded to create %s tunnel %s", cfg.Tunnel.Type, cfg.Name)
+
+	return &TunnelLink{
+		Device: Veth{Name: cfg.Name, Attached: false},
+		Name:   cfg.Name,
+		Tunnel: *cfg.Tunnel,
+	}, nil
+}
+
+func (t *TunnelLink) Destroy(dryrun bool) error {
+	// The device is deleted with the namespace.
+	if t.Device.Attached {
+		log.Infof("tunnel %s is invisible from host", t.Name)
+		return nil
+	}
+
+	if err := RunIpLinkDelete(t.Device.Name, dryrun); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to delete tunnel %s", t.Name)
+
+	return nil
+}
+
+func (t *TunnelLink) CreateLink(target *Namespace, dryrun bool) error {
+	defer observeDuration("create_tunnel_link", time.Now(), dryrun)
+	defer recordTiming(string(config.ModeTunnel), t.Name, time.Now(), dryrun)
+
+	if t.Device.Attached {
+		return Errorf(ErrDeviceAttached, "%s has been already busy", t.Name)
+	}
+
+	if err := target.Attach(&t.Device, dryrun); err != nil {
+		return err
+	}
+
+	incMetric(MetricLinksCreated, dryrun, map[string]string{"mode": string(config.ModeTunnel)})
+	return nil
+}
+
+func InitTunnelLinks(links []*config.LinkConfig, dryrun bool) (map[string]*TunnelLink, error) {
+	tunnels := make(map[string]*TunnelLink)
+	for _, link := range links {
+		if link.LinkMode != config.ModeTunnel {
+			continue
+		}
+
+		tunnel, err := InitTunnelLink(link, dryrun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tunnel link: %s: %w", link.Name, err)
+		}
+
+		tunnels[tunnel.Name] = tunnel
+	}
+
+	return tunnels, nil
+}
+
+func CleanupTunnelLinks(links map[string]*TunnelLink, dryrun bool) error {
+	var allerr error
+	for _, link := range links {
+		if err := link.Destroy(dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Network namespaces don't isolate hostnames, so the hostname is set in a
+// persistent UTS namespace bound to a file under this directory.
+const utsNamespaceDir = "/run/ayame/uts"
+
+func utsNamespacePath(nsname string) string {
+	return utsNamespaceDir + "/" + nsname
+}
+
+func CreateUtsNamespace(nsname string, hostname string, dryrun bool) error {
+	path := utsNamespacePath(nsname)
+	cmd := exec.Command("unshare", "--uts="+path, "hostname", hostname)
+	log.Infof("execute %s", cmd.String())
+
+	if dryrun {
+		// The file is created in Go, so the script creates it by itself.
+		scriptCommand(exec.Command("mkdir", "-p", utsNamespaceDir), false)
+		scriptCommand(exec.Command("touch", path), false)
+		auditPlannedCommand(cmd)
+		return nil
+	}
+
+	if err := os.MkdirAll(utsNamespaceDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", utsNamespaceDir, err)
+	}
+
+	// unshare requires the file to bind the namespace to.
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	f.Close()
+
+	if err := runCommand(cmd); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to set hostname %s of ns %s: %w", hostname, nsname, err)
+	}
+
+	return nil
+}
+
+func DeleteUtsNamespace(nsname string, dryrun bool) error {
+	path := utsNamespacePath(nsname)
+	cmd := exec.Command("umount", path)
+	log.Infof("execute %s", cmd.String())
+
+	if dryrun {
+		auditPlannedCommand(cmd)
+		scriptCommand(exec.Command("rm", "-f", path), false)
+		return nil
+	}
+
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to delete uts namespace of ns %s: %w", nsname, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -16,26 +16,40 @@ package network
 
 import (
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
 type VethConfig struct {
 	Name string `yaml:"name"`
+	// TxQueueLen is the txqueuelen of both ends. Zero leaves the default.
+	TxQueueLen uint `yaml:"txqueuelen"`
+	// Mtu is the MTU of both ends. Zero leaves the default.
+	Mtu uint `yaml:"mtu"`
+	// Description is set as the alias of both ends. Empty leaves no alias.
+	Description string `yaml:"description"`
 }
 
 type Veth struct {
 	Name     string `json:"name"`
 	Attached bool   `json:"attached"`
+	// Mtu is applied again after the veth is moved into a namespace, since the
+	// move may reset it.
+	Mtu uint `json:"mtu,omitempty"`
 }
 
 type VethPair struct {
-	Left  Veth `json:"veth_left"`
-	Right Veth `json:"veth_right"`
+	Left        Veth   `json:"veth_left"`
+	Right       Veth   `json:"veth_right"`
+	TxQueueLen  uint   `json:"txqueuelen,omitempty"`
+	Description string `json:"description,omitempty"`
 }
 
 func InitVethPair(config VethConfig, dryrun bool) (*VethPair, error) {
 	pair := &VethPair{
-		Left:  Veth{Name: config.Name + "-left", Attached: false},
-		Right: Veth{Name: config.Name + "-right", Attached: false},
+		Left:        Veth{Name: config.Name + "-left", Attached: false, Mtu: config.Mtu},
+		Right:       Veth{Name: config.Name + "-right", Attached: false, Mtu: config.Mtu},
+		TxQueueLen:  config.TxQueueLen,
+		Description: config.Description,
 	}
 
 	if err := pair.Create(dryrun); err != nil {
@@ -45,29 +59,100 @@ func InitVethPair(config VethConfig, dryrun bool) (*VethPair, error) {
 	return pair, nil
 }
 
+// Create creates the veth pair on the host. If the setup after the creation
+// fails, the pair is deleted again so that no stray device is left on the host.
 func (v *VethPair) Create(dryrun bool) error {
 	if err := RunIpLinkCreate(v.Left.Name, v.Right.Name, dryrun); err != nil {
 		return err
 	}
 
+	if err := v.setupInNamespaces("", "", dryrun); err != nil {
+		if derr := RunIpLinkDelete(v.Left.Name, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		return err
+	}
+
 	log.Infof("succeeded to create %s@%s", v.Left.Name, v.Right.Name)
 
 	return nil
 }
 
-func (v *VethPair) Destroy(dryrun bool) error {
-	deleted := false
+// CreateInNamespaces creates the veth pair whose ends are placed in the given
+// namespaces directly, so that they never live on the host. Both ends are moved
+// by the same command which creates them, so an interruption never leaves them
+// on the host. If the following setup fails, the pair is deleted again.
+func (v *VethPair) CreateInNamespaces(leftNs string, rightNs string, dryrun bool) error {
+	if err := RunIpLinkCreateInNamespaces(v.Left.Name, leftNs, v.Right.Name, rightNs, dryrun); err != nil {
+		return err
+	}
+
+	if err := v.setupInNamespaces(leftNs, rightNs, dryrun); err != nil {
+		// Deleting one end deletes the whole veth pair.
+		if derr := RunIpLinkDeleteInNamespace(v.Left.Name, leftNs, dryrun); derr != nil {
+			return multierr.Append(err, derr)
+		}
+		return err
+	}
+
+	log.Infof("succeeded to create %s@%s in ns %s@%s", v.Left.Name, v.Right.Name, leftNs, rightNs)
+
+	return nil
+}
 
-	if !v.Left.Attached {
-		if err := RunIpLinkDelete(v.Left.Name, dryrun); err != nil {
+// setupInNamespaces applies the attributes to the ends in the namespaces. The
+// ends are on the host if the namespaces are empty.
+func (v *VethPair) setupInNamespaces(leftNs string, rightNs string, dryrun bool) error {
+	if v.TxQueueLen != 0 {
+		if err := RunIpLinkSetTxQueueLen(v.Left.Name, leftNs, v.TxQueueLen, dryrun); err != nil {
+			return err
+		}
+		if err := RunIpLinkSetTxQueueLen(v.Right.Name, rightNs, v.TxQueueLen, dryrun); err != nil {
 			return err
 		}
+	}
 
-		deleted = true
+	for _, end := range []struct {
+		veth *Veth
+		ns   string
+	}{{&v.Left, leftNs}, {&v.Right, rightNs}} {
+		if end.veth.Mtu == 0 {
+			continue
+		}
+		if err := RunIpLinkSetMtu(end.veth.Name, end.ns, end.veth.Mtu, dryrun); err != nil {
+			return err
+		}
+	}
+
+	if v.Description != "" {
+		if err := RunIpLinkSetAlias(v.Left.Name, leftNs, v.Description, dryrun); err != nil {
+			return err
+		}
+		if err := RunIpLinkSetAlias(v.Right.Name, rightNs, v.Description, dryrun); err != nil {
+			return err
+		}
 	}
 
-	if !deleted && !v.Right.Attached {
-		if err := RunIpLinkDelete(v.Right.Name, dryrun); err != nil {
+	return nil
+}
+
+// Destroy deletes the veth pair from the host. A device which has already gone,
+// e.g. because the namespace it was in has been deleted, is treated as deleted.
+func (v *VethPair) Destroy(dryrun bool) error {
+	deleted := false
+
+	for _, veth := range []*Veth{&v.Left, &v.Right} {
+		if deleted || veth.Attached {
+			continue
+		}
+
+		if !CheckIpLinkExists(veth.Name, dryrun) {
+			log.Infof("%s doesn't exist", veth.Name)
+			deleted = true
+			continue
+		}
+
+		if err := RunIpLinkDelete(veth.Name, dryrun); err != nil {
 			return err
 		}
 
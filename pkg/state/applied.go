@@ -0,0 +1,182 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"net"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// IsApplied reports whether the config has been fully applied, i.e. the saved
+// state was created from the same namespaces and links, and all the namespaces,
+// the host side devices and the addresses exist in the kernel. It only reads
+// the state and the kernel, so it is cheaper than planning.
+func IsApplied(cfg *config.Config) (bool, error) {
+	s := LoadResources()
+	if s == nil {
+		return false, nil
+	}
+
+	if reason := s.mismatch(cfg); reason != "" {
+		log.Infof("config is not applied: %s", reason)
+		return false, nil
+	}
+
+	reason, err := s.missing(context.Background())
+	if err != nil {
+		return false, err
+	}
+	if reason != "" {
+		log.Infof("config is not applied: %s", reason)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// mismatch returns why the state wasn't created from the config, or empty.
+func (s *State) mismatch(cfg *config.Config) string {
+	if s.Prefix != cfg.Prefix {
+		return "prefix is changed"
+	}
+
+	links := 0
+	for _, link := range cfg.Links {
+		var ok bool
+		switch link.LinkMode {
+		case config.ModeDirectLink:
+			_, ok = s.DirectLinks[link.Name]
+		case config.ModeBridge:
+			_, ok = s.Bridges[link.Name]
+		case config.ModeTunnel:
+			_, ok = s.TunnelLinks[link.Name]
+		case config.ModeMacvlan:
+			_, ok = s.MacvlanLinks[link.Name]
+		}
+		if !ok {
+			return "link " + link.Name + " is not created"
+		}
+		links++
+	}
+	if links != len(s.DirectLinks)+len(s.Bridges)+len(s.TunnelLinks)+len(s.MacvlanLinks) {
+		return "links are removed"
+	}
+
+	if len(cfg.Namespaces) != len(s.Namespaces) {
+		return "namespaces are changed"
+	}
+	for _, nsCfg := range cfg.Namespaces {
+		ns := s.findNamespace(nsCfg.Name)
+		if ns == nil {
+			return "namespace " + nsCfg.Name + " is not created"
+		}
+		if len(nsCfg.Devices) != len(ns.RegisteredDeviceConfig) {
+			return "devices of namespace " + nsCfg.Name + " are changed"
+		}
+		for _, devCfg := range nsCfg.Devices {
+			found := false
+			for _, dev := range ns.RegisteredDeviceConfig {
+				if dev.Name != devCfg.Name || dev.LinkName() != devCfg.LinkName() {
+					continue
+				}
+				// The address of auto is allocated on creation.
+				if devCfg.Cidr != config.CidrAuto && devCfg.Cidr != dev.Cidr {
+					return "address of device " + devCfg.Name + " in namespace " + nsCfg.Name + " is changed"
+				}
+				found = len(dev.AttachedVeth) != 0
+			}
+			if !found {
+				return "device " + devCfg.Name + " in namespace " + nsCfg.Name + " is not attached"
+			}
+		}
+	}
+
+	return ""
+}
+
+// missing returns what in the state is absent from the kernel, or empty.
+func (s *State) missing(ctx context.Context) (string, error) {
+	nsnames, err := network.ListIpNetns()
+	if err != nil {
+		return "", err
+	}
+	exists := make(map[string]bool)
+	for _, name := range nsnames {
+		exists[name] = true
+	}
+
+	for _, ns := range s.Namespaces {
+		if !exists[ns.Name] {
+			return "namespace " + ns.Name + " doesn't exist", nil
+		}
+
+		ifaces, err := network.InspectAddrsInNamespace(ctx, ns.Name)
+		if err != nil {
+			return "", err
+		}
+		live := make(map[string][]network.LiveAddress)
+		for _, iface := range ifaces {
+			live[iface.Name] = iface.Addresses
+		}
+
+		for _, dev := range ns.RegisteredDeviceConfig {
+			addrs, ok := live[dev.AttachedVeth]
+			if !ok {
+				return "device " + dev.AttachedVeth + " doesn't exist in namespace " + ns.Name, nil
+			}
+			if dev.Cidr != "" && !hasAddress(addrs, dev.Cidr) {
+				return "address " + dev.Cidr + " doesn't exist on " + dev.AttachedVeth + " in namespace " + ns.Name, nil
+			}
+		}
+	}
+
+	for _, link := range s.DirectLinks {
+		if link.HostCidr != "" && !network.CheckIpLinkExists(link.Right.Name, false) {
+			return "device " + link.Right.Name + " doesn't exist on host", nil
+		}
+	}
+	for _, br := range s.Bridges {
+		if !network.CheckIpLinkExists(br.Name, false) {
+			return "bridge " + br.Name + " doesn't exist on host", nil
+		}
+	}
+
+	return "", nil
+}
+
+// hasAddress compares the addresses by value, since the kernel may format them
+// differently from the config, e.g. IPv6.
+func hasAddress(addrs []network.LiveAddress, cidr string) bool {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, _ := ipnet.Mask.Size()
+
+	for _, addr := range addrs {
+		lip, lnet, err := net.ParseCIDR(addr.Cidr)
+		if err != nil {
+			continue
+		}
+		if lones, _ := lnet.Mask.Size(); lip.Equal(ip) && lones == ones {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// PingConcurrency is the maximum number of pings running at the same time.
+var PingConcurrency = 8
+
+// ConnectivityMatrix is the reachability between every ordered pair of the
+// namespaces. Reachable[i][j] is true if Namespaces[j] replied to the ping from
+// Namespaces[i]. Namespaces without any address are never reachable.
+type ConnectivityMatrix struct {
+	Namespaces []string          `json:"namespaces"`
+	Reachable  [][]bool          `json:"reachable"`
+	Latencies  [][]time.Duration `json:"latencies"`
+}
+
+// ConnectivityMatrix pings the first address of every namespace from all the
+// other namespaces.
+func (s *State) ConnectivityMatrix(ctx context.Context) (*ConnectivityMatrix, error) {
+	return s.connectivityMatrix(ctx, PingConcurrency)
+}
+
+// ConnectivityMatrixWithOptions is ConnectivityMatrix configured by opts, whose
+// Concurrency limits the pings running at the same time.
+func (s *State) ConnectivityMatrixWithOptions(opts *network.Options) (*ConnectivityMatrix, error) {
+	defer opts.Apply()()
+	return s.connectivityMatrix(opts.Context, opts.Concurrency)
+}
+
+func (s *State) connectivityMatrix(ctx context.Context, limit int) (*ConnectivityMatrix, error) {
+	n := len(s.Namespaces)
+	matrix := &ConnectivityMatrix{
+		Namespaces: make([]string, n),
+		Reachable:  make([][]bool, n),
+		Latencies:  make([][]time.Duration, n),
+	}
+
+	addrs := make([]string, n)
+	for i, ns := range s.Namespaces {
+		matrix.Namespaces[i] = ns.Name
+		if s.Prefix != "" {
+			matrix.Namespaces[i] = strings.TrimPrefix(ns.Name, s.Prefix+"-")
+		}
+		matrix.Reachable[i] = make([]bool, n)
+		matrix.Latencies[i] = make([]time.Duration, n)
+		addrs[i] = firstAddr(ns)
+	}
+
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	for i := range s.Namespaces {
+		for j := range s.Namespaces {
+			if i == j || addrs[j] == "" {
+				continue
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return nil, ctx.Err()
+			}
+
+			wg.Add(1)
+			go func(i, j int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				rtt, err := network.Ping(ctx, s.Namespaces[i].Name, addrs[j])
+				if err != nil {
+					return
+				}
+				matrix.Reachable[i][j] = true
+				matrix.Latencies[i][j] = rtt
+			}(i, j)
+		}
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return matrix, nil
+}
+
+// Ping pings the first address of the namespace to from the namespace from,
+// which is the same probe as a cell of ConnectivityMatrix.
+func (s *State) Ping(ctx context.Context, from string, to string) (time.Duration, error) {
+	src := s.findNamespace(from)
+	if src == nil {
+		return 0, network.Errorf(network.ErrNotFound, "namespace %s is not found", from)
+	}
+	dst := s.findNamespace(to)
+	if dst == nil {
+		return 0, network.Errorf(network.ErrNotFound, "namespace %s is not found", to)
+	}
+
+	addr := firstAddr(dst)
+	if addr == "" {
+		return 0, network.Errorf(network.ErrInactive, "namespace %s has no address", to)
+	}
+	return network.Ping(ctx, src.Name, addr)
+}
+
+// firstAddr returns the first address of the attached devices in the
+// namespace, or empty if there is none.
+func firstAddr(ns *network.Namespace) string {
+	for _, dev := range ns.RegisteredDeviceConfig {
+		if ip, _, err := net.ParseCIDR(dev.Cidr); err == nil && len(dev.AttachedVeth) != 0 {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// Dump returns the grid whose rows are the sources and columns are the
+// destinations. Each cell is the latency or "x" if unreachable.
+func (m *ConnectivityMatrix) Dump() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+	fmt.Fprint(w, "FROM\\TO")
+	for _, name := range m.Namespaces {
+		fmt.Fprintf(w, "\t%s", name)
+	}
+	fmt.Fprintln(w)
+
+	for i, name := range m.Namespaces {
+		fmt.Fprint(w, name)
+		for j := range m.Namespaces {
+			switch {
+			case i == j:
+				fmt.Fprint(w, "\t-")
+			case m.Reachable[i][j]:
+				fmt.Fprintf(w, "\t%s", m.Latencies[i][j])
+			default:
+				fmt.Fprint(w, "\tx")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"go.uber.org/goleak"
+)
+
+// pingedState returns the state of n namespaces with an address each.
+func pingedState(n int) *State {
+	st := &State{}
+	for i := 1; i <= n; i++ {
+		st.Namespaces = append(st.Namespaces, &network.Namespace{
+			Name: fmt.Sprintf("ns%d", i),
+			RegisteredDeviceConfig: []network.RegisteredDeviceConfig{
+				{
+					NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "br0", Cidr: fmt.Sprintf("10.0.0.%d/24", i)},
+					AttachedVeth:          fmt.Sprintf("br0-%d-left", i),
+				},
+			},
+		})
+	}
+	return st
+}
+
+// The pings run in parallel, but none of them outlives ConnectivityMatrix even
+// if it is canceled.
+func TestConnectivityMatrixLeaksNoGoroutine(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pinged := make(chan struct{}, 1)
+	ping := func(cmd *exec.Cmd) ([]byte, error) {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+			return []byte("64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=0.042 ms"), nil
+		}
+	}
+	opts := network.NewOptions(network.WithRunner(ping), network.WithVerbose(false), network.WithConcurrency(2))
+
+	matrix, err := pingedState(3).ConnectivityMatrixWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matrix.Reachable[0][1] {
+		t.Errorf("ns2 is unreachable from ns1: %v", matrix.Reachable)
+	}
+
+	go func() {
+		<-pinged
+		cancel()
+	}()
+	opts.Context = ctx
+	if _, err := pingedState(8).ConnectivityMatrixWithOptions(opts); err == nil {
+		t.Error("canceled matrix succeeded")
+	}
+}
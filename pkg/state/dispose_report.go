@@ -0,0 +1,92 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// DisposeKindNamespace is the kind of namespaces in DisposeItem. Links use
+// their link mode as the kind.
+const DisposeKindNamespace = "namespace"
+
+// DisposeKindPort is the kind of the port mappings in DisposeItem, whose name
+// is the host port.
+const DisposeKindPort = "port"
+
+type DisposeStatus string
+
+const (
+	DisposeDeleted DisposeStatus = "deleted"
+	DisposeFailed  DisposeStatus = "failed"
+	// DisposeSkipped is the resource which hasn't been tried, e.g. because the
+	// context is done. It is kept in the state as the failed ones.
+	DisposeSkipped DisposeStatus = "skipped"
+)
+
+// DisposeItem is the outcome of disposing a resource.
+type DisposeItem struct {
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	Status DisposeStatus `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	// Duration is the time spent on deleting the resource. It is zero unless
+	// deleted.
+	Duration time.Duration `json:"duration_ns,omitempty"`
+}
+
+// DisposeReport lists the outcome of every resource in the order of disposal.
+type DisposeReport struct {
+	Items []DisposeItem `json:"items"`
+}
+
+func (r *DisposeReport) add(kind string, name string, status DisposeStatus, err error) {
+	item := DisposeItem{Kind: kind, Name: name, Status: status}
+	if err != nil {
+		item.Error = err.Error()
+	}
+	r.Items = append(r.Items, item)
+}
+
+// Remaining returns the items which haven't been deleted. They are kept in the
+// state, so disposing again retries only them.
+func (r *DisposeReport) Remaining() []DisposeItem {
+	var items []DisposeItem
+	for _, item := range r.Items {
+		if item.Status != DisposeDeleted {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Dump renders one row per resource.
+func (r *DisposeReport) Dump() (string, error) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tSTATUS\tDURATION\tERROR")
+	for _, item := range r.Items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.Kind, item.Name, item.Status, item.Duration, item.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
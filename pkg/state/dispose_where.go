@@ -0,0 +1,248 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"go.uber.org/multierr"
+)
+
+// DisposePlanned is the resource which would be deleted by DisposeWhere in
+// dry-run.
+const DisposePlanned DisposeStatus = "planned"
+
+// DisposeWhere deletes the namespaces with all the labels of the selector, the
+// links used only by them and their port mappings, e.g. to clean up one test
+// run on a shared host. Nothing is deleted if a link is shared with a namespace
+// not selected, since deleting either would break the other. The state is
+// saved afterwards, or removed if nothing remains. In dry-run the resources to
+// be deleted are reported as planned.
+func (s *State) DisposeWhere(ctx context.Context, selector map[string]string, dryrun bool) (*DisposeReport, error) {
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("selector must not be empty: dispose all the resources instead")
+	}
+
+	var report *DisposeReport
+	err := s.Do(func(s *State) error {
+		sub, err := s.selectResources(selector)
+		if err != nil {
+			return err
+		}
+
+		report = &DisposeReport{Items: []DisposeItem{}}
+		if dryrun {
+			sub.planDispose(report)
+			return nil
+		}
+
+		steps := sub.TeardownOrder()
+		derr := sub.dispose(ctx, report)
+		s.forgetDisposed(steps, sub)
+
+		if err := s.save(); err != nil {
+			return multierr.Append(derr, err)
+		}
+		return derr
+	})
+	return report, err
+}
+
+// selectResources returns the state of the selected namespaces, the links
+// used only by them and their port mappings.
+func (s *State) selectResources(selector map[string]string) (*State, error) {
+	matched := s.NamespacesWithLabels(selector)
+	if len(matched) == 0 {
+		return nil, network.Errorf(network.ErrNotFound, "no namespace matches the selector")
+	}
+
+	return s.subsetOf(matched)
+}
+
+// subsetOf returns the state of the namespaces, the links used only by them and
+// their port mappings. It is an error if a link is shared with the others.
+func (s *State) subsetOf(matched []*network.Namespace) (*State, error) {
+	selected := make(map[string]bool)
+	for _, ns := range matched {
+		selected[ns.Name] = true
+	}
+
+	// users maps the links to the namespaces having the devices on them.
+	users := make(map[string][]string)
+	for _, ns := range s.Namespaces {
+		for _, dev := range ns.RegisteredDeviceConfig {
+			users[dev.LinkName()] = append(users[dev.LinkName()], ns.Name)
+		}
+	}
+
+	// owned returns whether the link is used only by the selected namespaces.
+	owned := func(link string) (bool, error) {
+		own, shared := false, ""
+		for _, user := range users[link] {
+			if selected[user] {
+				own = true
+			} else {
+				shared = user
+			}
+		}
+		if own && shared != "" {
+			return false, fmt.Errorf("link %s is shared with namespace %s which isn't selected", link, shared)
+		}
+		return own, nil
+	}
+
+	sub := &State{
+		Prefix:       s.Prefix,
+		DirectLinks:  make(map[string]*network.DirectLink),
+		Bridges:      make(map[string]*network.Bridge),
+		TunnelLinks:  make(map[string]*network.TunnelLink),
+		MacvlanLinks: make(map[string]*network.MacvlanLink),
+		Namespaces:   matched,
+	}
+
+	var err error
+	pick := func(name string, add func()) {
+		if err != nil {
+			return
+		}
+		var own bool
+		if own, err = owned(name); own {
+			add()
+		}
+	}
+	for _, name := range sortedKeys(s.DirectLinks) {
+		name := name
+		pick(name, func() { sub.DirectLinks[name] = s.DirectLinks[name] })
+	}
+	for _, name := range sortedKeys(s.Bridges) {
+		name := name
+		pick(name, func() { sub.Bridges[name] = s.Bridges[name] })
+	}
+	for _, name := range sortedKeys(s.TunnelLinks) {
+		name := name
+		pick(name, func() { sub.TunnelLinks[name] = s.TunnelLinks[name] })
+	}
+	for _, name := range sortedKeys(s.MacvlanLinks) {
+		name := name
+		pick(name, func() { sub.MacvlanLinks[name] = s.MacvlanLinks[name] })
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range s.PortMappings {
+		if selected[m.Namespace] {
+			sub.PortMappings = append(sub.PortMappings, m)
+		}
+	}
+
+	return sub, nil
+}
+
+// forgetDisposed removes the resources of the steps which have been deleted
+// by the dispose of sub, i.e. the ones which sub no longer has. The port
+// mappings of sub are replaced with the ones which failed to stop.
+func (s *State) forgetDisposed(steps []TeardownStep, sub *State) {
+	deleted := make(map[string]bool)
+	for _, step := range steps {
+		switch step.Kind {
+		case string(config.ModeDirectLink):
+			if _, ok := sub.DirectLinks[step.Name]; !ok {
+				delete(s.DirectLinks, step.Name)
+			}
+		case string(config.ModeBridge):
+			if _, ok := sub.Bridges[step.Name]; !ok {
+				delete(s.Bridges, step.Name)
+			}
+		case string(config.ModeTunnel):
+			if _, ok := sub.TunnelLinks[step.Name]; !ok {
+				delete(s.TunnelLinks, step.Name)
+			}
+		case string(config.ModeMacvlan):
+			if _, ok := sub.MacvlanLinks[step.Name]; !ok {
+				delete(s.MacvlanLinks, step.Name)
+			}
+		case DisposeKindNamespace:
+			deleted[step.Name] = sub.findNamespace(step.Name) == nil
+		}
+	}
+
+	var namespaces []*network.Namespace
+	for _, ns := range s.Namespaces {
+		if !deleted[ns.Name] {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	s.Namespaces = namespaces
+
+	ports := sub.PortMappings
+	for _, m := range s.PortMappings {
+		if _, ok := deleted[m.Namespace]; !ok {
+			ports = append(ports, m)
+		}
+	}
+	s.PortMappings = ports
+}
+
+// merge adds the resources of other to s.
+func (s *State) merge(other *State) {
+	if s.DirectLinks == nil {
+		s.DirectLinks = make(map[string]*network.DirectLink)
+	}
+	for name, link := range other.DirectLinks {
+		s.DirectLinks[name] = link
+	}
+	if s.Bridges == nil {
+		s.Bridges = make(map[string]*network.Bridge)
+	}
+	for name, br := range other.Bridges {
+		s.Bridges[name] = br
+	}
+	if s.TunnelLinks == nil {
+		s.TunnelLinks = make(map[string]*network.TunnelLink)
+	}
+	for name, tunnel := range other.TunnelLinks {
+		s.TunnelLinks[name] = tunnel
+	}
+	if s.MacvlanLinks == nil {
+		s.MacvlanLinks = make(map[string]*network.MacvlanLink)
+	}
+	for name, macvlan := range other.MacvlanLinks {
+		s.MacvlanLinks[name] = macvlan
+	}
+	s.Namespaces = append(s.Namespaces, other.Namespaces...)
+	s.Timings = append(s.Timings, other.Timings...)
+	s.PortMappings = append(s.PortMappings, other.PortMappings...)
+}
+
+// empty returns whether the state has no resource.
+func (s *State) empty() bool {
+	return len(s.DirectLinks) == 0 && len(s.Bridges) == 0 && len(s.TunnelLinks) == 0 &&
+		len(s.MacvlanLinks) == 0 && len(s.Namespaces) == 0 && len(s.PortMappings) == 0
+}
+
+// planDispose reports all the resources which dispose would delete as planned,
+// without deleting them.
+func (s *State) planDispose(report *DisposeReport) {
+	for _, m := range s.PortMappings {
+		report.add(DisposeKindPort, fmt.Sprint(m.HostPort), DisposePlanned, nil)
+	}
+	for _, step := range s.TeardownOrder() {
+		report.add(step.Kind, step.Name, DisposePlanned, nil)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+	OutputTable = "table"
+)
+
+// OutputFormats are all the formats supported by Encode of the reports.
+var OutputFormats = []string{OutputJSON, OutputYAML, OutputTable}
+
+// ValidOutputFormat returns an error if the format isn't one of OutputFormats.
+func ValidOutputFormat(format string) error {
+	for _, f := range OutputFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q: valid formats are %s", format, strings.Join(OutputFormats, ", "))
+}
+
+// encode writes v in the format. The YAML keys are the same as the JSON ones
+// since v is converted from its JSON form. table renders the human readable
+// form.
+func encode(w io.Writer, format string, v interface{}, table func() (string, error)) error {
+	if err := ValidOutputFormat(format); err != nil {
+		return err
+	}
+
+	if format == OutputTable {
+		s, err := table()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, strings.TrimSuffix(s, "\n"))
+		return err
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if format == OutputJSON {
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	// JSON is YAML, and MapSlice keeps the order of the fields.
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	b, err = yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Encode writes the report in the format. The table has one row per device.
+func (r *Report) Encode(w io.Writer, format string) error {
+	return encode(w, format, r, r.dumpTable)
+}
+
+func (r *Report) dumpTable() (string, error) {
+	var buf strings.Builder
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tLINK\tINTERFACE\tCIDR")
+	for _, ns := range r.Namespaces {
+		for _, dev := range ns.Devices {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ns.Name, dev.Link, dev.Interface, dev.Cidr)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Encode writes the report in the format. The table is the same as Dump.
+func (r *DisposeReport) Encode(w io.Writer, format string) error {
+	return encode(w, format, r, r.Dump)
+}
+
+// Encode writes the matrix in the format. The table is the same as Dump.
+func (m *ConnectivityMatrix) Encode(w io.Writer, format string) error {
+	return encode(w, format, m, func() (string, error) {
+		return m.Dump(), nil
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// bridgePortSuffix matches what follows "<bridge>-" in the names of the veths
+// attached to namespaces from the bridge.
+var bridgePortSuffix = regexp.MustCompile(`^[0-9]+-left$`)
+
+// Import builds a state from the namespaces which already exist on the host.
+// Link modes can't be inferred from the kernel, so devices are classified with
+// the given hints by matching their names exactly to the veth names of the
+// links, like Attach does. Devices which can't be classified are logged and
+// skipped, and so are the namespaces without any classified device, e.g. the
+// ones of other tools, so that they are never deleted by ayame.
+func Import(hints []*config.LinkConfig) (*State, error) {
+	if ResourcesSaved() {
+		return nil, network.Errorf(network.ErrAlreadyActive, "resources have already existed.")
+	}
+
+	nsnames, err := network.ListIpNetns()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{
+		DirectLinks: make(map[string]*network.DirectLink),
+		Bridges:     make(map[string]*network.Bridge),
+	}
+
+	findHint := func(ifname string) *config.LinkConfig {
+		for _, hint := range hints {
+			switch hint.LinkMode {
+			case config.ModeDirectLink:
+				if ifname == hint.Name+"-left" || ifname == hint.Name+"-right" {
+					return hint
+				}
+			case config.ModeBridge:
+				if strings.HasPrefix(ifname, hint.Name+"-") && bridgePortSuffix.MatchString(strings.TrimPrefix(ifname, hint.Name+"-")) {
+					return hint
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, nsname := range nsnames {
+		ifnames, err := network.ListIpLinksInNamespace(nsname)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := network.ListIpAddrsInNamespace(nsname)
+		if err != nil {
+			return nil, err
+		}
+
+		ns := &network.Namespace{Name: nsname}
+
+		for _, ifname := range ifnames {
+			if ifname == "lo" {
+				continue
+			}
+
+			hint := findHint(ifname)
+			if hint == nil {
+				log.Warnf("couldn't classify device %s in ns %s", ifname, nsname)
+				continue
+			}
+
+			switch hint.LinkMode {
+			case config.ModeDirectLink:
+				dlink, ok := state.DirectLinks[hint.Name]
+				if !ok {
+					dlink = &network.DirectLink{
+						VethPair: network.VethPair{
+							Left:  network.Veth{Name: hint.Name + "-left"},
+							Right: network.Veth{Name: hint.Name + "-right"},
+						},
+						Name: hint.Name,
+					}
+				}
+
+				if ifname == dlink.Left.Name {
+					dlink.Left.Attached = true
+				} else {
+					dlink.Right.Attached = true
+				}
+
+				state.DirectLinks[hint.Name] = dlink
+			case config.ModeBridge:
+				br, ok := state.Bridges[hint.Name]
+				if !ok {
+					br = &network.Bridge{Name: hint.Name}
+				}
+
+				br.VethPairs = append(br.VethPairs, &network.VethPair{
+					Left:  network.Veth{Name: ifname, Attached: true},
+					Right: network.Veth{Name: strings.TrimSuffix(ifname, "-left") + "-right", Attached: true},
+				})
+
+				state.Bridges[hint.Name] = br
+			}
+
+			devCfg := network.RegisteredDeviceConfig{AttachedVeth: ifname}
+			devCfg.Name = hint.Name
+			if cidrs := addrs[ifname]; len(cidrs) != 0 {
+				devCfg.Cidr = cidrs[0]
+			}
+			ns.RegisteredDeviceConfig = append(ns.RegisteredDeviceConfig, devCfg)
+		}
+
+		if len(ns.RegisteredDeviceConfig) == 0 {
+			log.Warnf("skip ns %s without any device of the links", nsname)
+			continue
+		}
+
+		log.Infof("imported ns %s", nsname)
+		state.Namespaces = append(state.Namespaces, ns)
+	}
+
+	return state, nil
+}
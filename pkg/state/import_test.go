@@ -0,0 +1,67 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+func TestImportOnlyClassifiedNamespaces(t *testing.T) {
+	withTempHome(t)
+
+	links := map[string]string{
+		"ns1":     "1: lo: <LOOPBACK,UP>\n2: veth1-left@if3: <BROADCAST,UP>\n3: veth10-left@if5: <BROADCAST,UP>\n",
+		"ns2":     "1: lo: <LOOPBACK,UP>\n2: veth1-right@if2: <BROADCAST,UP>\n3: br1-1-left@if7: <BROADCAST,UP>\n",
+		"cni-abc": "1: lo: <LOOPBACK,UP>\n2: eth0@if9: <BROADCAST,UP>\n",
+		"ns3":     "1: lo: <LOOPBACK,UP>\n2: veth12-right@if4: <BROADCAST,UP>\n",
+	}
+	run := func(cmd *exec.Cmd) ([]byte, error) {
+		args := strings.Join(cmd.Args[1:], " ")
+		if args == "netns list" {
+			return []byte("ns1\nns2\ncni-abc (id: 0)\nns3\n"), nil
+		}
+		if strings.HasSuffix(args, "-o link show") {
+			return []byte(links[cmd.Args[3]]), nil
+		}
+		return nil, nil
+	}
+	defer network.NewOptions(network.WithRunner(run), network.WithVerbose(false)).Apply()()
+
+	st, err := Import([]*config.LinkConfig{
+		{Name: "veth1", LinkMode: config.ModeDirectLink},
+		{Name: "br1", LinkMode: config.ModeBridge},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(st.Namespaces) != 2 || st.Namespaces[0].Name != "ns1" || st.Namespaces[1].Name != "ns2" {
+		t.Fatalf("unexpected namespaces are imported: %+v", st.Namespaces)
+	}
+	if devs := st.Namespaces[0].RegisteredDeviceConfig; len(devs) != 1 || devs[0].AttachedVeth != "veth1-left" {
+		t.Errorf("veth10-left is classified as veth1: %+v", devs)
+	}
+	if link := st.DirectLinks["veth1"]; link == nil || !link.Left.Attached || !link.Right.Attached {
+		t.Errorf("direct link isn't imported: %+v", st.DirectLinks)
+	}
+	if br := st.Bridges["br1"]; br == nil || len(br.VethPairs) != 1 || br.VethPairs[0].Right.Name != "br1-1-right" {
+		t.Errorf("bridge isn't imported: %+v", st.Bridges)
+	}
+}
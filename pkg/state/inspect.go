@@ -0,0 +1,92 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// NamespaceInspection is the live view of the namespace captured from the
+// kernel, as opposed to the intended one saved in the state.
+type NamespaceInspection struct {
+	Name       string                  `json:"name"`
+	Interfaces []network.LiveInterface `json:"interfaces"`
+	Routes     []network.LiveRoute     `json:"routes"`
+}
+
+// Inspect captures the addresses and the routes of every namespace in the state
+// from the kernel. Names are the names on the host, i.e. with the prefix.
+func (s *State) Inspect(ctx context.Context) ([]NamespaceInspection, error) {
+	inspections := []NamespaceInspection{}
+	for _, ns := range s.Namespaces {
+		ifaces, err := network.InspectAddrsInNamespace(ctx, ns.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		routes, err := network.InspectRoutesInNamespace(ctx, ns.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		inspections = append(inspections, NamespaceInspection{
+			Name:       ns.Name,
+			Interfaces: ifaces,
+			Routes:     routes,
+		})
+	}
+
+	return inspections, nil
+}
+
+// VethPeer finds the other end of the veth attached to the device in the
+// namespace, on the host or in the other namespaces.
+func (s *State) VethPeer(ctx context.Context, namespace string, device string) (*network.VethPeer, error) {
+	ns := s.findNamespace(namespace)
+	if ns == nil {
+		return nil, network.Errorf(network.ErrNotFound, "namespace %s is not found", namespace)
+	}
+
+	ifname := ""
+	for _, dev := range ns.RegisteredDeviceConfig {
+		if dev.Name == device {
+			ifname = dev.AttachedVeth
+		}
+	}
+	if ifname == "" {
+		return nil, network.Errorf(network.ErrInactive, "device %s is not attached to namespace %s", device, namespace)
+	}
+
+	candidates := []string{""}
+	for _, other := range s.Namespaces {
+		if other.Name != namespace {
+			candidates = append(candidates, other.Name)
+		}
+	}
+
+	return network.InspectVethPeer(ctx, ns.Name, ifname, candidates)
+}
+
+// DumpInspection formats the result of Inspect as JSON.
+func DumpInspection(inspections []NamespaceInspection) (string, error) {
+	b, err := json.MarshalIndent(inspections, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// ParseLabelSelector parses the comma separated key=value pairs, e.g.
+// "owner=alice,run=42". An empty selector matches every namespace.
+func ParseLabelSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if selector == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(selector, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label selector %q: must be key=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
+
+// NamespacesWithLabels returns the namespaces which have all the labels of the
+// selector, in the order of the state.
+func (s *State) NamespacesWithLabels(selector map[string]string) []*network.Namespace {
+	var matched []*network.Namespace
+	for _, ns := range s.Namespaces {
+		if hasLabels(ns, selector) {
+			matched = append(matched, ns)
+		}
+	}
+	return matched
+}
+
+func hasLabels(ns *network.Namespace, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := ns.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectNamespaces drops the namespaces without all the labels of the selector
+// from the report.
+func (r *Report) SelectNamespaces(selector map[string]string) {
+	selected := []NamespaceReport{}
+	for _, ns := range r.Namespaces {
+		if hasLabels(&network.Namespace{Labels: ns.Labels}, selector) {
+			selected = append(selected, ns)
+		}
+	}
+	r.Namespaces = selected
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+)
+
+// mermaidHost is the node of the host end of direct links with host_cidr.
+const mermaidHost = "host"
+
+// ToMermaid renders the topology as a fenced Mermaid flowchart which can be
+// pasted into Markdown. Namespaces are nodes and direct links are labeled
+// edges between them. Bridges, tunnels and macvlans are nodes of their own
+// shape connected to the namespaces. The names are logical names and every
+// list is sorted so that the output is stable.
+func (s *State) ToMermaid() (string, error) {
+	report, err := s.Report()
+	if err != nil {
+		return "", err
+	}
+
+	namespaces := make([]NamespaceReport, len(report.Namespaces))
+	copy(namespaces, report.Namespaces)
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+
+	// Node IDs are generated since names may contain characters, e.g. '-',
+	// which Mermaid doesn't accept as IDs.
+	ids := make(map[string]string)
+	users := make(map[string][]string)
+
+	var b strings.Builder
+	b.WriteString("```mermaid\ngraph LR\n")
+
+	for i, ns := range namespaces {
+		id := fmt.Sprintf("ns%d", i)
+		ids[ns.Name] = id
+		fmt.Fprintf(&b, "  %s[%q]\n", id, ns.Name)
+		for _, dev := range ns.Devices {
+			users[dev.Link] = append(users[dev.Link], id)
+		}
+	}
+
+	var edges, bridges []string
+	hostUsed := false
+	for i, link := range report.Links {
+		id := fmt.Sprintf("link%d", i)
+		switch link.Mode {
+		case config.ModeDirectLink:
+			ends := users[link.Name]
+			switch len(ends) {
+			case 2:
+				edges = append(edges, fmt.Sprintf("  %s ---|%q| %s", ends[0], link.Name, ends[1]))
+			case 1:
+				hostUsed = true
+				edges = append(edges, fmt.Sprintf("  %s ---|%q| %s", ends[0], link.Name, mermaidHost))
+			}
+			continue
+		case config.ModeBridge:
+			fmt.Fprintf(&b, "  %s{{%q}}\n", id, link.Name)
+			bridges = append(bridges, id)
+		default:
+			fmt.Fprintf(&b, "  %s([%q])\n", id, string(link.Mode)+": "+link.Name)
+		}
+		for _, end := range users[link.Name] {
+			edges = append(edges, fmt.Sprintf("  %s --- %s", end, id))
+		}
+	}
+
+	if hostUsed {
+		fmt.Fprintf(&b, "  %s[(%q)]\n", mermaidHost, mermaidHost)
+	}
+	for _, edge := range edges {
+		b.WriteString(edge + "\n")
+	}
+	if len(bridges) != 0 {
+		b.WriteString("  classDef bridge fill:#eef,stroke:#336\n")
+		fmt.Fprintf(&b, "  class %s bridge\n", strings.Join(bridges, ","))
+	}
+
+	b.WriteString("```")
+	return b.String(), nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// stateMigrations upgrade the raw state file of the version, i.e. the key, to
+// the next version in place, e.g. by renaming the keys or filling defaults. A
+// migration must be registered here whenever StateVersion is bumped.
+var stateMigrations = map[int]func(raw map[string]interface{}) error{}
+
+// migrateState upgrades the state file saved by an older version to
+// StateVersion. It reports whether anything was migrated, so that the caller
+// can save the state in the new format. The files saved before versioning are
+// regarded as version 1, and are always reported as migrated to be saved again
+// with the checksum.
+func migrateState(b []byte) ([]byte, bool, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, false, err
+	}
+
+	version := 1
+	v, ok := raw["version"].(float64)
+	versioned := ok && v != 0
+	if versioned {
+		version = int(v)
+	}
+	if version >= StateVersion {
+		return b, !versioned, nil
+	}
+
+	for v := version; v < StateVersion; v++ {
+		migrate, ok := stateMigrations[v]
+		if !ok {
+			return nil, false, fmt.Errorf("no migration of state from version %d", v)
+		}
+		if err := migrate(raw); err != nil {
+			return nil, false, fmt.Errorf("failed to migrate state from version %d: %w", v, err)
+		}
+	}
+
+	// The checksum of the old format can't be verified anymore.
+	raw["version"] = StateVersion
+	delete(raw, "checksum")
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return migrated, true, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadFixture saves the fixture as the state and loads it.
+func loadFixture(t *testing.T, name string) (*State, string) {
+	t.Helper()
+
+	raw, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeState(t, withTempHome(t), raw)
+
+	st := LoadResources()
+	if st == nil {
+		t.Fatalf("%s can't be loaded", name)
+	}
+	return st, path
+}
+
+// savedVersion returns the version and the checksum of the state file.
+func savedVersion(t *testing.T, path string) (int, string) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved State
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved.Version, saved.Checksum
+}
+
+func TestLoadUnversionedState(t *testing.T) {
+	st, path := loadFixture(t, "state_unversioned.json")
+
+	if len(st.Namespaces) != 2 || st.Namespaces[1].RegisteredDeviceConfig[0].AttachedVeth != "veth1-right" {
+		t.Errorf("namespaces aren't loaded: %+v", st.Namespaces)
+	}
+	if link := st.DirectLinks["veth1"]; link == nil || !link.Left.Attached {
+		t.Errorf("links aren't loaded: %+v", st.DirectLinks)
+	}
+
+	// The files saved before versioning have no checksum, so they are saved
+	// again with the checksum on load.
+	version, checksum := savedVersion(t, path)
+	if version != StateVersion || checksum == "" {
+		t.Errorf("state is saved with version %d and checksum %q", version, checksum)
+	}
+	if LoadResources() == nil {
+		t.Error("saved state can't be loaded")
+	}
+}
+
+func TestLoadStateWithoutChecksum(t *testing.T) {
+	home := withTempHome(t)
+	if err := attachedState().SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(home, stateDirName, stateFileName)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	delete(raw, "checksum")
+	if b, err = json.Marshal(raw); err != nil {
+		t.Fatal(err)
+	}
+	writeState(t, home, b)
+
+	if st := LoadResources(); st != nil {
+		t.Errorf("state without the checksum is loaded: %+v", st)
+	}
+}
+
+func TestLoadStateUnderFutureVersion(t *testing.T) {
+	prevVersion := StateVersion
+	StateVersion = prevVersion + 1
+	stateMigrations[prevVersion] = func(raw map[string]interface{}) error {
+		if _, ok := raw["prefix"]; !ok {
+			raw["prefix"] = "lab"
+		}
+		return nil
+	}
+	defer func() {
+		StateVersion = prevVersion
+		delete(stateMigrations, prevVersion)
+	}()
+
+	st, path := loadFixture(t, "state_unversioned.json")
+
+	if st.Prefix != "lab" {
+		t.Errorf("default isn't filled by the migration: %q", st.Prefix)
+	}
+	if len(st.Namespaces) != 2 {
+		t.Errorf("namespaces aren't loaded: %+v", st.Namespaces)
+	}
+	if version, _ := savedVersion(t, path); version != StateVersion {
+		t.Errorf("state is saved with version %d, want %d", version, StateVersion)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"strings"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var (
+	// WarnOrphansOnDispose makes DisposeResources warn about the resources on
+	// the host with the prefix of the state which no state tracks, e.g. because
+	// the state file is stale.
+	WarnOrphansOnDispose = false
+	// CleanOrphansOnDispose makes DisposeResources delete them too. Without a
+	// prefix they are only warned about, since namespaces of other tools can't
+	// be told apart.
+	CleanOrphansOnDispose = false
+)
+
+// DisposeKindOrphan is the kind of the orphaned resources in DisposeItem.
+const DisposeKindOrphan = "orphan"
+
+// Orphans are resources which exist on the host but aren't tracked by the state.
+type Orphans struct {
+	Namespaces []*network.Namespace `json:"namespaces"`
+	Veths      []*network.Veth      `json:"veths"`
+}
+
+// FindOrphans lists namespaces and host veths which follow the naming convention
+// of ayame, i.e. start with the prefix and veths end with -left or -right, but
+// are absent from the saved state.
+func FindOrphans(prefix string) (*Orphans, error) {
+	// Resources of all the profiles are known, not only the active one's.
+	states, err := loadAllStates()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, s := range states {
+		for _, ns := range s.Namespaces {
+			known[ns.Name] = true
+		}
+		for _, link := range s.DirectLinks {
+			known[link.Left.Name] = true
+			known[link.Right.Name] = true
+		}
+		for _, tunnel := range s.TunnelLinks {
+			known[tunnel.Device.Name] = true
+		}
+		for _, macvlan := range s.MacvlanLinks {
+			for _, dev := range macvlan.Devices {
+				known[dev.Name] = true
+			}
+		}
+		for _, br := range s.Bridges {
+			for _, pair := range br.VethPairs {
+				known[pair.Left.Name] = true
+				known[pair.Right.Name] = true
+			}
+		}
+	}
+
+	matchPrefix := func(name string) bool {
+		return prefix == "" || strings.HasPrefix(name, prefix+"-")
+	}
+
+	nsnames, err := network.ListIpNetns()
+	if err != nil {
+		return nil, err
+	}
+
+	ifnames, err := network.ListIpLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := &Orphans{}
+
+	for _, nsname := range nsnames {
+		if known[nsname] || !matchPrefix(nsname) {
+			continue
+		}
+		orphans.Namespaces = append(orphans.Namespaces, &network.Namespace{Name: nsname})
+	}
+
+	for _, ifname := range ifnames {
+		if known[ifname] || !matchPrefix(ifname) {
+			continue
+		}
+		if !strings.HasSuffix(ifname, "-left") && !strings.HasSuffix(ifname, "-right") {
+			continue
+		}
+		orphans.Veths = append(orphans.Veths, &network.Veth{Name: ifname})
+	}
+
+	return orphans, nil
+}
+
+// Cleanup deletes all the orphaned resources.
+func (o *Orphans) Cleanup(dryrun bool) error {
+	var allerr error
+	deleted := make(map[string]bool)
+	for _, veth := range o.Veths {
+		// Deleting one end deletes its peer too.
+		if deleted[vethPairName(veth.Name)] {
+			continue
+		}
+		deleted[vethPairName(veth.Name)] = true
+
+		if err := network.RunIpLinkDelete(veth.Name, dryrun); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+
+	if err := network.CleanupNamespaces(o.Namespaces, dryrun); err != nil {
+		allerr = multierr.Append(allerr, err)
+	}
+
+	return allerr
+}
+
+func vethPairName(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, "-left"), "-right")
+}
+
+// disposeOrphans warns about the orphans with the prefix of the state after
+// the state has been disposed, and deletes them with CleanOrphansOnDispose.
+// The deletions are recorded in the report.
+func (s *State) disposeOrphans(report *DisposeReport) error {
+	orphans, err := FindOrphans(s.Prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range orphans.Namespaces {
+		log.Warnf("namespace %s exists on the host but isn't tracked by any state", ns.Name)
+	}
+	for _, veth := range orphans.Veths {
+		log.Warnf("veth %s exists on the host but isn't tracked by any state", veth.Name)
+	}
+
+	if !CleanOrphansOnDispose {
+		return nil
+	}
+	if s.Prefix == "" {
+		log.Warnf("orphans are not deleted without prefix")
+		return nil
+	}
+
+	var allerr error
+	deleted := make(map[string]bool)
+	for _, veth := range orphans.Veths {
+		if deleted[vethPairName(veth.Name)] {
+			continue
+		}
+		deleted[vethPairName(veth.Name)] = true
+
+		if err := network.RunIpLinkDelete(veth.Name, false); err != nil {
+			report.add(DisposeKindOrphan, veth.Name, DisposeFailed, err)
+			allerr = multierr.Append(allerr, network.WithResource(err, DisposeKindOrphan+"/"+veth.Name))
+			continue
+		}
+		report.add(DisposeKindOrphan, veth.Name, DisposeDeleted, nil)
+	}
+
+	for _, ns := range orphans.Namespaces {
+		if err := ns.Destroy(false); err != nil {
+			report.add(DisposeKindOrphan, ns.Name, DisposeFailed, err)
+			allerr = multierr.Append(allerr, network.WithResource(err, DisposeKindOrphan+"/"+ns.Name))
+			continue
+		}
+		report.add(DisposeKindOrphan, ns.Name, DisposeDeleted, nil)
+	}
+
+	return allerr
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"github.com/Shikugawa/ayame/pkg/network"
+	"go.uber.org/multierr"
+)
+
+// PauseLinks severs all the connectivity by setting the devices in every
+// namespace down, while the namespaces and the processes in them are kept. Only
+// the devices set down here are recorded, so that ResumeLinks doesn't bring up
+// the ones which were already down. The state is marked as paused even if some
+// devices fail. Save the state to persist it.
+func (s *State) PauseLinks(dryrun bool) error {
+	return s.Do(func(s *State) error {
+		var allerr error
+		for _, ns := range s.Namespaces {
+			if err := ns.PauseLinks(dryrun); err != nil {
+				allerr = multierr.Append(allerr, err)
+			}
+		}
+
+		s.Paused = true
+		return allerr
+	})
+}
+
+// ResumeLinks sets the devices paused by PauseLinks up again. The state stays
+// paused if any device fails.
+func (s *State) ResumeLinks(dryrun bool) error {
+	return s.Do(func(s *State) error {
+		var allerr error
+		for _, ns := range s.Namespaces {
+			if err := ns.ResumeLinks(dryrun); err != nil {
+				allerr = multierr.Append(allerr, err)
+			}
+		}
+		if allerr != nil {
+			return allerr
+		}
+
+		s.Paused = false
+		return nil
+	})
+}
+
+// SetCarrier turns the carrier of the device in the namespace on or off, which
+// simulates plugging or unplugging the cable. veths don't support setting the
+// carrier, so the peer of the veth is set down instead: the interface stays up
+// and the processes see only the carrier lost. Only the devices of direct links
+// and bridges have peers.
+func (s *State) SetCarrier(namespace string, dev string, on bool, dryrun bool) error {
+	return s.Do(func(s *State) error {
+		return s.setCarrier(namespace, dev, on, dryrun)
+	})
+}
+
+func (s *State) setCarrier(namespace string, dev string, on bool, dryrun bool) error {
+	ns := s.findNamespace(namespace)
+	if ns == nil {
+		return network.Errorf(network.ErrNotFound, "namespace %s is not found", namespace)
+	}
+
+	for i := range ns.RegisteredDeviceConfig {
+		cfg := &ns.RegisteredDeviceConfig[i]
+		if cfg.Name != dev {
+			continue
+		}
+
+		if len(cfg.AttachedVeth) == 0 {
+			return network.Errorf(network.ErrInactive, "device %s is not attached to ns %s", dev, namespace)
+		}
+
+		peer, peerNs, err := s.vethPeer(cfg.AttachedVeth, cfg.LinkName())
+		if err != nil {
+			return err
+		}
+
+		if peerNs != nil {
+			err = network.RunIpLinkSetState(peer, peerNs.Name, on, dryrun)
+		} else {
+			err = network.RunIpLinkSetHostState(peer, on, dryrun)
+		}
+		if err != nil {
+			return err
+		}
+
+		cfg.CarrierOff = !on
+		return nil
+	}
+
+	return network.Errorf(network.ErrNotFound, "device %s is not configured in ns %s", dev, namespace)
+}
+
+// vethPeer returns the other end of the veth of the link and the namespace
+// which it is attached to. The namespace is nil if the peer is on the host.
+func (s *State) vethPeer(veth string, link string) (string, *network.Namespace, error) {
+	peer := ""
+	if dl, ok := s.DirectLinks[link]; ok {
+		switch veth {
+		case dl.Left.Name:
+			peer = dl.Right.Name
+		case dl.Right.Name:
+			peer = dl.Left.Name
+		}
+	}
+	if br, ok := s.Bridges[link]; ok {
+		for _, pair := range br.VethPairs {
+			if pair.Left.Name == veth {
+				return pair.Right.Name, nil, nil
+			}
+		}
+	}
+	if peer == "" {
+		return "", nil, network.Errorf(network.ErrNotFound, "%s of link %s has no veth peer", veth, link)
+	}
+
+	for _, ns := range s.Namespaces {
+		for _, cfg := range ns.RegisteredDeviceConfig {
+			if cfg.AttachedVeth == peer {
+				return peer, ns, nil
+			}
+		}
+	}
+	return peer, nil, nil
+}
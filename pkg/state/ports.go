@@ -0,0 +1,78 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// ExposePort forwards the TCP port of the bind address on the host to the port
+// on the first address of the namespace, e.g. to curl the server in the
+// namespace from the host. The mapping is kept in the state and stopped on
+// dispose.
+func (s *State) ExposePort(namespace string, bind string, hostPort uint16, port uint16, dryrun bool) (*network.PortMapping, error) {
+	var m *network.PortMapping
+	err := s.Do(func(s *State) error {
+		var err error
+		m, err = s.exposePort(namespace, bind, hostPort, port, dryrun)
+		return err
+	})
+	return m, err
+}
+
+func (s *State) exposePort(namespace string, bind string, hostPort uint16, port uint16, dryrun bool) (*network.PortMapping, error) {
+	ns := s.findNamespace(namespace)
+	if ns == nil {
+		return nil, network.Errorf(network.ErrNotFound, "namespace %s is not found", namespace)
+	}
+	for _, m := range s.PortMappings {
+		if m.HostPort == hostPort {
+			return nil, network.Errorf(network.ErrAlreadyActive, "port %d has been already forwarded to ns %s", hostPort, m.Namespace)
+		}
+	}
+
+	addr := firstAddr(ns)
+	if addr == "" {
+		return nil, network.Errorf(network.ErrInactive, "namespace %s has no address", namespace)
+	}
+
+	m, err := network.StartPortForward(ns.Name, addr, bind, hostPort, port, dryrun)
+	if err != nil {
+		return nil, err
+	}
+	s.PortMappings = append(s.PortMappings, m)
+	return m, nil
+}
+
+// UnexposePort stops forwarding the host port started by ExposePort.
+func (s *State) UnexposePort(hostPort uint16, dryrun bool) error {
+	return s.Do(func(s *State) error {
+		return s.unexposePort(hostPort, dryrun)
+	})
+}
+
+func (s *State) unexposePort(hostPort uint16, dryrun bool) error {
+	for i, m := range s.PortMappings {
+		if m.HostPort != hostPort {
+			continue
+		}
+		if err := network.StopPortForward(m, dryrun); err != nil {
+			return err
+		}
+		s.PortMappings = append(s.PortMappings[:i], s.PortMappings[i+1:]...)
+		return nil
+	}
+	return network.Errorf(network.ErrNotFound, "port %d isn't forwarded", hostPort)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// ProfileEnv selects the active profile unless SetProfile is called.
+const ProfileEnv = "AYAME_PROFILE"
+
+var (
+	profile      string
+	profileRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+)
+
+// SetProfile selects the active profile. The state of the profile is saved as
+// ~/.ayame/<profile>/state.json, isolated from other profiles. The empty name
+// selects the default profile saved as ~/.ayame/state.json.
+func SetProfile(name string) error {
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+
+	profile = name
+	return nil
+}
+
+// ActiveProfile returns the profile set by SetProfile or AYAME_PROFILE. An
+// invalid AYAME_PROFILE is an error rather than the default profile, so that a
+// typo never selects the resources of another profile.
+func ActiveProfile() (string, error) {
+	if profile != "" {
+		return profile, nil
+	}
+
+	name := os.Getenv(ProfileEnv)
+	if err := validateProfile(name); err != nil {
+		return "", fmt.Errorf("%s: %w", ProfileEnv, err)
+	}
+
+	return name, nil
+}
+
+func validateProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	if !profileRegex.MatchString(name) || name == snapshotDirName {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+
+	return nil
+}
+
+// ListProfiles returns the profiles which have the saved state. The default
+// profile is returned as the empty name.
+func ListProfiles() ([]string, error) {
+	root, err := rootStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []string
+	if _, err := os.Stat(root + "/" + stateFileName); err == nil {
+		profiles = append(profiles, "")
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !f.IsDir() || validateProfile(f.Name()) != nil {
+			continue
+		}
+		if _, err := os.Stat(root + "/" + f.Name() + "/" + stateFileName); err != nil {
+			continue
+		}
+		profiles = append(profiles, f.Name())
+	}
+
+	return profiles, nil
+}
+
+// loadAllStates loads the saved states of all the profiles.
+func loadAllStates() ([]*State, error) {
+	profiles, err := ListProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := rootStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*State
+	for _, p := range profiles {
+		path := root + "/" + stateFileName
+		if p != "" {
+			path = root + "/" + p + "/" + stateFileName
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if s := LoadStateFromBytes(b); s != nil {
+			states = append(states, s)
+		}
+	}
+
+	return states, nil
+}
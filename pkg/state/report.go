@@ -0,0 +1,122 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// Report is the user facing view of the state. Unlike State, which keeps the
+// bookkeeping to manage resources, its JSON format is a stable contract: fields
+// may be added but existing ones are never renamed or removed.
+type Report struct {
+	// Prefix is the prefix of the names on the host. All the names in the report
+	// are logical names, i.e. without the prefix.
+	Prefix     string            `json:"prefix,omitempty"`
+	Links      []LinkReport      `json:"links"`
+	Namespaces []NamespaceReport `json:"namespaces"`
+	// Timings are the time spent on creating each resource, slowest first.
+	Timings []network.Timing `json:"timings,omitempty"`
+}
+
+type LinkReport struct {
+	Name string          `json:"name"`
+	Mode config.LinkMode `json:"mode"`
+}
+
+type NamespaceReport struct {
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Devices []DeviceReport    `json:"devices"`
+}
+
+type DeviceReport struct {
+	// Link is the name of the link which the device belongs to.
+	Link string `json:"link"`
+	// Interface is the name of the interface inside the namespace. It is empty
+	// if the device hasn't been attached.
+	Interface string `json:"interface"`
+	Cidr      string `json:"cidr"`
+	// Ipv6 is the address derived from the IPv6 prefix of the device.
+	Ipv6 string `json:"ipv6,omitempty"`
+}
+
+// Report builds the user facing view of the state.
+func (s *State) Report() (*Report, error) {
+	target := s
+	if s.Prefix != "" {
+		display, err := s.withoutPrefix()
+		if err != nil {
+			return nil, err
+		}
+		target = display
+	}
+
+	report := &Report{
+		Prefix:     s.Prefix,
+		Links:      []LinkReport{},
+		Namespaces: []NamespaceReport{},
+	}
+
+	for _, link := range target.DirectLinks {
+		report.Links = append(report.Links, LinkReport{Name: link.Name, Mode: config.ModeDirectLink})
+	}
+	for _, br := range target.Bridges {
+		report.Links = append(report.Links, LinkReport{Name: br.Name, Mode: config.ModeBridge})
+	}
+	for _, tunnel := range target.TunnelLinks {
+		report.Links = append(report.Links, LinkReport{Name: tunnel.Name, Mode: config.ModeTunnel})
+	}
+	for _, macvlan := range target.MacvlanLinks {
+		report.Links = append(report.Links, LinkReport{Name: macvlan.Name, Mode: config.ModeMacvlan})
+	}
+	sort.Slice(report.Links, func(i, j int) bool {
+		return report.Links[i].Name < report.Links[j].Name
+	})
+
+	for _, ns := range target.Namespaces {
+		nsReport := NamespaceReport{Name: ns.Name, Labels: ns.Labels, Devices: []DeviceReport{}}
+		for _, dev := range ns.RegisteredDeviceConfig {
+			nsReport.Devices = append(nsReport.Devices, DeviceReport{
+				Link:      dev.LinkName(),
+				Interface: dev.AttachedVeth,
+				Cidr:      dev.Cidr,
+				Ipv6:      dev.Ipv6Addr,
+			})
+		}
+		report.Namespaces = append(report.Namespaces, nsReport)
+	}
+
+	if len(target.Timings) != 0 {
+		report.Timings = append([]network.Timing{}, target.Timings...)
+		sort.SliceStable(report.Timings, func(i, j int) bool {
+			return report.Timings[i].Duration > report.Timings[j].Duration
+		})
+	}
+
+	return report, nil
+}
+
+func (r *Report) Dump() (string, error) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotDirName   = "snapshots"
+	snapshotExtension = ".json"
+)
+
+type SnapshotInfo struct {
+	Label     string    `json:"label"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func snapshotDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return dir + "/" + snapshotDirName, nil
+}
+
+func snapshotPath(label string) (string, error) {
+	if label == "" || strings.ContainsAny(label, "/\\") || strings.HasPrefix(label, ".") {
+		return "", fmt.Errorf("invalid snapshot label %q", label)
+	}
+
+	dir, err := snapshotDir()
+	if err != nil {
+		return "", err
+	}
+
+	return dir + "/" + label + snapshotExtension, nil
+}
+
+// Snapshot copies the current state file under the state directory. The
+// timestamp is used as the label if label is empty. It returns the label.
+func Snapshot(label string) (string, error) {
+	if label == "" {
+		label = time.Now().Format("20060102-150405")
+	}
+
+	dst, err := snapshotPath(label)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return "", fmt.Errorf("snapshot %s already exists", label)
+	}
+
+	src, err := stateFilePath()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to read state: %w", err)
+	}
+
+	dir, err := snapshotDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s", dir)
+	}
+
+	if err := writeFileAtomic(dst, b); err != nil {
+		return "", err
+	}
+
+	log.Infof("succeeded to save snapshot %s", label)
+
+	return label, nil
+}
+
+// Restore replaces the state file with the snapshot. The current resources
+// must have been disposed unless force is true, in which case the current
+// state file is overwritten as is.
+func Restore(label string, force bool) error {
+	src, err := snapshotPath(label)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", label, err)
+	}
+
+	var snapshot State
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return fmt.Errorf("failed to parse snapshot %s: %w", label, err)
+	}
+
+	version := snapshot.Version
+	if version == 0 {
+		version = 1
+	}
+	if version != StateVersion {
+		return fmt.Errorf("snapshot %s has state version %d but %d is supported", label, version, StateVersion)
+	}
+
+	if ResourcesSaved() && !force {
+		return network.Errorf(network.ErrAlreadyActive, "resources have already existed. dispose them before restore or force it")
+	}
+
+	dst, err := stateFilePath()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(dst, b); err != nil {
+		return err
+	}
+
+	log.Infof("succeeded to restore snapshot %s", label)
+
+	return nil
+}
+
+// ListSnapshots returns the snapshots sorted by creation time.
+func ListSnapshots() ([]SnapshotInfo, error) {
+	dir, err := snapshotDir()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), snapshotExtension) {
+			continue
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Label:     strings.TrimSuffix(f.Name(), snapshotExtension),
+			CreatedAt: f.ModTime(),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, nil
+}
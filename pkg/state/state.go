@@ -12,41 +12,181 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package state manages the resources created by ayame and their state file.
+//
+// All the operations are synchronous: goroutines started by an operation, e.g.
+// the pings of ConnectivityMatrix, finish before it returns. A type running in
+// the background must implement io.Closer which stops it deterministically.
 package state
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Shikugawa/ayame/pkg/config"
 	"github.com/Shikugawa/ayame/pkg/network"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
+// StateVersion is the schema version of the state file. It must be bumped on
+// incompatible changes of State.
+var StateVersion = 1
+
+// State is not safe for concurrent use: the network resources in it are mutated
+// in place, e.g. a device is marked as attached. The methods mutating the
+// state, e.g. SaveState, PauseLinks, ExposePort and DisposeWhere, run with Do,
+// which serializes them. Run any other access to the state shared between
+// goroutines with Do too.
 type State struct {
-	DirectLinks map[string]*network.DirectLink `json:"direct_links"`
-	Bridges     map[string]*network.Bridge     `json:"bridges"`
-	Namespaces  []*network.Namespace           `json:"namespaces"`
+	mu sync.Mutex
+
+	// Version is the schema version. It is set on SaveState, and the files saved
+	// before versioning are regarded as version 1.
+	Version      int                             `json:"version,omitempty"`
+	Prefix       string                          `json:"prefix,omitempty"`
+	DirectLinks  map[string]*network.DirectLink  `json:"direct_links"`
+	Bridges      map[string]*network.Bridge      `json:"bridges"`
+	TunnelLinks  map[string]*network.TunnelLink  `json:"tunnel_links,omitempty"`
+	MacvlanLinks map[string]*network.MacvlanLink `json:"macvlan_links,omitempty"`
+	Namespaces   []*network.Namespace            `json:"namespaces"`
+	// Paused is true while all the links are down by PauseLinks.
+	Paused bool `json:"paused,omitempty"`
+	// Timings are the time spent on creating each resource, in the order of
+	// creation. Dry-run has none.
+	Timings []network.Timing `json:"timings,omitempty"`
+	// PortMappings are the host ports forwarded to the namespaces by ExposePort.
+	PortMappings []*network.PortMapping `json:"port_mappings,omitempty"`
+	// Checksum is the SHA-256 of the state saved with the empty checksum. The
+	// files saved before checksums have none and aren't verified.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// IgnoreStateIntegrity loads the state even if Verify fails, e.g. to dispose
+// the resources of the state edited by hand on purpose.
+var IgnoreStateIntegrity = false
+
+const (
+	stateDirName  = ".ayame"
+	stateFileName = "state.json"
+)
+
+// rootStateDir returns the directory which contains the states of all the
+// profiles. It is resolved lazily so that an unset $HOME results in an error
+// rather than writing to /.ayame.
+func rootStateDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine state path: %w", err)
+	}
+	if home == "" {
+		return "", fmt.Errorf("failed to determine state path: home directory is empty")
+	}
+
+	return home + "/" + stateDirName, nil
+}
+
+// stateDir returns the directory to save the state of the active profile.
+func stateDir() (string, error) {
+	root, err := rootStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	profile, err := ActiveProfile()
+	if err != nil {
+		return "", err
+	}
+	if profile == "" {
+		return root, nil
+	}
+
+	return root + "/" + profile, nil
+}
+
+func stateFilePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return dir + "/" + stateFileName, nil
 }
 
-var statePath = os.Getenv("HOME") + "/.ayame"
+// Do runs f with the exclusive access to the state. f must not call Do again.
+func (s *State) Do(f func(s *State) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-const stateFileName = "state.json"
+	return f(s)
+}
 
+// Clone returns the deep copy of the state, which can be read without Do while
+// the original is mutated.
+func (s *State) Clone() (*State, error) {
+	var clone *State
+	err := s.Do(func(s *State) error {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		clone = LoadStateFromBytes(b)
+		if clone == nil {
+			return fmt.Errorf("failed to clone state")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// SaveState saves the state to the state file of the active profile.
 func (s *State) SaveState() error {
+	return s.Do(func(s *State) error {
+		return s.saveState()
+	})
+}
+
+// saveState is SaveState for the caller running with Do.
+func (s *State) saveState() error {
+	s.Version = StateVersion
+
+	sum, err := s.checksum()
+	if err != nil {
+		return err
+	}
+	s.Checksum = sum
+
 	b, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
+	statePath, err := stateDir()
+	if err != nil {
+		return err
+	}
+
 	if _, err := os.Stat(statePath); os.IsNotExist(err) {
-		if err := os.MkdirAll(statePath, 0644); err != nil {
+		if err := os.MkdirAll(statePath, 0755); err != nil {
 			return fmt.Errorf("failed to create %s", statePath)
 		}
 	}
 
-	if err := ioutil.WriteFile(statePath+"/"+stateFileName, b, 0644); err != nil {
+	if err := writeFileAtomic(statePath+"/"+stateFileName, b); err != nil {
 		return err
 	}
 
@@ -55,35 +195,324 @@ func (s *State) SaveState() error {
 	return nil
 }
 
+// writeFileAtomic writes to the temporary file in the same directory and renames
+// it over path, so that a crash in the middle of writing never leaves the
+// truncated file and the previous content stays loadable.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %s: %w", dir, err)
+	}
+
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		return cleanup(fmt.Errorf("failed to write %s: %w", tmp.Name(), err))
+	}
+	if err := tmp.Sync(); err != nil {
+		return cleanup(fmt.Errorf("failed to sync %s: %w", tmp.Name(), err))
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return cleanup(fmt.Errorf("failed to chmod %s: %w", tmp.Name(), err))
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), path, err)
+	}
+
+	return nil
+}
+
 func (s *State) DumpAll() (string, error) {
-	b, err := json.MarshalIndent(s, "", "  ")
+	target := s
+	if s.Prefix != "" {
+		display, err := s.withoutPrefix()
+		if err != nil {
+			return "", err
+		}
+		target = display
+	}
+
+	b, err := json.MarshalIndent(target, "", "  ")
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
 
+// DumpTable renders one row per device in aligned columns, sorted by namespace
+// then device.
+func (s *State) DumpTable() (string, error) {
+	target := s
+	if s.Prefix != "" {
+		display, err := s.withoutPrefix()
+		if err != nil {
+			return "", err
+		}
+		target = display
+	}
+
+	type row struct {
+		namespace string
+		device    string
+		cidr      string
+		link      string
+		attached  bool
+	}
+
+	var rows []row
+	for _, ns := range target.Namespaces {
+		for _, dev := range ns.RegisteredDeviceConfig {
+			rows = append(rows, row{
+				namespace: ns.Name,
+				device:    dev.AttachedVeth,
+				cidr:      dev.Cidr,
+				link:      dev.LinkName(),
+				attached:  len(dev.AttachedVeth) != 0,
+			})
+		}
+	}
+
+	if len(rows) == 0 {
+		return "no devices", nil
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].namespace != rows[j].namespace {
+			return rows[i].namespace < rows[j].namespace
+		}
+		return rows[i].device < rows[j].device
+	})
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tDEVICE\tCIDR\tLINK\tATTACHED")
+	for _, r := range rows {
+		device := r.device
+		if device == "" {
+			device = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", r.namespace, device, r.cidr, r.link, r.attached)
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// withoutPrefix returns a copy of the state whose names are the logical names
+// written in the config, i.e. with the prefix stripped.
+func (s *State) withoutPrefix() (*State, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var display State
+	if err := json.Unmarshal(b, &display); err != nil {
+		return nil, err
+	}
+
+	strip := func(name string) string {
+		return strings.TrimPrefix(name, s.Prefix+"-")
+	}
+	stripPair := func(pair *network.VethPair) {
+		pair.Left.Name = strip(pair.Left.Name)
+		pair.Right.Name = strip(pair.Right.Name)
+	}
+
+	dlinks := make(map[string]*network.DirectLink)
+	for name, link := range display.DirectLinks {
+		link.Name = strip(link.Name)
+		stripPair(&link.VethPair)
+		for i := range link.Endpoints {
+			link.Endpoints[i] = strip(link.Endpoints[i])
+		}
+		for i := range link.Namespaces {
+			link.Namespaces[i] = strip(link.Namespaces[i])
+		}
+		dlinks[strip(name)] = link
+	}
+	display.DirectLinks = dlinks
+
+	brs := make(map[string]*network.Bridge)
+	for name, br := range display.Bridges {
+		br.Name = strip(br.Name)
+		for _, pair := range br.VethPairs {
+			stripPair(pair)
+		}
+		brs[strip(name)] = br
+	}
+	display.Bridges = brs
+
+	if display.TunnelLinks != nil {
+		tunnels := make(map[string]*network.TunnelLink)
+		for name, tunnel := range display.TunnelLinks {
+			tunnel.Name = strip(tunnel.Name)
+			tunnel.Device.Name = strip(tunnel.Device.Name)
+			tunnels[strip(name)] = tunnel
+		}
+		display.TunnelLinks = tunnels
+	}
+
+	if display.MacvlanLinks != nil {
+		macvlans := make(map[string]*network.MacvlanLink)
+		for name, macvlan := range display.MacvlanLinks {
+			macvlan.Name = strip(macvlan.Name)
+			for _, dev := range macvlan.Devices {
+				dev.Name = strip(dev.Name)
+			}
+			macvlans[strip(name)] = macvlan
+		}
+		display.MacvlanLinks = macvlans
+	}
+
+	for _, ns := range display.Namespaces {
+		ns.Name = strip(ns.Name)
+		for i := range ns.RegisteredDeviceConfig {
+			dev := &ns.RegisteredDeviceConfig[i]
+			dev.Name = strip(dev.Name)
+			dev.Link = strip(dev.Link)
+			dev.AttachedVeth = strip(dev.AttachedVeth)
+		}
+		for i := range ns.Routes {
+			ns.Routes[i].Dev = strip(ns.Routes[i].Dev)
+			for j := range ns.Routes[i].Nexthops {
+				ns.Routes[i].Nexthops[j].Dev = strip(ns.Routes[i].Nexthops[j].Dev)
+			}
+		}
+		for i := range ns.Bonds {
+			for j := range ns.Bonds[i].Slaves {
+				ns.Bonds[i].Slaves[j] = strip(ns.Bonds[i].Slaves[j])
+			}
+		}
+	}
+
+	for i := range display.Timings {
+		display.Timings[i].Name = strip(display.Timings[i].Name)
+	}
+	for _, m := range display.PortMappings {
+		m.Namespace = strip(m.Namespace)
+	}
+
+	return &display, nil
+}
+
 func ResourcesSaved() bool {
-	if _, err := os.Stat(statePath + "/" + stateFileName); os.IsNotExist(err) {
+	path, err := stateFilePath()
+	if err != nil {
+		return false
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
+// checksum returns the SHA-256 of the state whose checksum is empty.
+func (s *State) checksum() (string, error) {
+	saved := s.Checksum
+	s.Checksum = ""
+	defer func() { s.Checksum = saved }()
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// Verify returns an error if the state was saved by a newer version of ayame or
+// has been modified after it was saved, e.g. edited by hand or truncated. Every
+// versioned state is saved with the checksum, so only the state saved before
+// versioning may lack it.
+func (s *State) Verify() error {
+	if s.Version > StateVersion {
+		return fmt.Errorf("state version %d is newer than the supported version %d", s.Version, StateVersion)
+	}
+	if s.Checksum == "" {
+		if s.Version == 0 {
+			return nil
+		}
+		return fmt.Errorf("state checksum is missing: the state file has been modified after it was saved")
+	}
+
+	sum, err := s.checksum()
+	if err != nil {
+		return err
+	}
+	if sum != s.Checksum {
+		return fmt.Errorf("state checksum mismatch: the state file has been modified after it was saved")
+	}
+	return nil
+}
+
+// LoadResources returns the saved state, or nil if there is none. The state
+// which fails Verify is refused unless IgnoreStateIntegrity is set. The migrated
+// state has no checksum to verify, and is saved again with the new one.
 func LoadResources() *State {
 	if !ResourcesSaved() {
 		return nil
 	}
 
-	b, err := ioutil.ReadFile(statePath + "/" + stateFileName)
+	path, err := stateFilePath()
 	if err != nil {
 		return nil
 	}
 
-	return LoadStateFromBytes(b)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	b, migrated, err := migrateState(b)
+	if err != nil {
+		log.Errorf("failed to load state %s: %s", path, err)
+		return nil
+	}
+
+	s := LoadStateFromBytes(b)
+	if s == nil {
+		log.Errorf("failed to parse state %s", path)
+		return nil
+	}
+
+	if migrated {
+		log.Infof("migrate state %s to version %d", path, StateVersion)
+		if err := s.SaveState(); err != nil {
+			log.Warnf("failed to save the migrated state: %s", err)
+		}
+	} else if err := s.Verify(); err != nil {
+		if !IgnoreStateIntegrity {
+			log.Errorf("refuse to load state %s: %s: use --force-state to load it anyway", path, err)
+			return nil
+		}
+		log.Warnf("load state %s anyway: %s", path, err)
+	}
+
+	return s
 }
 
+// LoadStateFromBytes parses the state, migrating it from an older version if
+// needed. It returns nil if the state can't be parsed.
 func LoadStateFromBytes(bytes []byte) *State {
+	bytes, _, err := migrateState(bytes)
+	if err != nil {
+		return nil
+	}
+
 	var state State
 	if err := json.Unmarshal(bytes, &state); err != nil {
 		return nil
@@ -92,38 +521,238 @@ func LoadStateFromBytes(bytes []byte) *State {
 	return &state
 }
 
-func DisposeResources() error {
+// DisposeResources deletes all the saved resources. Links are always deleted
+// before namespaces: deleting a namespace also deletes the devices inside it,
+// so the links must be cleaned up while their state still matches the host.
+// Links whose devices have already gone are treated as deleted.
+func DisposeResources() (*DisposeReport, error) {
+	return DisposeResourcesContext(context.Background())
+}
+
+// DisposeResourcesContext is DisposeResources which stops deleting further
+// resources once ctx is done. Resources which haven't been deleted are saved
+// back to the state so that a later run can finish the job. The state file is
+// removed only if every resource has been deleted.
+func DisposeResourcesContext(ctx context.Context) (*DisposeReport, error) {
+	return DisposeResourcesWithOptions(network.NewOptions(network.WithContext(ctx)))
+}
+
+// DisposeResourcesWithOptions is DisposeResourcesContext configured by opts. In
+// dry-run the resources to be deleted are reported as planned, and neither they
+// nor the state are touched.
+func DisposeResourcesWithOptions(opts *network.Options) (*DisposeReport, error) {
+	defer opts.Apply()()
+	ctx := opts.Context
+
+	path, err := stateFilePath()
+	if err != nil {
+		return nil, err
+	}
+
 	state := LoadResources()
+	if state == nil && ResourcesSaved() {
+		return nil, fmt.Errorf("state %s can't be loaded", path)
+	}
 	if state == nil {
-		return fmt.Errorf("resources have already cleared.")
+		return nil, network.Errorf(network.ErrInactive, "resources have already cleared.")
 	}
 
-	if err := network.CleanupDirectLinks(state.DirectLinks, false); err != nil {
-		return err
+	report := &DisposeReport{Items: []DisposeItem{}}
+	err = state.Do(func(state *State) error {
+		if opts.DryRun {
+			state.planDispose(report)
+			return nil
+		}
+
+		if err := state.dispose(ctx, report); err != nil {
+			if serr := state.saveState(); serr != nil {
+				return multierr.Append(err, serr)
+			}
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		// The state is gone, so whatever is left with its prefix is untracked.
+		if WarnOrphansOnDispose || CleanOrphansOnDispose {
+			return state.disposeOrphans(report)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// dispose deletes the resources in TeardownOrder and removes them from the
+// state. It continues past failures, but namespaces are deleted only if all the
+// links have been deleted. The outcome of every resource is recorded
+// in the report.
+func (s *State) dispose(ctx context.Context, report *DisposeReport) error {
+	type target struct {
+		kind    string
+		name    string
+		destroy func() error
+		forget  func()
 	}
-	if err := network.CleanupBridges(state.Bridges, false); err != nil {
-		return err
+
+	// run destroys the targets in order. Once ctx is done the rest are skipped.
+	run := func(targets []target) error {
+		var allerr error
+		for i, t := range targets {
+			if err := ctx.Err(); err != nil {
+				for _, rest := range targets[i:] {
+					report.add(rest.kind, rest.name, DisposeSkipped, err)
+				}
+				return multierr.Append(allerr, err)
+			}
+			started := time.Now()
+			if err := t.destroy(); err != nil {
+				report.add(t.kind, t.name, DisposeFailed, err)
+				allerr = multierr.Append(allerr, network.WithResource(err, t.kind+"/"+t.name))
+				continue
+			}
+			report.add(t.kind, t.name, DisposeDeleted, nil)
+			report.Items[len(report.Items)-1].Duration = time.Since(started)
+			t.forget()
+		}
+		return allerr
 	}
-	if err := network.CleanupNamespaces(state.Namespaces, false); err != nil {
-		return err
+
+	// The forwarders relay into the namespaces, so they are stopped first.
+	var ports []*network.PortMapping
+	for _, m := range s.PortMappings {
+		name := fmt.Sprint(m.HostPort)
+		if err := network.StopPortForward(m, false); err != nil {
+			report.add(DisposeKindPort, name, DisposeFailed, err)
+			ports = append(ports, m)
+			continue
+		}
+		report.add(DisposeKindPort, name, DisposeDeleted, nil)
+	}
+	s.PortMappings = ports
+
+	deleted := make(map[string]bool)
+	var links, nss []target
+	for _, step := range s.TeardownOrder() {
+		step := step
+		t := target{step.Kind, step.Name, func() error { return s.destroyStep(step, false) }, nil}
+		switch step.Kind {
+		case string(config.ModeDirectLink):
+			t.forget = func() { delete(s.DirectLinks, step.Name) }
+		case string(config.ModeBridge):
+			t.forget = func() { delete(s.Bridges, step.Name) }
+		case string(config.ModeTunnel):
+			t.forget = func() { delete(s.TunnelLinks, step.Name) }
+		case string(config.ModeMacvlan):
+			t.forget = func() { delete(s.MacvlanLinks, step.Name) }
+		case DisposeKindNamespace:
+			t.forget = func() { deleted[step.Name] = true }
+			nss = append(nss, t)
+			continue
+		}
+		links = append(links, t)
 	}
 
-	if err := os.Remove(statePath + "/" + stateFileName); err != nil {
+	if err := run(links); err != nil {
+		for _, ns := range s.Namespaces {
+			report.add(DisposeKindNamespace, ns.Name, DisposeSkipped, fmt.Errorf("links have not been deleted"))
+		}
 		return err
 	}
-	return nil
+
+	err := run(nss)
+
+	var remaining []*network.Namespace
+	for _, ns := range s.Namespaces {
+		if !deleted[ns.Name] {
+			remaining = append(remaining, ns)
+		}
+	}
+	s.Namespaces = remaining
+
+	return err
+}
+
+// sortedKeys returns the keys of the map of links in sorted order.
+func sortedKeys(links interface{}) []string {
+	var keys []string
+	switch m := links.(type) {
+	case map[string]*network.DirectLink:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*network.Bridge:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*network.TunnelLink:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*network.MacvlanLink:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // TODO: consider error handling
 func InitResources(cfg *config.Config, dryrun bool) (*State, error) {
-	state := LoadResources()
-	if state != nil {
-		return nil, fmt.Errorf("resources have already existed.")
+	return InitResourcesWithOptions(cfg, network.NewOptions(network.WithDryRun(dryrun)))
+}
+
+// InitSubset creates only the named namespaces and the links attached to them
+// as described in config.Subset. The state is disposed the same as the whole.
+func InitSubset(cfg *config.Config, namespaces []string, dryrun bool) (*State, error) {
+	sub, err := cfg.Subset(namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return InitResources(sub, dryrun)
+}
+
+// InitResourcesWithOptions is InitResources configured by opts. The context is
+// checked between the steps, and the created resources are cleaned up once it
+// is done.
+func InitResourcesWithOptions(cfg *config.Config, opts *network.Options) (*State, error) {
+	// The state file refused by LoadResources still blocks the creation, so that
+	// its resources aren't forgotten by overwriting it.
+	if ResourcesSaved() {
+		return nil, network.Errorf(network.ErrAlreadyActive, "resources have already existed.")
 	}
 
-	state = &State{Namespaces: nil, DirectLinks: nil, Bridges: nil}
+	return initResources(cfg, opts)
+}
+
+// initResources creates the resources of cfg regardless of the saved state,
+// e.g. to merge them into it.
+func initResources(cfg *config.Config, opts *network.Options) (*State, error) {
+	// Dry-run must not run any command, so it works without privileges.
+	if opts.DryRun && opts.Runner == nil {
+		dry := *opts
+		dry.Runner = network.RefuseRunner
+		opts = &dry
+	}
+
+	defer opts.Apply()()
+	dryrun := opts.DryRun
+	ctx := opts.Context
+
+	if err := cfg.ValidateNames(); err != nil {
+		return nil, err
+	}
+
+	stopTimings := network.CollectTimings()
+	defer stopTimings()
+
+	state := &State{Prefix: cfg.Prefix, Namespaces: nil, DirectLinks: nil, Bridges: nil}
 
 	cleanup := func(links map[string]*network.DirectLink, bridges map[string]*network.Bridge,
+		tunnels map[string]*network.TunnelLink, macvlans map[string]*network.MacvlanLink,
 		nss []*network.Namespace, dryrun bool) {
 		if links != nil {
 			network.CleanupDirectLinks(links, dryrun)
@@ -133,6 +762,14 @@ func InitResources(cfg *config.Config, dryrun bool) (*State, error) {
 			network.CleanupBridges(bridges, dryrun)
 		}
 
+		if tunnels != nil {
+			network.CleanupTunnelLinks(tunnels, dryrun)
+		}
+
+		if macvlans != nil {
+			network.CleanupMacvlanLinks(macvlans, dryrun)
+		}
+
 		if nss != nil {
 			network.CleanupNamespaces(nss, dryrun)
 		}
@@ -147,34 +784,194 @@ func InitResources(cfg *config.Config, dryrun bool) (*State, error) {
 	// Init Bridges
 	brs, err := network.InitBridges(cfg.Links, dryrun)
 	if err != nil {
-		cleanup(dlinks, nil, nil, dryrun)
+		cleanup(dlinks, nil, nil, nil, nil, dryrun)
+		return nil, err
+	}
+
+	// Init Tunnels
+	tunnels, err := network.InitTunnelLinks(cfg.Links, dryrun)
+	if err != nil {
+		cleanup(dlinks, brs, nil, nil, nil, dryrun)
+		return nil, err
+	}
+
+	// Init Macvlans
+	macvlans, err := network.InitMacvlanLinks(cfg.Links, dryrun)
+	if err != nil {
+		cleanup(dlinks, brs, tunnels, nil, nil, dryrun)
+		return nil, err
+	}
+
+	// Every link must be claimed by one of the link handlers above. Otherwise the
+	// link would silently vanish.
+	var unclaimed []string
+	for _, link := range cfg.Links {
+		_, isDirectLink := dlinks[link.Name]
+		_, isBridge := brs[link.Name]
+		_, isTunnel := tunnels[link.Name]
+		_, isMacvlan := macvlans[link.Name]
+		if !isDirectLink && !isBridge && !isTunnel && !isMacvlan {
+			unclaimed = append(unclaimed, fmt.Sprintf("%s (mode %q)", link.Name, link.LinkMode))
+		}
+	}
+	if len(unclaimed) != 0 {
+		cleanup(dlinks, brs, tunnels, macvlans, nil, dryrun)
+		return nil, fmt.Errorf("links with unsupported mode: %s", strings.Join(unclaimed, ", "))
+	}
+
+	if err := ctx.Err(); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, nil, dryrun)
 		return nil, err
 	}
 
 	// Init namespaces
 	ns, err := network.InitNamespaces(cfg.Namespaces, dryrun)
 	if err != nil {
-		cleanup(dlinks, brs, nil, dryrun)
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+		return nil, err
+	}
+
+	// Allocate addresses to the devices whose CIDR is auto
+	if err := network.AssignAddresses(ns, cfg.Links); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
 		return nil, err
 	}
 
 	// Link (Direct Links) Namespaces
+	network.ScriptComment("attach direct links to namespaces")
 	if err := network.InitNamespacesLinks(ns, dlinks, dryrun); err != nil {
-		cleanup(dlinks, brs, ns, dryrun)
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
 		return nil, err
 	}
 
 	// Link (Bridges) Namespaces
+	network.ScriptComment("attach bridges to namespaces")
 	if err := network.InitNamespacesBridges(ns, brs, dryrun); err != nil {
-		cleanup(dlinks, brs, ns, dryrun)
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+		return nil, err
+	}
+
+	// Link (Tunnels) Namespaces
+	network.ScriptComment("attach tunnels to namespaces")
+	if err := network.InitNamespacesTunnels(ns, tunnels, dryrun); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+		return nil, err
+	}
+
+	// Link (Macvlans) Namespaces
+	network.ScriptComment("attach macvlan links to namespaces")
+	if err := network.InitNamespacesMacvlans(ns, macvlans, dryrun); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+		return nil, err
+	}
+
+	// Move the host interfaces into namespaces
+	for _, n := range ns {
+		network.ScriptComment("host interfaces of namespace %s", n.Name)
+		if err := n.AdoptInterfaces(dryrun); err != nil {
+			cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+			return nil, err
+		}
+	}
+
+	// Create bonds inside namespaces
+	for _, n := range ns {
+		network.ScriptComment("bonds of namespace %s", n.Name)
+		if err := n.CreateBonds(dryrun); err != nil {
+			cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+			return nil, err
+		}
+	}
+
+	// Create dummies inside namespaces
+	for _, n := range ns {
+		network.ScriptComment("dummies of namespace %s", n.Name)
+		if err := n.CreateDummies(dryrun); err != nil {
+			cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+			return nil, err
+		}
+	}
+
+	// Both ends of all the links are up now, so DAD can finish.
+	for _, n := range ns {
+		if err := n.WaitForAddresses(dryrun); err != nil {
+			cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+			return nil, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
 		return nil, err
 	}
 
+	// Mark DSCP on links inside namespaces
+	network.ScriptComment("mark dscp")
+	for _, link := range cfg.Links {
+		if link.Dscp == nil {
+			continue
+		}
+		for _, n := range ns {
+			if err := n.MarkDscp(link.Name, *link.Dscp, dryrun); err != nil {
+				cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+				return nil, err
+			}
+		}
+	}
+
+	// Add routes and rules inside namespaces
+	for _, n := range ns {
+		for _, nscfg := range cfg.Namespaces {
+			if n.Name != nscfg.Name {
+				continue
+			}
+			network.ScriptComment("routes and rules of namespace %s", n.Name)
+			if err := n.ApplyRouting(nscfg.Routes, nscfg.Rules, dryrun); err != nil {
+				cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+				return nil, err
+			}
+		}
+	}
+
+	// Add firewall rules inside namespaces
+	for _, n := range ns {
+		for _, nscfg := range cfg.Namespaces {
+			if n.Name != nscfg.Name {
+				continue
+			}
+			network.ScriptComment("firewall of namespace %s", n.Name)
+			if err := n.ApplyFirewall(nscfg.Firewall, dryrun); err != nil {
+				cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+				return nil, err
+			}
+		}
+	}
+
+	// Run post setup inside namespaces
+	for _, n := range ns {
+		for _, nscfg := range cfg.Namespaces {
+			if n.Name != nscfg.Name {
+				continue
+			}
+			network.ScriptComment("post setup of namespace %s", n.Name)
+			if err := n.RunPostSetup(nscfg.PostSetup, dryrun); err != nil {
+				cleanup(dlinks, brs, tunnels, macvlans, ns, dryrun)
+				return nil, err
+			}
+		}
+	}
+
 	// Run Commands inside namespaces
 	for _, n := range ns {
 		// TODO: dirty
 		for _, nscfg := range cfg.Namespaces {
 			if n.Name == nscfg.Name {
+				network.ScriptComment("commands of namespace %s", n.Name)
 				n.RunCommands(nscfg.Commands, dryrun)
 			}
 		}
@@ -182,7 +979,14 @@ func InitResources(cfg *config.Config, dryrun bool) (*State, error) {
 
 	state.DirectLinks = dlinks
 	state.Bridges = brs
+	state.TunnelLinks = tunnels
+	if len(macvlans) != 0 {
+		state.MacvlanLinks = macvlans
+	}
 	state.Namespaces = ns
+	if timings := stopTimings(); len(timings) != 0 {
+		state.Timings = timings
+	}
 
 	return state, nil
 }
@@ -0,0 +1,176 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// attachedState returns the state of a namespace with an attached device.
+func attachedState() *State {
+	return &State{
+		Namespaces: []*network.Namespace{
+			{
+				Name: "ns1",
+				RegisteredDeviceConfig: []network.RegisteredDeviceConfig{
+					{
+						NamespaceDeviceConfig: config.NamespaceDeviceConfig{Name: "veth1", Cidr: "10.0.0.1/24"},
+						AttachedVeth:          "veth1-left",
+					},
+				},
+			},
+		},
+	}
+}
+
+// TestStateMutationsAreSerialized must be run with -race to be meaningful.
+func TestStateMutationsAreSerialized(t *testing.T) {
+	withTempHome(t)
+	st := attachedState()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	run := func(f func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := f(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	run(func(int) error { return st.PauseLinks(true) })
+	run(func(int) error { return st.ResumeLinks(true) })
+	run(func(int) error { return st.SaveState() })
+	run(func(i int) error {
+		if _, err := st.ExposePort("ns1", network.DefaultPortForwardBind, uint16(8080+i), 80, true); err != nil {
+			return err
+		}
+		return st.UnexposePort(uint16(8080+i), true)
+	})
+	run(func(int) error {
+		_, err := st.Clone()
+		return err
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSaveStateWithoutHome(t *testing.T) {
+	withTempHome(t)
+	os.Setenv("HOME", "")
+
+	if err := attachedState().SaveState(); err == nil {
+		t.Fatal("state is saved without $HOME")
+	}
+	if _, err := os.Stat("/" + stateDirName + "/" + stateFileName); err == nil {
+		t.Fatal("state is saved under /")
+	}
+}
+
+func TestTeardownOrderDeletesLinksFirst(t *testing.T) {
+	st := attachedState()
+	st.DirectLinks = map[string]*network.DirectLink{
+		"veth1": {Name: "veth1", VethPair: network.VethPair{Left: network.Veth{Name: "veth1-left", Attached: true}}},
+	}
+
+	steps := st.TeardownOrder()
+	if len(steps) != 2 {
+		t.Fatalf("unexpected steps: %v", steps)
+	}
+	if steps[0].Name != "veth1" || steps[1].Kind != DisposeKindNamespace {
+		t.Errorf("namespace is deleted before the link: %v", steps)
+	}
+	if len(steps[1].After) != 1 || steps[1].After[0] != "veth1" {
+		t.Errorf("namespace doesn't wait for the link: %v", steps[1])
+	}
+}
+
+func TestTornStateWriteKeepsOldState(t *testing.T) {
+	home := withTempHome(t)
+
+	if err := attachedState().SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(home, stateDirName, stateFileName)
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of the next save leaves the half written temporary
+	// file, which is never renamed over the state.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+stateFileName+".tmp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.Write(saved[:len(saved)/2]); err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+
+	st := LoadResources()
+	if st == nil {
+		t.Fatal("old state can't be loaded after the torn write")
+	}
+	if len(st.Namespaces) != 1 || st.Namespaces[0].Name != "ns1" {
+		t.Errorf("unexpected state: %+v", st)
+	}
+
+	// The state is still saved over the old one later.
+	st.Paused = true
+	if err := st.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	if st := LoadResources(); st == nil || !st.Paused {
+		t.Errorf("state isn't updated after the torn write: %+v", st)
+	}
+}
+
+func TestSaveStateOfProfileMakesSearchableDirs(t *testing.T) {
+	home := withTempHome(t)
+	if err := SetProfile("lab1"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { profile = "" }()
+
+	if err := attachedState().SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{filepath.Join(home, stateDirName), filepath.Join(home, stateDirName, "lab1")} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0100 == 0 {
+			t.Errorf("%s isn't searchable by the owner: %s", dir, info.Mode())
+		}
+	}
+}
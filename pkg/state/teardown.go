@@ -0,0 +1,128 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"go.uber.org/multierr"
+)
+
+// TeardownStep is a deletion in the teardown order. Kind is the link mode or
+// DisposeKindNamespace as in DisposeItem.
+type TeardownStep struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// After are the links which must be deleted before this step. Deleting a
+	// namespace first deletes the ends of the links inside it, so the links are
+	// deleted while their state still matches the host. The links whose devices
+	// have already gone are treated as deleted anyway.
+	After []string `json:"after,omitempty"`
+}
+
+// TeardownOrder returns the order in which dispose deletes the resources: the
+// direct links, the bridges, the tunnels and the macvlans sorted by name, and
+// then the namespaces after the links attached to them.
+func (s *State) TeardownOrder() []TeardownStep {
+	var steps []TeardownStep
+	links := make(map[string]bool)
+
+	add := func(mode config.LinkMode, names []string) {
+		for _, name := range names {
+			steps = append(steps, TeardownStep{Kind: string(mode), Name: name})
+			links[name] = true
+		}
+	}
+	add(config.ModeDirectLink, sortedKeys(s.DirectLinks))
+	add(config.ModeBridge, sortedKeys(s.Bridges))
+	add(config.ModeTunnel, sortedKeys(s.TunnelLinks))
+	add(config.ModeMacvlan, sortedKeys(s.MacvlanLinks))
+
+	for _, ns := range s.Namespaces {
+		step := TeardownStep{Kind: DisposeKindNamespace, Name: ns.Name}
+		for _, dev := range ns.RegisteredDeviceConfig {
+			if links[dev.LinkName()] {
+				step.After = append(step.After, dev.LinkName())
+			}
+		}
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+// destroyStep deletes the resource of the step without removing it from the state.
+func (s *State) destroyStep(step TeardownStep, dryrun bool) error {
+	switch step.Kind {
+	case string(config.ModeDirectLink):
+		return s.DirectLinks[step.Name].Destroy(dryrun)
+	case string(config.ModeBridge):
+		return s.Bridges[step.Name].Destroy(dryrun)
+	case string(config.ModeTunnel):
+		return s.TunnelLinks[step.Name].Destroy(dryrun)
+	case string(config.ModeMacvlan):
+		return s.MacvlanLinks[step.Name].Destroy(dryrun)
+	case DisposeKindNamespace:
+		if ns := s.findNamespace(step.Name); ns != nil {
+			return ns.Destroy(dryrun)
+		}
+	}
+	return fmt.Errorf("unknown %s %s", step.Kind, step.Name)
+}
+
+// PlanTeardown plans the deletions in TeardownOrder without running any
+// command, so that they are recorded in the audit log and the script. The
+// state is not changed.
+func (s *State) PlanTeardown() error {
+	defer network.NewOptions(network.WithDryRun(true), network.WithRunner(network.RefuseRunner)).Apply()()
+
+	var allerr error
+	for _, step := range s.TeardownOrder() {
+		network.ScriptComment("delete %s %s", step.Kind, step.Name)
+		if err := s.destroyStep(step, true); err != nil {
+			allerr = multierr.Append(allerr, err)
+		}
+	}
+	return allerr
+}
+
+func (s *State) findNamespace(name string) *network.Namespace {
+	for _, ns := range s.Namespaces {
+		if ns.Name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// DumpTeardownOrder renders one row per step in order.
+func DumpTeardownOrder(steps []TeardownStep) (string, error) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tKIND\tNAME\tAFTER")
+	for i, step := range steps {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, step.Kind, step.Name, strings.Join(step.After, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/network"
+)
+
+// MeasureThroughput measures the TCP throughput from the client namespace to
+// the server namespace over the link between them with iperf3. The address of
+// the server on the first link they share is used.
+func (s *State) MeasureThroughput(ctx context.Context, server string, client string, duration time.Duration) (*network.Throughput, error) {
+	srv := s.findNamespace(server)
+	if srv == nil {
+		return nil, network.Errorf(network.ErrNotFound, "namespace %s is not found", server)
+	}
+	cli := s.findNamespace(client)
+	if cli == nil {
+		return nil, network.Errorf(network.ErrNotFound, "namespace %s is not found", client)
+	}
+
+	links := make(map[string]bool)
+	for _, dev := range cli.RegisteredDeviceConfig {
+		if len(dev.AttachedVeth) != 0 {
+			links[dev.LinkName()] = true
+		}
+	}
+
+	for _, dev := range srv.RegisteredDeviceConfig {
+		if len(dev.AttachedVeth) == 0 || !links[dev.LinkName()] {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(dev.Cidr)
+		if err != nil {
+			continue
+		}
+		return network.MeasureThroughput(ctx, srv.Name, cli.Name, ip.String(), duration)
+	}
+
+	return nil, network.Errorf(network.ErrNotFound, "namespaces %s and %s don't share any link with address", server, client)
+}
@@ -0,0 +1,359 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"github.com/Shikugawa/ayame/pkg/network"
+	"github.com/fsnotify/fsnotify"
+	"github.com/r3labs/diff"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// ConfigDebounce is the quiet period after the last change of the config
+// before it is applied, so that an editor saving in several writes applies once.
+var ConfigDebounce = 500 * time.Millisecond
+
+// Apply changes the active resources created from last into the ones of cfg
+// and saves the state. cfg is planned in dry-run first, so a config which
+// can't be planned doesn't touch anything. Only the namespaces which differ
+// between the configs, and the links and the namespaces connected to them, are
+// recreated, and the others are kept untouched. If the creation fails, the
+// recreated part is created again from last. Everything is recreated if last
+// is nil or the prefix changes.
+func Apply(ctx context.Context, last *config.Config, cfg *config.Config) (*State, error) {
+	plan := network.NewOptions(network.WithContext(ctx), network.WithDryRun(true))
+	if _, err := initResources(cfg, plan); err != nil {
+		return nil, fmt.Errorf("failed to plan: %w", err)
+	}
+
+	if !ResourcesSaved() {
+		st, err := InitResourcesWithOptions(cfg, network.NewOptions(network.WithContext(ctx)))
+		if err != nil {
+			return nil, err
+		}
+		return st, st.SaveState()
+	}
+
+	st := LoadResources()
+	if st == nil {
+		return nil, fmt.Errorf("state can't be loaded")
+	}
+
+	var names map[string]bool
+	if last != nil && last.Prefix == cfg.Prefix {
+		names = changedNamespaces(last, cfg)
+	} else {
+		last = nil
+	}
+	if last != nil && len(names) == 0 {
+		return st, nil
+	}
+
+	err := st.Do(func(st *State) error {
+		sub := st
+		if last != nil {
+			var old []*network.Namespace
+			for _, ns := range st.Namespaces {
+				if names[ns.Name] {
+					old = append(old, ns)
+				}
+			}
+			var err error
+			if sub, err = st.subsetOf(old); err != nil {
+				return err
+			}
+		}
+
+		steps := sub.TeardownOrder()
+		derr := sub.dispose(ctx, &DisposeReport{})
+		st.forgetDisposed(steps, sub)
+		if derr != nil {
+			return multierr.Append(derr, st.saveState())
+		}
+
+		created, err := createSubset(ctx, cfg, names)
+		if err != nil {
+			log.Errorf("failed to apply the config: %s", err)
+			if last != nil {
+				restored, rerr := createSubset(ctx, last, names)
+				if rerr != nil {
+					err = multierr.Append(err, fmt.Errorf("failed to restore the last config: %w", rerr))
+				} else {
+					st.merge(restored)
+				}
+			}
+			return multierr.Append(err, st.save())
+		}
+
+		st.merge(created)
+		return st.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// createSubset creates the namespaces of cfg in names and their links, or all
+// of them if names is nil.
+func createSubset(ctx context.Context, cfg *config.Config, names map[string]bool) (*State, error) {
+	if names != nil {
+		var selected []string
+		for _, ns := range cfg.Namespaces {
+			if names[ns.Name] {
+				selected = append(selected, ns.Name)
+			}
+		}
+		if len(selected) == 0 {
+			return &State{}, nil
+		}
+
+		sub, err := cfg.Subset(selected)
+		if err != nil {
+			return nil, err
+		}
+		cfg = sub
+	}
+
+	return initResources(cfg, network.NewOptions(network.WithContext(ctx)))
+}
+
+// save saves the state, or removes the state file if nothing remains. The
+// caller must run it with Do.
+func (s *State) save() error {
+	if !s.empty() {
+		return s.saveState()
+	}
+
+	path, err := stateFilePath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// changedNamespaces returns the names of the namespaces of either config which
+// are added, removed or changed, the ones on the links added, removed or
+// changed, and the ones sharing links with them.
+func changedNamespaces(last *config.Config, cfg *config.Config) map[string]bool {
+	users := make(map[string]map[string]bool)
+	lastNamespaces := make(map[string]*config.NamespaceConfig)
+	newNamespaces := make(map[string]*config.NamespaceConfig)
+	for _, c := range []struct {
+		cfg        *config.Config
+		namespaces map[string]*config.NamespaceConfig
+	}{{last, lastNamespaces}, {cfg, newNamespaces}} {
+		for _, ns := range c.cfg.Namespaces {
+			c.namespaces[ns.Name] = ns
+			for _, dev := range ns.Devices {
+				if users[dev.LinkName()] == nil {
+					users[dev.LinkName()] = make(map[string]bool)
+				}
+				users[dev.LinkName()][ns.Name] = true
+			}
+		}
+	}
+
+	changed := make(map[string]bool)
+	for _, namespaces := range []map[string]*config.NamespaceConfig{lastNamespaces, newNamespaces} {
+		for name := range namespaces {
+			if !reflect.DeepEqual(lastNamespaces[name], newNamespaces[name]) {
+				changed[name] = true
+			}
+		}
+	}
+
+	lastLinks := make(map[string]*config.LinkConfig)
+	for _, link := range last.Links {
+		lastLinks[link.Name] = link
+	}
+	newLinks := make(map[string]*config.LinkConfig)
+	for _, link := range cfg.Links {
+		newLinks[link.Name] = link
+	}
+	for _, links := range []map[string]*config.LinkConfig{lastLinks, newLinks} {
+		for name := range links {
+			if !reflect.DeepEqual(lastLinks[name], newLinks[name]) {
+				for user := range users[name] {
+					changed[user] = true
+				}
+			}
+		}
+	}
+
+	// A link is recreated with all the namespaces on it.
+	for grown := true; grown; {
+		grown = false
+		for _, names := range users {
+			shared := false
+			for name := range names {
+				shared = shared || changed[name]
+			}
+			for name := range names {
+				if shared && !changed[name] {
+					changed[name] = true
+					grown = true
+				}
+			}
+		}
+	}
+
+	return changed
+}
+
+// ConfigWatcher applies the config every time it changes. It runs in the
+// background until Close or the cancellation of the context.
+type ConfigWatcher struct {
+	path    string
+	watcher *fsnotify.Watcher
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// last is the config which the active resources are created from.
+	last *config.Config
+}
+
+// WatchConfig starts watching the config file or directory given to
+// config.LoadConfig. The config is applied first unless resources exist, in
+// which case they are regarded as created from the current config. A config
+// which fails to load or to be planned is logged and ignored, and the changes
+// are applied as described in Apply. The included files outside the watched
+// path are not watched.
+func WatchConfig(ctx context.Context, path string) (*ConfigWatcher, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ResourcesSaved() {
+		if _, err := Apply(ctx, nil, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Editors often replace the file by rename, which drops the watch of the
+	// file itself, so its directory is watched instead.
+	dir := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &ConfigWatcher{
+		path:    path,
+		watcher: watcher,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		last:    cfg,
+	}
+	go w.run(ctx)
+
+	return w, nil
+}
+
+// Close stops watching and waits for the config being applied, if any.
+func (w *ConfigWatcher) Close() error {
+	w.cancel()
+	<-w.done
+	return w.watcher.Close()
+}
+
+func (w *ConfigWatcher) run(ctx context.Context) {
+	defer close(w.done)
+
+	timer := time.NewTimer(ConfigDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.relevant(ev.Name) {
+				continue
+			}
+			timer.Reset(ConfigDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("failed to watch %s: %s", w.path, err)
+		case <-timer.C:
+			w.reload(ctx)
+		}
+	}
+}
+
+// relevant reports whether the changed file is the config or in its directory.
+func (w *ConfigWatcher) relevant(name string) bool {
+	if filepath.Clean(name) == filepath.Clean(w.path) {
+		return true
+	}
+	ext := filepath.Ext(name)
+	return filepath.Dir(name) == filepath.Clean(w.path) && (ext == ".yaml" || ext == ".yml")
+}
+
+func (w *ConfigWatcher) reload(ctx context.Context) {
+	cfg, err := config.LoadConfig(w.path)
+	if err != nil {
+		log.Errorf("ignored the change of %s: %s", w.path, err)
+		return
+	}
+
+	if reflect.DeepEqual(cfg, w.last) {
+		return
+	}
+
+	changes, err := diff.Diff(w.last, cfg)
+	if err != nil {
+		log.Warnf("failed to diff config: %s", err)
+	}
+	for _, c := range changes {
+		log.Infof("config %s %s: %v -> %v", c.Type, strings.Join(c.Path, "."), c.From, c.To)
+	}
+
+	if _, err := Apply(ctx, w.last, cfg); err != nil {
+		log.Errorf("failed to apply %s: %s", w.path, err)
+		return
+	}
+
+	w.last = cfg
+	log.Infof("succeeded to apply %s", w.path)
+}
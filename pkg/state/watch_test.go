@@ -0,0 +1,190 @@
+// Copyright 2022 Rei Shimizu
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shikugawa/ayame/pkg/config"
+	"go.uber.org/goleak"
+)
+
+const watchedConfig = `
+links:
+  - name: veth1
+    mode: direct_link
+  - name: veth2
+    mode: direct_link
+namespaces:
+  - name: ns1
+    devices:
+      - name: veth1
+        cidr: 10.0.0.1/24
+  - name: ns2
+    devices:
+      - name: veth1
+        cidr: 10.0.0.2/24
+  - name: ns3
+    devices:
+      - name: veth2
+        cidr: 10.0.1.1/24
+  - name: ns4
+    devices:
+      - name: veth2
+        cidr: 10.0.1.2/24
+`
+
+// withTempHome points $HOME to a temporary directory for the test, so that the
+// state is saved there.
+func withTempHome(t *testing.T) string {
+	t.Helper()
+
+	home := t.TempDir()
+	prevHome, prevProfile := os.Getenv("HOME"), os.Getenv(ProfileEnv)
+	os.Setenv("HOME", home)
+	os.Unsetenv(ProfileEnv)
+	t.Cleanup(func() {
+		os.Setenv("HOME", prevHome)
+		os.Setenv(ProfileEnv, prevProfile)
+	})
+	return home
+}
+
+// writeState saves the raw state as the state of the default profile.
+func writeState(t *testing.T, home string, raw []byte) string {
+	t.Helper()
+
+	dir := filepath.Join(home, stateDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, stateFileName)
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigWatcherCloseLeaksNoGoroutine(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	home := withTempHome(t)
+	if err := (&State{}).SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(home, stateDirName, stateFileName)
+	prevSaved, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(watchedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prevDebounce := ConfigDebounce
+	ConfigDebounce = 10 * time.Millisecond
+	defer func() { ConfigDebounce = prevDebounce }()
+
+	// The saved resources are regarded as created from the config, so nothing
+	// is created on start.
+	w, err := WatchConfig(context.Background(), cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken edit is ignored without touching the resources.
+	if err := ioutil.WriteFile(cfgPath, []byte("namespaces: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * ConfigDebounce)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, prevSaved) {
+		t.Errorf("state is changed by the broken config: %s", saved)
+	}
+}
+
+func TestConfigWatcherStopsOnCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	home := withTempHome(t)
+	writeState(t, home, []byte(`{"namespaces": []}`))
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(cfgPath, []byte(watchedConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := WatchConfig(ctx, cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher doesn't stop on the cancellation")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangedNamespaces(t *testing.T) {
+	last, err := config.ParseConfig([]byte(watchedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.ParseConfig([]byte(watchedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := changedNamespaces(last, cfg); len(changed) != 0 {
+		t.Errorf("same configs have changes: %v", changed)
+	}
+
+	// ns2 is recreated with the link, and ns1 on the other end too.
+	cfg.Namespaces[1].Devices[0].Cidr = "10.0.0.3/24"
+	changed := changedNamespaces(last, cfg)
+	for _, name := range []string{"ns1", "ns2"} {
+		if !changed[name] {
+			t.Errorf("%s is not recreated: %v", name, changed)
+		}
+	}
+	for _, name := range []string{"ns3", "ns4"} {
+		if changed[name] {
+			t.Errorf("%s is recreated though it isn't changed: %v", name, changed)
+		}
+	}
+}